@@ -14,21 +14,28 @@ const (
 	CommandFunction
 	CommandSubshell
 	CommandGroup
+	CommandConditional
+	CommandNegation
+	CommandArithmetic
 )
 
 type Command struct {
-	Type       CommandType
-	Simple     *SimpleCommand
-	Pipeline   *Pipeline
-	Background *BackgroundCommand
-	List       *List
-	If         *IfCommand
-	For        *ForCommand
-	While      *WhileCommand
-	Case       *CaseCommand
-	Function   *FunctionCommand
-	Subshell   *SubshellCommand
-	Group      *GroupCommand
+	Type        CommandType
+	Text        string
+	Simple      *SimpleCommand
+	Pipeline    *Pipeline
+	Background  *BackgroundCommand
+	List        *List
+	If          *IfCommand
+	For         *ForCommand
+	While       *WhileCommand
+	Case        *CaseCommand
+	Function    *FunctionCommand
+	Subshell    *SubshellCommand
+	Group       *GroupCommand
+	Conditional *ConditionalCommand
+	Negation    *NegationCommand
+	Arithmetic  *ArithmeticCommand
 }
 
 type SimpleCommand struct {
@@ -60,7 +67,7 @@ type IfCommand struct {
 
 type ForCommand struct {
 	Variable string
-	Values   []string
+	Values   []Word
 	Body     *Command
 }
 
@@ -79,6 +86,23 @@ type CaseItem struct {
 	Command  *Command
 }
 
+// ConditionalCommand is a [[ ]] command. Its words are kept unexpanded,
+// with operators as separate unquoted words.
+type ConditionalCommand struct {
+	Words []Word
+}
+
+// NegationCommand is ! command, which succeeds when its command fails.
+type NegationCommand struct {
+	Command *Command
+}
+
+// ArithmeticCommand is ((expression)), which succeeds when the expression
+// is non-zero.
+type ArithmeticCommand struct {
+	Expression string
+}
+
 type FunctionCommand struct {
 	Name string
 	Body *Command
@@ -103,13 +127,21 @@ const (
 	RedirectInputOutput
 	RedirectHereDoc
 	RedirectHereString
+	RedirectBoth
+	RedirectBothAppend
+	RedirectDup
+	RedirectClobber
 )
 
+// Redirect applies to descriptor Source. For RedirectDup, Target is the
+// descriptor to copy, or "-" to close Source. For RedirectHereDoc, Target
+// is the delimiter and Quoted means the body is used without expansion.
 type Redirect struct {
 	Type    RedirectType
 	Source  int
 	Target  string
 	HereDoc string
+	Quoted  bool
 }
 
 type Word struct {
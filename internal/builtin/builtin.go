@@ -2,19 +2,41 @@ package builtin
 
 import (
 	"fmt"
+	"io"
 	"strconv"
 	"strings"
 )
 
-type BuiltinFunc func(args []string) int
+// IO holds the streams a builtin reads from and writes to, which are the
+// command's own after pipes and redirects rather than the process's.
+type IO struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Status is $? as the builtin starts, for those that default to it.
+	Status int
+}
+
+type BuiltinFunc func(stdio IO, args []string) int
+
+// Help documents a builtin for the help builtin: Usage is its synopsis,
+// Short a one-line description and Long any further lines of detail.
+type Help struct {
+	Usage string
+	Short string
+	Long  []string
+}
 
 type Manager struct {
 	builtins map[string]BuiltinFunc
+	help     map[string]Help
 }
 
 func New() *Manager {
 	return &Manager{
 		builtins: make(map[string]BuiltinFunc),
+		help:     make(map[string]Help),
 	}
 }
 
@@ -22,6 +44,18 @@ func (m *Manager) Register(name string, fn BuiltinFunc) {
 	m.builtins[name] = fn
 }
 
+// RegisterWithHelp registers fn as name along with its help.
+func (m *Manager) RegisterWithHelp(name string, fn BuiltinFunc, help Help) {
+	m.builtins[name] = fn
+	m.help[name] = help
+}
+
+// Help returns the help registered for name, if any.
+func (m *Manager) Help(name string) (Help, bool) {
+	help, exists := m.help[name]
+	return help, exists
+}
+
 func (m *Manager) Get(name string) BuiltinFunc {
 	return m.builtins[name]
 }
@@ -41,6 +75,7 @@ func (m *Manager) Exists(name string) bool {
 
 func (m *Manager) Remove(name string) {
 	delete(m.builtins, name)
+	delete(m.help, name)
 }
 
 func ParseIntArg(arg string) (int, error) {
@@ -0,0 +1,315 @@
+// Package conditional evaluates the operators shared by test, [ and the
+// [[ ]] compound command.
+package conditional
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gosh/internal/ast"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// IsUnary reports whether op is a unary test operator such as -f.
+func IsUnary(op string) bool {
+	switch op {
+	case "-z", "-n", "-e", "-f", "-d", "-r", "-w", "-x", "-s", "-L", "-h",
+		"-p", "-S", "-b", "-c", "-t":
+		return true
+	}
+	return false
+}
+
+// IsBinary reports whether op is a binary test operator such as -eq.
+func IsBinary(op string) bool {
+	switch op {
+	case "=", "==", "!=", "<", ">", "-eq", "-ne", "-lt", "-le", "-gt", "-ge",
+		"-nt", "-ot", "-ef":
+		return true
+	}
+	return false
+}
+
+// Unary applies the unary test operator op to operand.
+func Unary(op, operand string) (bool, error) {
+	switch op {
+	case "-z":
+		return operand == "", nil
+	case "-n":
+		return operand != "", nil
+	case "-r":
+		return unix.Access(operand, unix.R_OK) == nil, nil
+	case "-w":
+		return unix.Access(operand, unix.W_OK) == nil, nil
+	case "-x":
+		return unix.Access(operand, unix.X_OK) == nil, nil
+	case "-t":
+		fd, err := strconv.Atoi(operand)
+		if err != nil {
+			return false, fmt.Errorf("%s: integer expression expected", operand)
+		}
+		return term.IsTerminal(fd), nil
+	case "-L", "-h":
+		info, err := os.Lstat(operand)
+		return err == nil && info.Mode()&os.ModeSymlink != 0, nil
+	}
+
+	info, err := os.Stat(operand)
+	if err != nil {
+		return false, nil
+	}
+	mode := info.Mode()
+	switch op {
+	case "-f":
+		return mode.IsRegular(), nil
+	case "-d":
+		return mode.IsDir(), nil
+	case "-s":
+		return info.Size() > 0, nil
+	case "-p":
+		return mode&os.ModeNamedPipe != 0, nil
+	case "-S":
+		return mode&os.ModeSocket != 0, nil
+	case "-b":
+		return mode&os.ModeDevice != 0 && mode&os.ModeCharDevice == 0, nil
+	case "-c":
+		return mode&os.ModeCharDevice != 0, nil
+	}
+	return true, nil // -e
+}
+
+// Binary applies the binary test operator op to its operands. Integer
+// operators fail on operands that are not integers.
+func Binary(left, op, right string) (bool, error) {
+	switch op {
+	case "=", "==":
+		return left == right, nil
+	case "!=":
+		return left != right, nil
+	case "<":
+		return left < right, nil
+	case ">":
+		return left > right, nil
+	case "-nt", "-ot", "-ef":
+		l, lerr := os.Stat(left)
+		r, rerr := os.Stat(right)
+		switch op {
+		case "-nt":
+			return lerr == nil && (rerr != nil || l.ModTime().After(r.ModTime())), nil
+		case "-ot":
+			return rerr == nil && (lerr != nil || l.ModTime().Before(r.ModTime())), nil
+		}
+		return lerr == nil && rerr == nil && os.SameFile(l, r), nil
+	}
+
+	l, err := strconv.Atoi(strings.TrimSpace(left))
+	if err != nil {
+		return false, fmt.Errorf("%s: integer expression expected", left)
+	}
+	r, err := strconv.Atoi(strings.TrimSpace(right))
+	if err != nil {
+		return false, fmt.Errorf("%s: integer expression expected", right)
+	}
+	switch op {
+	case "-eq":
+		return l == r, nil
+	case "-ne":
+		return l != r, nil
+	case "-lt":
+		return l < r, nil
+	case "-le":
+		return l <= r, nil
+	case "-gt":
+		return l > r, nil
+	}
+	return l >= r, nil // -ge
+}
+
+// Eval evaluates the words of a [[ ]] command. Operators are recognized
+// only in unquoted words as written, and operands are passed to expand
+// one at a time, so expansions are never split and the right side of
+// && and || is not expanded when it cannot change the result.
+//
+// The right side of == and != is a pattern and that of =~ a POSIX
+// extended regular expression, both expanded by pattern, which keeps
+// quoted characters escaped so that they match literally. The match of =~
+// and its groups are passed to rematch, which gets nil if there was no
+// match.
+func Eval(words []ast.Word, expand func(string) string, pattern func(ast.Word) string, rematch func([]string)) (bool, error) {
+	if len(words) == 0 {
+		return false, fmt.Errorf("syntax error: empty conditional")
+	}
+
+	e := &evaluator{words: words, expand: expand, pattern: pattern, rematch: rematch}
+	result, err := e.or(true)
+	if err == nil && e.pos < len(e.words) {
+		err = fmt.Errorf("syntax error near `%s'", e.words[e.pos].Text)
+	}
+	return result, err
+}
+
+// evaluator parses or := and { || and }, and := not { && not },
+// not := ! not | primary. Each method takes whether to evaluate what it
+// parses, which is false in a branch that is short-circuited.
+type evaluator struct {
+	words   []ast.Word
+	pos     int
+	expand  func(string) string
+	pattern func(ast.Word) string
+	rematch func([]string)
+}
+
+// operator reports whether the next word is the unquoted operator op.
+func (e *evaluator) operator(op string) bool {
+	return e.pos < len(e.words) && !e.words[e.pos].Quoted && e.words[e.pos].Text == op
+}
+
+func (e *evaluator) or(eval bool) (bool, error) {
+	result, err := e.and(eval)
+	for err == nil && e.operator("||") {
+		e.pos++
+		var right bool
+		right, err = e.and(eval && !result)
+		result = result || right
+	}
+	return result, err
+}
+
+func (e *evaluator) and(eval bool) (bool, error) {
+	result, err := e.not(eval)
+	for err == nil && e.operator("&&") {
+		e.pos++
+		var right bool
+		right, err = e.not(eval && result)
+		result = result && right
+	}
+	return result, err
+}
+
+func (e *evaluator) not(eval bool) (bool, error) {
+	if e.operator("!") {
+		e.pos++
+		result, err := e.not(eval)
+		return !result, err
+	}
+	return e.primary(eval)
+}
+
+func (e *evaluator) primary(eval bool) (bool, error) {
+	if e.pos >= len(e.words) {
+		return false, fmt.Errorf("syntax error: unexpected end of conditional")
+	}
+
+	if e.operator("(") {
+		e.pos++
+		result, err := e.or(eval)
+		if err != nil {
+			return false, err
+		}
+		if !e.operator(")") {
+			return false, fmt.Errorf("syntax error: expected `)'")
+		}
+		e.pos++
+		return result, nil
+	}
+
+	word := e.words[e.pos]
+	if e.pos+2 < len(e.words) && !e.words[e.pos+1].Quoted && (IsBinary(e.words[e.pos+1].Text) || e.words[e.pos+1].Text == "=~") {
+		op, right := e.words[e.pos+1].Text, e.words[e.pos+2]
+		e.pos += 3
+		if !eval {
+			return false, nil
+		}
+		left := e.expand(word.Text)
+		switch op {
+		case "=", "==":
+			return match(e.pattern(right), left), nil
+		case "!=":
+			return !match(e.pattern(right), left), nil
+		case "=~":
+			return e.matchRegexp(left, right)
+		}
+		return Binary(left, op, e.expand(right.Text))
+	}
+
+	if !word.Quoted && IsUnary(word.Text) && e.pos+1 < len(e.words) {
+		operand := e.words[e.pos+1]
+		e.pos += 2
+		if !eval {
+			return false, nil
+		}
+		return Unary(word.Text, e.expand(operand.Text))
+	}
+
+	e.pos++
+	if !eval {
+		return false, nil
+	}
+	return e.expand(word.Text) != "", nil
+}
+
+func (e *evaluator) matchRegexp(s string, word ast.Word) (bool, error) {
+	pattern := e.pattern(word)
+	re, err := regexp.CompilePOSIX(pattern)
+	if err != nil {
+		return false, fmt.Errorf("%s: invalid regular expression", pattern)
+	}
+
+	groups := re.FindStringSubmatch(s)
+	if e.rematch != nil {
+		e.rematch(groups)
+	}
+	return groups != nil, nil
+}
+
+// match reports whether s matches the shell pattern.
+func match(pattern string, s string) bool {
+	re, err := regexp.Compile(patternRegexp(pattern))
+	if err != nil {
+		return pattern == s
+	}
+	return re.MatchString(s)
+}
+
+// patternRegexp translates a shell pattern with *, ? and [...] into an
+// anchored regular expression. Unlike filepath.Match, * also matches /.
+func patternRegexp(pattern string) string {
+	var b strings.Builder
+	b.WriteString("^(?s:")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			} else {
+				b.WriteString(`\\`)
+			}
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + strings.ReplaceAll(class, `\`, `\\`) + "]")
+			i += end + 1
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(")$")
+	return b.String()
+}
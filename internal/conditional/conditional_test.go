@@ -0,0 +1,137 @@
+package conditional
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"gosh/internal/ast"
+)
+
+// words returns the words of a conditional. One written in single
+// quotes is quoted, with the quotes removed.
+func words(spec ...string) []ast.Word {
+	list := make([]ast.Word, len(spec))
+	for i, text := range spec {
+		if len(text) >= 2 && text[0] == '\'' && text[len(text)-1] == '\'' {
+			list[i] = ast.Word{Text: text[1 : len(text)-1], Quoted: true}
+		} else {
+			list[i] = ast.Word{Text: text}
+		}
+	}
+	return list
+}
+
+func TestEval(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "f")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{"$a": "x", "$b": "n", "$f": file, "$missing": file + ".no", "$v": "a b"}
+
+	tests := []struct {
+		name  string
+		words []string
+		want  bool
+	}{
+		{"grouping", []string{"(", "$a", "==", "x", "||", "$b", "==", "y", ")", "&&", "-f", "$f"}, true},
+		{"grouping, file missing", []string{"(", "$a", "==", "x", "||", "$b", "==", "y", ")", "&&", "-f", "$missing"}, false},
+		{"grouping, neither side", []string{"(", "$a", "==", "z", "||", "$b", "==", "y", ")", "&&", "-f", "$f"}, false},
+		{"&& before ||", []string{"1", "||", "''", "&&", "''"}, true},
+		{"&& before || on the left", []string{"''", "&&", "1", "||", "1"}, true},
+		{"parentheses override", []string{"(", "1", "||", "''", ")", "&&", "''"}, false},
+		{"negation", []string{"!", "''", "&&", "1"}, true},
+		{"negated group", []string{"!", "(", "1", "&&", "''", ")"}, true},
+		{"double negation", []string{"!", "!", "1"}, true},
+		{"no splitting", []string{"$v", "==", "'a b'"}, true},
+		{"no splitting, -n", []string{"-n", "$v"}, true},
+		{"pattern", []string{"$a", "==", "x*"}, true},
+		{"quoted pattern", []string{"x", "==", "'x*'"}, false},
+		{"not equal", []string{"$a", "!=", "y"}, true},
+		{"integers", []string{"3", "-lt", "10"}, true},
+		{"strings", []string{"b", "<", "a"}, false},
+		{"empty", []string{"-z", "''"}, true},
+		{"quoted operator is a string", []string{"'!'"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expand := func(s string) string {
+				if value, ok := values[s]; ok {
+					return value
+				}
+				return s
+			}
+			pattern := func(w ast.Word) string {
+				if w.Quoted {
+					return regexp.QuoteMeta(w.Text)
+				}
+				return expand(w.Text)
+			}
+			got, err := Eval(words(tt.words...), expand, pattern, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("[[ %s ]] = %v, want %v", strings.Join(tt.words, " "), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvalShortCircuit(t *testing.T) {
+	tests := [][]string{
+		{"''", "&&", "$boom"},
+		{"1", "||", "$boom"},
+		{"1", "||", "(", "$boom", "==", "x", "&&", "-f", "$boom", ")"},
+		{"''", "&&", "$boom", "||", "1"},
+	}
+	for _, spec := range tests {
+		var expanded []string
+		expand := func(s string) string {
+			expanded = append(expanded, s)
+			return s
+		}
+		pattern := func(w ast.Word) string { return expand(w.Text) }
+		if _, err := Eval(words(spec...), expand, pattern, nil); err != nil {
+			t.Errorf("[[ %s ]]: %v", strings.Join(spec, " "), err)
+		}
+		for _, s := range expanded {
+			if s == "$boom" {
+				t.Errorf("[[ %s ]] expanded $boom", strings.Join(spec, " "))
+			}
+		}
+	}
+}
+
+func TestEvalRegexp(t *testing.T) {
+	var groups []string
+	identity := func(s string) string { return s }
+	pattern := func(w ast.Word) string { return w.Text }
+	ok, err := Eval(words("abc", "=~", "^a(b)"), identity, pattern, func(g []string) { groups = g })
+	if err != nil || !ok {
+		t.Fatalf("[[ abc =~ ^a(b) ]] = %v, %v; want true", ok, err)
+	}
+	if want := []string{"ab", "b"}; !reflect.DeepEqual(groups, want) {
+		t.Errorf("groups = %q, want %q", groups, want)
+	}
+}
+
+func TestEvalSyntaxErrors(t *testing.T) {
+	identity := func(s string) string { return s }
+	pattern := func(w ast.Word) string { return w.Text }
+	for _, spec := range [][]string{
+		{},
+		{"(", "1"},
+		{"1", ")"},
+		{"1", "&&"},
+		{"!"},
+		{"(", ")"},
+	} {
+		if _, err := Eval(words(spec...), identity, pattern, nil); err == nil {
+			t.Errorf("[[ %s ]] succeeded, want a syntax error", strings.Join(spec, " "))
+		}
+	}
+}
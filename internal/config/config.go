@@ -1,20 +1,39 @@
 package config
 
 type Config struct {
-	Command    string
-	ScriptFile string
-	ScriptArgs []string
-	ReadStdin  bool
+	Command     string
+	HasCommand  bool // -c was given, even with an empty string
+	CommandName string
+	CommandFile string
+	ScriptFile  string
+	ScriptArgs  []string
+	ReadStdin   bool
 
 	NoRC        bool
 	NoProfile   bool
 	POSIX       bool
+	ErrExit     bool
+	NoUnset     bool
+	NoGlob      bool
+	XTrace      bool
+	PipeFail    bool
 	Debug       bool
 	Interactive bool
 	Login       bool
+	JSON        bool
 
 	HistorySize    int
 	HistoryFile    string
+	HistoryAppend  bool
+	LitHist        bool
+	HupOnExit      bool
+	NoClobber      bool
+	ViMode         bool
+	GlobStar       bool
+	NullGlob       bool
+	FailGlob       bool
+	DotGlob        bool
+	NoCaseGlob     bool
 	MaxJobHistory  int
 	CommandTimeout int
 
@@ -31,6 +50,9 @@ func New() *Config {
 	return &Config{
 		HistorySize:    1000,
 		HistoryFile:    "~/.gosh_history",
+		HistoryAppend:  true,
+		LitHist:        true,
+		HupOnExit:      true,
 		MaxJobHistory:  100,
 		CommandTimeout: 0,
 
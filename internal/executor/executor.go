@@ -1,19 +1,31 @@
 package executor
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"os/exec"
+	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"gosh/internal/ast"
 	"gosh/internal/builtin"
+	"gosh/internal/conditional"
 	"gosh/internal/jobs"
 	"gosh/internal/parser"
 	"gosh/internal/variables"
+
+	"golang.org/x/sys/unix"
 )
 
 type Executor struct {
@@ -22,6 +34,35 @@ type Executor struct {
 	jobs      *jobs.Manager
 
 	lastExitCode int
+	timeout      time.Duration
+	noclobber    bool
+	noglob       bool
+	nounset      bool
+	xtrace       bool
+	pipefail     bool
+	glob         parser.GlobOptions
+	posix        func() bool
+
+	// terminal gives the terminal to a process group and returns the
+	// function that takes it back; nil when the shell has none to give.
+	terminal func(pgid int) func()
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+
+	fgMu       *sync.Mutex
+	foreground map[*exec.Cmd]bool
+
+	functions map[string]*ast.Command
+
+	// returning is set by the return builtin and stops every compound
+	// command up to the function call or sourced script it returns from.
+	// Copies made for pipelines share it.
+	returning *atomic.Bool
+
+	// redirects belong to the builtin being run, for exec.
+	redirects []*ast.Redirect
 }
 
 func New(vars *variables.Manager, builtins *builtin.Manager, jobs *jobs.Manager) *Executor {
@@ -30,6 +71,13 @@ func New(vars *variables.Manager, builtins *builtin.Manager, jobs *jobs.Manager)
 		builtins:     builtins,
 		jobs:         jobs,
 		lastExitCode: 0,
+		stdin:        os.Stdin,
+		stdout:       os.Stdout,
+		stderr:       os.Stderr,
+		fgMu:         &sync.Mutex{},
+		foreground:   make(map[*exec.Cmd]bool),
+		functions:    make(map[string]*ast.Command),
+		returning:    &atomic.Bool{},
 	}
 }
 
@@ -38,6 +86,11 @@ func (e *Executor) Execute(cmd *ast.Command) int {
 		return 0
 	}
 
+	e.lastExitCode = e.execute(cmd)
+	return e.lastExitCode
+}
+
+func (e *Executor) execute(cmd *ast.Command) int {
 	switch cmd.Type {
 	case ast.CommandSimple:
 		return e.executeSimple(cmd.Simple)
@@ -61,78 +114,563 @@ func (e *Executor) Execute(cmd *ast.Command) int {
 		return e.executeSubshell(cmd.Subshell)
 	case ast.CommandGroup:
 		return e.executeGroup(cmd.Group)
+	case ast.CommandConditional:
+		return e.executeConditional(cmd.Conditional)
+	case ast.CommandArithmetic:
+		return e.executeArithmetic(cmd.Arithmetic)
+	case ast.CommandNegation:
+		if e.Execute(cmd.Negation.Command) == 0 {
+			return 1
+		}
+		return 0
 	default:
 		return 1
 	}
 }
 
 func (e *Executor) executeSimple(cmd *ast.SimpleCommand) int {
-	if cmd == nil || cmd.Name == "" {
+	if cmd == nil {
 		return 0
 	}
 
-	idx := 0
-	for idx < len(cmd.Args)+1 {
-		var part string
-		if idx == 0 {
-			part = cmd.Name
-		} else {
-			part = cmd.Args[idx-1]
-		}
-		if strings.Contains(part, "=") && !strings.Contains(part, "/") {
-			kv := strings.SplitN(part, "=", 2)
-			e.variables.Set(kv[0], kv[1])
-			idx++
-			if idx == 1 {
-				if len(cmd.Args) > 0 {
-					cmd.Name = cmd.Args[0]
-					cmd.Args = cmd.Args[1:]
-					continue
-				} else {
-					return 0
+	words := append([]string{cmd.Name}, cmd.Args...)
+
+	// The parser moves assignments that precede a command into Env, so a
+	// leading assignment here means the command is nothing but
+	// assignments, which set shell variables.
+	if isAssignment(cmd.Name) {
+		if e.xtrace {
+			expanded := make([]string, len(words))
+			for i, word := range words {
+				expanded[i] = parser.ExpandWord(word, e.parameter)
+			}
+			e.trace(expanded)
+		}
+		for _, word := range words {
+			if err := e.assign(word); err != nil {
+				fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+				return 1
+			}
+		}
+		return 0
+	}
+
+	name, args, err := e.expandCommand(cmd)
+	if err != nil {
+		fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+		return 1
+	}
+	if e.xtrace {
+		e.trace(append([]string{name}, args...))
+	}
+
+	if body, exists := e.functions[name]; exists {
+		defer e.applyEnv(cmd.Env)()
+		if len(cmd.Redirects) == 0 {
+			return e.callFunction(body, args)
+		}
+		// The body runs with the redirected streams, as a pipeline stage
+		// does with its pipe.
+		stdio, closeRedirects, err := e.redirectStdio(cmd.Redirects)
+		if err != nil {
+			fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+			return 1
+		}
+		defer closeRedirects()
+		return e.withStdio(stdio).callFunction(body, args)
+	}
+
+	if fn := e.builtins.Get(name); fn != nil {
+		defer e.applyEnv(cmd.Env)()
+		defer func(saved []*ast.Redirect) { e.redirects = saved }(e.redirects)
+		e.redirects = cmd.Redirects
+		stdio, closeRedirects, err := e.redirectStdio(cmd.Redirects)
+		if err != nil {
+			fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+			return 1
+		}
+		defer closeRedirects()
+		return fn(stdio, args)
+	}
+
+	return e.executeExternal(name, args, cmd.Env, cmd.Redirects, e.timeout)
+}
+
+// expandCommand returns the expanded command name and arguments of cmd.
+func (e *Executor) expandCommand(cmd *ast.SimpleCommand) (string, []string, error) {
+	if e.nounset {
+		for _, word := range append([]string{cmd.Name}, cmd.Args...) {
+			if name, ok := parser.UnsetParameter(word, e.variables.IsSet); ok {
+				return "", nil, fmt.Errorf("%s: unbound variable", name)
+			}
+		}
+	}
+
+	name := cmd.Name
+	if needsExpansion(name) {
+		name = e.variables.SubstituteVariables(parser.ExpandTilde(name, false, e.home))
+	}
+
+	args := make([]string, 0, len(cmd.Args))
+	for _, arg := range cmd.Args {
+		// An array literal given to declare and the like keeps its
+		// quotes and escapes; ArrayElements expands each element.
+		if !needsExpansion(arg) || parser.IsArrayAssignment(arg) {
+			args = append(args, arg)
+			continue
+		}
+		for _, word := range e.expandBraces(arg) {
+			if elems, ok := e.listWord(word); ok {
+				args = append(args, elems...)
+				continue
+			}
+			word = parser.ExpandTilde(word, false, e.home)
+			if !e.noglob && parser.HasGlob(word) {
+				paths, err := e.expandGlob(word)
+				if err != nil {
+					return "", nil, err
 				}
-			} else {
-				cmd.Args = append(cmd.Args[:idx-1], cmd.Args[idx:]...)
+				args = append(args, paths...)
+				continue
+			}
+			args = append(args, parser.ExpandWord(word, e.parameter))
+		}
+	}
+	return name, args, nil
+}
+
+// expandGlob expands word into the paths it matches as a pattern. Only
+// the wildcards written in the word itself are active; those in the
+// values of variables match literally. When nothing matches, the word
+// stays as it is unless nullglob or failglob is set. POSIX mode turns
+// globstar off, leaving ** the same as *.
+func (e *Executor) expandGlob(word string) ([]string, error) {
+	opts := e.glob
+	if e.posixMode() {
+		opts.GlobStar = false
+	}
+
+	pattern := parser.ExpandPattern(word, true, e.parameter)
+	if paths := parser.ExpandGlobs(pattern, opts); paths != nil {
+		return paths, nil
+	}
+
+	switch {
+	case e.glob.NullGlob:
+		return nil, nil
+	case e.glob.FailGlob:
+		return nil, fmt.Errorf("no match: %s", parser.Unescape(pattern))
+	}
+	return []string{parser.Unescape(pattern)}, nil
+}
+
+// needsExpansion reports whether word has anything expansion could
+// change. Most words, like ls or -la, do not, and skip it entirely.
+func needsExpansion(word string) bool {
+	return strings.ContainsAny(word, "$`*?[]{}~'\"\\")
+}
+
+// applyEnv performs a command's leading assignments in the shell for the
+// duration of a builtin or function call, and returns the function that
+// undoes them. External commands get them through environ instead.
+func (e *Executor) applyEnv(env map[string]string) func() {
+	var restores []func()
+	for name, value := range env {
+		restores = append(restores, e.variables.Snapshot(name))
+		e.assign(name + "=" + value)
+		e.variables.Export(name)
+	}
+
+	return func() {
+		for i := len(restores) - 1; i >= 0; i-- {
+			restores[i]()
+		}
+	}
+}
+
+// environ returns the environment of an external command: the exported
+// variables, overridden by the command's leading assignments.
+func (e *Executor) environ(env map[string]string) []string {
+	exported := e.variables.Exported()
+	if len(env) == 0 {
+		return exported
+	}
+
+	result := make([]string, 0, len(exported)+len(env))
+	for _, kv := range exported {
+		name, _, _ := strings.Cut(kv, "=")
+		if _, overridden := env[name]; !overridden {
+			result = append(result, kv)
+		}
+	}
+	for name, value := range env {
+		result = append(result, name+"="+parser.ExpandWord(parser.ExpandTilde(value, true, e.home), e.parameter))
+	}
+	return result
+}
+
+// assign performs a name=value or name=(elements...) assignment word.
+func (e *Executor) assign(word string) error {
+	name, value, _ := strings.Cut(word, "=")
+	if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		return e.variables.AssignCompound(name, parser.ArrayElements(value[1:len(value)-1], e.parameter))
+	}
+	return e.variables.Set(name, parser.ExpandWord(parser.ExpandTilde(value, true, e.home), e.parameter))
+}
+
+// home returns the directory a tilde-prefix names: $HOME for ~, the home
+// directory of user for ~user, and $PWD and $OLDPWD for ~+ and ~-.
+func (e *Executor) home(name string) (string, bool) {
+	switch name {
+	case "":
+		if home := e.variables.Get("HOME"); home != "" {
+			return home, true
+		}
+		u, err := user.Current()
+		if err != nil {
+			return "", false
+		}
+		return u.HomeDir, true
+	case "+":
+		dir := e.variables.Get("PWD")
+		return dir, dir != ""
+	case "-":
+		dir := e.variables.Get("OLDPWD")
+		return dir, dir != ""
+	}
+
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", false
+	}
+	return u.HomeDir, true
+}
+
+// isAssignment reports whether word has the form name=value.
+func isAssignment(word string) bool {
+	eq := strings.IndexByte(word, '=')
+	return eq > 0 && variables.ValidName(word[:eq])
+}
+
+// listWord expands the words that stand for a list of values: $@ and
+// ${@} give the positional parameters, ${name[@]} the elements of an
+// array and ${!name[@]} its indices, each as a separate word.
+func (e *Executor) listWord(word string) ([]string, bool) {
+	if word == "$@" || word == "${@}" {
+		count, _ := strconv.Atoi(e.variables.Get("#"))
+		params := make([]string, count)
+		for i := range params {
+			params[i] = e.variables.Get(strconv.Itoa(i + 1))
+		}
+		return params, true
+	}
+
+	if !strings.HasPrefix(word, "${") || !strings.HasSuffix(word, "[@]}") {
+		return nil, false
+	}
+	name := word[2 : len(word)-4]
+	if strings.HasPrefix(name, "!") && variables.ValidName(name[1:]) {
+		return e.variables.Indices(name[1:]), true
+	}
+	if variables.ValidName(name) {
+		return e.variables.Elements(name), true
+	}
+	return nil, false
+}
+
+// hereInput returns the input of the last here-string or here-document
+// in redirects, or nil if there is none.
+func (e *Executor) hereInput(redirects []*ast.Redirect) io.Reader {
+	var stdin io.Reader
+	for _, redirect := range redirects {
+		switch redirect.Type {
+		case ast.RedirectHereString:
+			stdin = strings.NewReader(parser.ExpandWord(redirect.Target, e.parameter) + "\n")
+		case ast.RedirectHereDoc:
+			body := redirect.HereDoc
+			if !redirect.Quoted {
+				body = e.expandHereDoc(body)
+			}
+			stdin = strings.NewReader(body)
+		}
+	}
+	return stdin
+}
+
+// expandHereDoc performs the expansions of a here-document whose
+// delimiter was not quoted: parameters, $(...) and backslash escapes of
+// $, `, \ and newline. There is no word splitting or globbing.
+func (e *Executor) expandHereDoc(body string) string {
+	var b, chunk strings.Builder
+	flush := func() {
+		b.WriteString(parser.ExpandVariables(chunk.String(), e.parameter))
+		chunk.Reset()
+	}
+
+	for i := 0; i < len(body); i++ {
+		switch {
+		case body[i] == '\\' && i+1 < len(body) && strings.IndexByte("$`\\\n", body[i+1]) >= 0:
+			flush()
+			if body[i+1] != '\n' {
+				b.WriteByte(body[i+1])
+			}
+			i++
+		case strings.HasPrefix(body[i:], "$(") && !strings.HasPrefix(body[i:], "$(("):
+			end := parser.MatchingParen(body, i+1)
+			if end < 0 {
+				chunk.WriteByte(body[i])
 				continue
 			}
+			flush()
+			b.WriteString(e.commandOutput(body[i+2 : end]))
+			i = end
+		default:
+			chunk.WriteByte(body[i])
+		}
+	}
+	flush()
+
+	return b.String()
+}
+
+// commandOutput runs src as a command substitution and returns what it
+// wrote to stdout, without trailing newlines.
+func (e *Executor) commandOutput(src string) string {
+	commands, err := parser.New().Parse(src)
+	if err != nil {
+		fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+		return ""
+	}
+
+	var out bytes.Buffer
+	saved := e.stdout
+	e.stdout = &out
+	for _, cmd := range commands {
+		e.Execute(cmd)
+	}
+	e.stdout = saved
+
+	return strings.TrimRight(out.String(), "\n")
+}
+
+// Exec implements the exec builtin. With no arguments it applies the
+// redirects of the exec command to the shell itself. Otherwise it
+// replaces the shell process with the command and returns only on
+// failure, with status 127 if the command was not found and 126 if it
+// could not be run.
+func (e *Executor) Exec(args []string) (int, error) {
+	cmd := &exec.Cmd{}
+	if err := e.setupRedirects(cmd, e.redirects); err != nil {
+		return 1, err
+	}
+
+	if len(args) == 0 {
+		e.stdin, e.stdout, e.stderr = cmd.Stdin, cmd.Stdout, cmd.Stderr
+		if e.stdin == nil {
+			e.stdin = strings.NewReader("")
+		}
+		if e.stdout == nil {
+			e.stdout = io.Discard
+		}
+		if e.stderr == nil {
+			e.stderr = io.Discard
+		}
+		return 0, nil
+	}
+
+	path, err := e.findCommand(args[0])
+	if err != nil {
+		return 127, fmt.Errorf("%s: %v", args[0], err)
+	}
+
+	// The descriptors are replaced in place for the new process image, so
+	// the originals are kept aside to be restored if it cannot be run.
+	streams := []any{cmd.Stdin, cmd.Stdout, cmd.Stderr}
+	saved, err := saveFds()
+	if err != nil {
+		closeOpened(streams, e.stdin, e.stdout, e.stderr, os.Stdin, os.Stdout, os.Stderr)
+		return 126, fmt.Errorf("%s: %v", args[0], err)
+	}
+	defer closeFds(saved)
+
+	if err = replaceFds(streams, saved); err == nil {
+		err = syscall.Exec(path, args, e.environ(nil))
+	}
+
+	restoreFds(saved)
+	closeOpened(streams, e.stdin, e.stdout, e.stderr, os.Stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, syscall.ENOENT) {
+		return 127, fmt.Errorf("%s: %v", args[0], err)
+	}
+	return 126, fmt.Errorf("%s: %v", args[0], err)
+}
+
+// saveFds returns close-on-exec copies of descriptors 0 to 2, with -1
+// for any that is not open.
+func saveFds() ([]int, error) {
+	saved := []int{-1, -1, -1}
+	for fd := range saved {
+		dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 3)
+		if err == unix.EBADF {
+			continue
+		}
+		if err != nil {
+			closeFds(saved)
+			return nil, err
+		}
+		saved[fd] = dup
+	}
+	return saved, nil
+}
+
+// replaceFds points descriptors 0 to 2 at streams, closing those whose
+// stream is nil. A stream that is one of the original descriptors is
+// taken from saved, since that descriptor may already have been replaced.
+// Only files can be handed to another process; other streams are left
+// alone.
+func replaceFds(streams []any, saved []int) error {
+	for fd, stream := range streams {
+		if stream == nil {
+			unix.Close(fd)
+			continue
+		}
+		file, ok := stream.(*os.File)
+		if !ok {
+			continue
+		}
+		src := int(file.Fd())
+		if src < len(saved) {
+			src = saved[src]
+		}
+		if src == fd {
+			continue
+		}
+		if err := unix.Dup2(src, fd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreFds puts back the descriptors saved by saveFds.
+func restoreFds(saved []int) {
+	for fd, dup := range saved {
+		if dup < 0 {
+			unix.Close(fd)
+		} else {
+			unix.Dup2(dup, fd)
+		}
+	}
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		if fd >= 0 {
+			unix.Close(fd)
+		}
+	}
+}
+
+// closeOpened closes the files among streams that redirects opened,
+// leaving the shell's own streams open.
+func closeOpened(streams []any, own ...any) {
+	for _, stream := range streams {
+		file, ok := stream.(*os.File)
+		if !ok {
+			continue
+		}
+		shared := false
+		for _, o := range own {
+			shared = shared || o == stream
+		}
+		if !shared {
+			file.Close()
 		}
-		break
 	}
+}
 
-	name := e.variables.SubstituteVariables(cmd.Name)
-	args := make([]string, len(cmd.Args))
-	for i, arg := range cmd.Args {
-		expanded := parser.ExpandVariables(arg, e.variables.Get)
-		// arithmetic $(( ))
-		args[i] = expanded
+// RunCommand runs name as a builtin or external command with the given
+// streams, bypassing functions, for the command builtin.
+func (e *Executor) RunCommand(stdio builtin.IO, name string, args []string) int {
+	if fn := e.builtins.Get(name); fn != nil {
+		return fn(stdio, args)
 	}
+	return e.withStdio(stdio).executeExternal(name, args, nil, nil, e.timeout)
+}
 
-	if builtin := e.builtins.Get(name); builtin != nil {
-		return builtin(args)
+// IsFunction reports whether name is a defined shell function.
+func (e *Executor) IsFunction(name string) bool {
+	_, exists := e.functions[name]
+	return exists
+}
+
+// Functions returns the names of the defined shell functions.
+func (e *Executor) Functions() []string {
+	names := make([]string, 0, len(e.functions))
+	for name := range e.functions {
+		names = append(names, name)
 	}
+	return names
+}
 
-	return e.executeExternal(name, args, cmd.Redirects)
+// UnsetFunction removes the function name and reports whether it was
+// defined.
+func (e *Executor) UnsetFunction(name string) bool {
+	_, exists := e.functions[name]
+	delete(e.functions, name)
+	return exists
 }
 
-func (e *Executor) executeExternal(name string, args []string, redirects []*ast.Redirect) int {
+// LookPath returns the path of the external command name, searched for
+// in $PATH unless name contains a slash.
+func (e *Executor) LookPath(name string) (string, error) {
+	return e.findCommand(name)
+}
+
+// RunWithTimeout runs an external command, killing its process group
+// and returning 124 if it is still running after timeout.
+func (e *Executor) RunWithTimeout(stdio builtin.IO, name string, args []string, timeout time.Duration) int {
+	return e.withStdio(stdio).executeExternal(name, args, nil, nil, timeout)
+}
+
+func (e *Executor) executeExternal(name string, args []string, env map[string]string, redirects []*ast.Redirect, timeout time.Duration) int {
 	cmdPath, err := e.findCommand(name)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "gosh: %s: command not found\n", name)
+		fmt.Fprintf(e.stderr, "gosh: %s: command not found\n", name)
 		return 127
 	}
 
-	cmd := exec.Command(cmdPath, args...)
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	cmd := exec.CommandContext(ctx, cmdPath, args...)
+	if timeout > 0 {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+		cmd.Cancel = func() error {
+			return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		}
+	}
 
-	cmd.Env = e.variables.Exported()
+	cmd.Env = e.environ(env)
 
 	if err := e.setupRedirects(cmd, redirects); err != nil {
-		fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+		fmt.Fprintf(e.stderr, "gosh: %v\n", err)
 		return 1
 	}
 
-	if err := cmd.Run(); err != nil {
+	if err := e.runForeground(cmd); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return 124
+		}
 		if exitError, ok := err.(*exec.ExitError); ok {
 			if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
+				if status.Signaled() {
+					return 128 + int(status.Signal())
+				}
 				return status.ExitStatus()
 			}
 		}
@@ -142,7 +680,65 @@ func (e *Executor) executeExternal(name string, args []string, redirects []*ast.
 	return 0
 }
 
+// runForeground runs cmd to completion, recording it as a foreground
+// process so that SignalForeground can reach it while it runs.
+func (e *Executor) runForeground(cmd *exec.Cmd) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	untrack := e.TrackForeground(cmd)
+	defer untrack()
+
+	// A command in a process group of its own can only read the terminal
+	// once the group has it. One that tried sooner has stopped, so it is
+	// continued.
+	if attr := cmd.SysProcAttr; attr != nil && attr.Setpgid && e.terminal != nil {
+		defer e.terminal(cmd.Process.Pid)()
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGCONT)
+	}
+	return cmd.Wait()
+}
+
+// TrackForeground records cmd, which has been started, as a foreground
+// process until the returned function is called, so that
+// SignalForeground reaches it meanwhile. fg uses it for the job it waits
+// on.
+func (e *Executor) TrackForeground(cmd *exec.Cmd) func() {
+	e.fgMu.Lock()
+	e.foreground[cmd] = true
+	e.fgMu.Unlock()
+
+	return func() {
+		e.fgMu.Lock()
+		delete(e.foreground, cmd)
+		e.fgMu.Unlock()
+	}
+}
+
+// SignalForeground forwards sig to the running foreground commands and
+// reports whether there were any. Commands started in their own process
+// group get the signal sent to the whole group; the others share the
+// shell's group and already receive signals generated by the terminal.
+func (e *Executor) SignalForeground(sig syscall.Signal) bool {
+	e.fgMu.Lock()
+	defer e.fgMu.Unlock()
+
+	for cmd := range e.foreground {
+		if cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+			syscall.Kill(-cmd.Process.Pid, sig)
+		}
+	}
+
+	return len(e.foreground) > 0
+}
+
 func (e *Executor) findCommand(name string) (string, error) {
+	// An empty name can only come from a quoted empty word such as "",
+	// which like any other name that matches nothing is not found.
+	if name == "" {
+		return "", fmt.Errorf("command not found")
+	}
 	if strings.Contains(name, "/") {
 		if _, err := os.Stat(name); err == nil {
 			return name, nil
@@ -166,53 +762,176 @@ func (e *Executor) findCommand(name string) (string, error) {
 }
 
 func (e *Executor) setupRedirects(cmd *exec.Cmd, redirects []*ast.Redirect) error {
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = e.stdin, e.stdout, e.stderr
+
+	// Redirects apply left to right, so "2>&1 >file" leaves stderr on the
+	// original stdout while ">file 2>&1" sends both to file.
 	for _, redirect := range redirects {
+		var err error
+		if redirect.Type != ast.RedirectHereDoc && redirect.Type != ast.RedirectHereString {
+			// The target is a word like any other, as in >"$dir/out".
+			expanded := *redirect
+			expanded.Target = parser.ExpandWord(parser.ExpandTilde(redirect.Target, false, e.home), e.parameter)
+			redirect = &expanded
+		}
+		if fd, ok := deviceFd(redirect); ok {
+			// /dev/stdout and friends name the shell's own descriptors,
+			// which may not be files at all, so they are duplicated.
+			err = dupFd(cmd, redirect.Source, fd)
+			if err == nil && (redirect.Type == ast.RedirectBoth || redirect.Type == ast.RedirectBothAppend) {
+				err = dupFd(cmd, 2, fd)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
 		switch redirect.Type {
 		case ast.RedirectInput:
-			file, err := os.Open(redirect.Target)
-			if err != nil {
+			var file *os.File
+			if file, err = os.Open(redirect.Target); err != nil {
 				return fmt.Errorf("cannot open %s: %v", redirect.Target, err)
 			}
-			cmd.Stdin = file
+			err = redirectFd(cmd, redirect.Source, file)
+
+		case ast.RedirectOutput, ast.RedirectError, ast.RedirectClobber:
+			var file *os.File
+			if file, err = e.create(redirect.Target, redirect.Type == ast.RedirectClobber); err != nil {
+				return err
+			}
+			err = redirectFd(cmd, redirect.Source, file)
 
-		case ast.RedirectOutput:
-			file, err := os.Create(redirect.Target)
+		case ast.RedirectAppend, ast.RedirectErrorAppend:
+			var file *os.File
+			if file, err = os.OpenFile(redirect.Target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+				return fmt.Errorf("cannot open %s: %v", redirect.Target, err)
+			}
+			err = redirectFd(cmd, redirect.Source, file)
+
+		case ast.RedirectHereString, ast.RedirectHereDoc:
+			cmd.Stdin = e.hereInput([]*ast.Redirect{redirect})
+
+		case ast.RedirectDup:
+			err = dupFd(cmd, redirect.Source, redirect.Target)
+
+		case ast.RedirectBoth:
+			file, err := e.create(redirect.Target, false)
 			if err != nil {
-				return fmt.Errorf("cannot create %s: %v", redirect.Target, err)
+				return err
 			}
 			cmd.Stdout = file
+			cmd.Stderr = file
 
-		case ast.RedirectAppend:
+		case ast.RedirectBothAppend:
 			file, err := os.OpenFile(redirect.Target, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
 			if err != nil {
 				return fmt.Errorf("cannot open %s: %v", redirect.Target, err)
 			}
 			cmd.Stdout = file
-
-		case ast.RedirectError:
-			file, err := os.Create(redirect.Target)
-			if err != nil {
-				return fmt.Errorf("cannot create %s: %v", redirect.Target, err)
-			}
 			cmd.Stderr = file
 		}
+		if err != nil {
+			return err
+		}
 	}
 
-	if cmd.Stdin == nil {
-		cmd.Stdin = os.Stdin
+	return nil
+}
+
+// create opens name for an output redirect, truncating it. With
+// noclobber set and force unset, an existing regular file is an error,
+// though devices such as /dev/null can still be written.
+func (e *Executor) create(name string, force bool) (*os.File, error) {
+	if force || !e.noclobber {
+		file, err := os.Create(name)
+		if err != nil {
+			return nil, fmt.Errorf("cannot create %s: %v", name, err)
+		}
+		return file, nil
 	}
-	if cmd.Stdout == nil {
-		cmd.Stdout = os.Stdout
+
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if errors.Is(err, fs.ErrExist) {
+		if info, statErr := os.Stat(name); statErr == nil && !info.Mode().IsRegular() {
+			file, err = os.OpenFile(name, os.O_WRONLY, 0)
+		} else {
+			return nil, fmt.Errorf("%s: cannot overwrite existing file", name)
+		}
 	}
-	if cmd.Stderr == nil {
-		cmd.Stderr = os.Stderr
+	if err != nil {
+		return nil, fmt.Errorf("cannot create %s: %v", name, err)
 	}
+	return file, nil
+}
 
+// redirectFd points descriptor fd of cmd at stream. A nil stream closes
+// the descriptor, which the child sees as the null device.
+func redirectFd(cmd *exec.Cmd, fd int, stream any) error {
+	var ok bool
+	switch fd {
+	case 0:
+		cmd.Stdin, ok = stream.(io.Reader)
+	case 1:
+		cmd.Stdout, ok = stream.(io.Writer)
+	case 2:
+		cmd.Stderr, ok = stream.(io.Writer)
+	default:
+		return fmt.Errorf("%d: redirection of descriptors above 2 is not supported", fd)
+	}
+	if !ok && stream != nil {
+		return fmt.Errorf("%d: bad file descriptor", fd)
+	}
 	return nil
 }
 
+// deviceFd returns the descriptor named by the target of a file redirect
+// to /dev/stdin, /dev/stdout, /dev/stderr or /dev/fd/N.
+func deviceFd(redirect *ast.Redirect) (string, bool) {
+	switch redirect.Type {
+	case ast.RedirectHereString, ast.RedirectHereDoc, ast.RedirectDup:
+		return "", false
+	}
+
+	switch target := redirect.Target; target {
+	case "/dev/stdin":
+		return "0", true
+	case "/dev/stdout":
+		return "1", true
+	case "/dev/stderr":
+		return "2", true
+	default:
+		fd, ok := strings.CutPrefix(target, "/dev/fd/")
+		return fd, ok && fd != "" && strings.Trim(fd, "0123456789") == ""
+	}
+}
+
+// dupFd makes descriptor fd of cmd a copy of descriptor target, as in
+// 2>&1, or closes it when target is "-".
+func dupFd(cmd *exec.Cmd, fd int, target string) error {
+	if target == "-" {
+		return redirectFd(cmd, fd, nil)
+	}
+
+	var stream any
+	switch target {
+	case "0":
+		stream = cmd.Stdin
+	case "1":
+		stream = cmd.Stdout
+	case "2":
+		stream = cmd.Stderr
+	default:
+		return fmt.Errorf("%s: bad file descriptor", target)
+	}
+	if stream == nil {
+		return fmt.Errorf("%s: bad file descriptor", target)
+	}
+	return redirectFd(cmd, fd, stream)
+}
+
 func (e *Executor) executePipeline(pipeline *ast.Pipeline) int {
-	if pipeline == nil {
+	if pipeline == nil || pipeline.Left == nil || pipeline.Right == nil {
 		return 1
 	}
 
@@ -220,85 +939,31 @@ func (e *Executor) executePipeline(pipeline *ast.Pipeline) int {
 	if err != nil {
 		return 1
 	}
-	defer leftReader.Close()
-	defer leftWriter.Close()
-
-	var rightExitCode int
 
-	done := make(chan bool, 2)
+	// Each side runs with its own streams, so builtins, functions and
+	// compound commands take part in the pipe just as external commands
+	// do.
+	left := e.withStdio(builtin.IO{Stdin: e.stdin, Stdout: leftWriter, Stderr: e.stderr})
+	right := e.withStdio(builtin.IO{Stdin: leftReader, Stdout: e.stdout, Stderr: e.stderr})
 
+	var leftCode int
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		defer leftWriter.Close()
-
-		if pipeline.Left.Type == ast.CommandSimple {
-			cmd := pipeline.Left.Simple
-			if cmd != nil {
-				cmdPath, err := e.findCommand(cmd.Name)
-				if err == nil {
-					execCmd := exec.Command(cmdPath, cmd.Args...)
-					execCmd.Stdout = leftWriter
-					execCmd.Stderr = os.Stderr
-					execCmd.Stdin = os.Stdin
-					execCmd.Env = e.variables.Exported()
-
-					execCmd.Run()
-				} else {
-					// command lost
-				}
-			}
-		} else {
-			e.Execute(pipeline.Left)
-		}
-		done <- true
-	}()
-
-	go func() {
-		defer leftReader.Close()
-
-		if pipeline.Right.Type == ast.CommandSimple {
-			cmd := pipeline.Right.Simple
-			if cmd != nil {
-				if builtin := e.builtins.Get(cmd.Name); builtin != nil {
-					oldStdin := os.Stdin
-					os.Stdin = leftReader
-					rightExitCode = builtin(cmd.Args)
-					os.Stdin = oldStdin
-				} else {
-					cmdPath, err := e.findCommand(cmd.Name)
-					if err == nil {
-						execCmd := exec.Command(cmdPath, cmd.Args...)
-						execCmd.Stdin = leftReader
-						execCmd.Stdout = os.Stdout
-						execCmd.Stderr = os.Stderr
-						execCmd.Env = e.variables.Exported()
-
-						if err := execCmd.Run(); err != nil {
-							if exitError, ok := err.(*exec.ExitError); ok {
-								if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
-									rightExitCode = status.ExitStatus()
-								}
-							} else {
-								rightExitCode = 1
-							}
-						}
-					} else {
-						rightExitCode = 127
-					}
-				}
-			}
-		} else {
-			oldStdin := os.Stdin
-			os.Stdin = leftReader
-			rightExitCode = e.Execute(pipeline.Right)
-			os.Stdin = oldStdin
-		}
-		done <- true
+		leftCode = left.Execute(pipeline.Left)
 	}()
 
-	<-done
+	code := right.Execute(pipeline.Right)
+	leftReader.Close()
 	<-done
 
-	return rightExitCode
+	// With pipefail the status is the rightmost failure. Nested
+	// pipelines have already reduced their own stages the same way.
+	if e.pipefail && code == 0 {
+		return leftCode
+	}
+	return code
 }
 
 func (e *Executor) executeBackground(bg *ast.BackgroundCommand) int {
@@ -306,10 +971,49 @@ func (e *Executor) executeBackground(bg *ast.BackgroundCommand) int {
 		return 1
 	}
 
-	go func() {
-		e.Execute(bg.Command)
-	}()
+	// An external command becomes a job with its own process group, so
+	// that a Ctrl-C meant for the foreground does not reach it. Anything
+	// else runs in a goroutine registered as a job without a process.
+	if cmd := bg.Command; cmd != nil && cmd.Type == ast.CommandSimple && cmd.Simple != nil && !isAssignment(cmd.Simple.Name) {
+		name, args, err := e.expandCommand(cmd.Simple)
+		if err != nil {
+			fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+			return 1
+		}
+		if e.functions[name] == nil && e.builtins.Get(name) == nil {
+			return e.startJob(cmd.Text, name, args, cmd.Simple)
+		}
+	}
 
+	// The job runs alongside the shell, on an executor of its own.
+	sub := e.subshell()
+	e.jobs.AddFunc(bg.Command.Text, func() int {
+		return sub.Execute(bg.Command)
+	})
+	return 0
+}
+
+func (e *Executor) startJob(text, name string, args []string, simple *ast.SimpleCommand) int {
+	cmdPath, err := e.findCommand(name)
+	if err != nil {
+		fmt.Fprintf(e.stderr, "gosh: %s: command not found\n", name)
+		return 127
+	}
+
+	cmd := exec.Command(cmdPath, args...)
+	cmd.Env = e.environ(simple.Env)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := e.setupRedirects(cmd, simple.Redirects); err != nil {
+		fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+		return 1
+	}
+	if err := cmd.Start(); err != nil {
+		fmt.Fprintf(e.stderr, "gosh: %s: %v\n", name, err)
+		return 126
+	}
+
+	e.jobs.Add(cmd, text)
+	e.variables.Set("!", strconv.Itoa(cmd.Process.Pid))
 	return 0
 }
 
@@ -318,22 +1022,28 @@ func (e *Executor) executeList(list *ast.List) int {
 		return 0
 	}
 
+	// A command after && runs only if the status so far is 0 and one
+	// after || only if it is not. A skipped command leaves the status
+	// for the next operator, so a && b || c runs c when a fails.
 	var exitCode int
 	for i, cmd := range list.Commands {
-		exitCode = e.Execute(cmd)
-
-		if i < len(list.Operators) {
-			switch list.Operators[i] {
+		if i > 0 && i <= len(list.Operators) {
+			switch list.Operators[i-1] {
 			case "&&":
 				if exitCode != 0 {
-					return exitCode
+					continue
 				}
 			case "||":
 				if exitCode == 0 {
-					return exitCode
+					continue
 				}
 			}
 		}
+
+		exitCode = e.Execute(cmd)
+		if e.Returning() {
+			return exitCode
+		}
 	}
 
 	return exitCode
@@ -345,6 +1055,9 @@ func (e *Executor) executeIf(ifCmd *ast.IfCommand) int {
 	}
 
 	conditionResult := e.Execute(ifCmd.Condition)
+	if e.Returning() {
+		return conditionResult
+	}
 
 	if conditionResult == 0 {
 		return e.Execute(ifCmd.Then)
@@ -352,6 +1065,8 @@ func (e *Executor) executeIf(ifCmd *ast.IfCommand) int {
 		return e.Execute(ifCmd.Else)
 	}
 
+	// With no branch run, the status is 0 even though the condition
+	// failed.
 	return 0
 }
 
@@ -360,10 +1075,47 @@ func (e *Executor) executeFor(forCmd *ast.ForCommand) int {
 		return 1
 	}
 
-	var exitCode int
-	for _, value := range forCmd.Values {
+	var values []string
+	for _, word := range forCmd.Values {
+		for _, text := range e.expandBraces(word.Text) {
+			if elems, ok := e.listWord(text); ok {
+				if word.Quoted {
+					values = append(values, elems...)
+					continue
+				}
+				for _, elem := range elems {
+					values = append(values, e.variables.SplitFields(elem, -1)...)
+				}
+				continue
+			}
+			text = parser.ExpandTilde(text, false, e.home)
+			if !e.noglob && parser.HasGlob(text) {
+				paths, err := e.expandGlob(text)
+				if err != nil {
+					fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+					return 1
+				}
+				values = append(values, paths...)
+				continue
+			}
+			expanded := parser.ExpandWord(text, e.parameter)
+			if word.Quoted || !strings.Contains(text, "$") {
+				values = append(values, expanded)
+				continue
+			}
+			values = append(values, e.variables.SplitFields(expanded, -1)...)
+		}
+	}
+
+	// A loop over no words succeeds, and otherwise its status is that
+	// of the last run of its body.
+	exitCode := 0
+	for _, value := range values {
 		e.variables.Set(forCmd.Variable, value)
 		exitCode = e.Execute(forCmd.Body)
+		if e.Returning() {
+			break
+		}
 	}
 
 	return exitCode
@@ -374,13 +1126,26 @@ func (e *Executor) executeWhile(whileCmd *ast.WhileCommand) int {
 		return 1
 	}
 
-	var exitCode int
+	// An empty condition would succeed forever.
+	if whileCmd.Condition == nil {
+		return 0
+	}
+
+	// The status is that of the last run of the body, or 0 if the
+	// condition failed the first time.
+	exitCode := 0
 	for {
 		conditionResult := e.Execute(whileCmd.Condition)
+		if e.Returning() {
+			return conditionResult
+		}
 		if conditionResult != 0 {
 			break
 		}
 		exitCode = e.Execute(whileCmd.Body)
+		if e.Returning() {
+			break
+		}
 	}
 
 	return exitCode
@@ -404,14 +1169,91 @@ func (e *Executor) executeCase(caseCmd *ast.CaseCommand) int {
 	return 0
 }
 
+// executeArithmetic evaluates ((expression)) after expanding the
+// parameters in it, and succeeds if the result is not zero.
+func (e *Executor) executeArithmetic(arith *ast.ArithmeticCommand) int {
+	value, err := e.variables.EvalArithmetic(parser.ExpandVariables(arith.Expression, e.parameter))
+	if err != nil {
+		fmt.Fprintf(e.stderr, "gosh: ((: %v\n", err)
+		return 1
+	}
+	if value == 0 {
+		return 1
+	}
+	return 0
+}
+
+func (e *Executor) executeConditional(condCmd *ast.ConditionalCommand) int {
+	if condCmd == nil {
+		return 1
+	}
+
+	result, err := conditional.Eval(condCmd.Words, func(word string) string {
+		return parser.ExpandWord(word, e.parameter)
+	}, func(word ast.Word) string {
+		return parser.ExpandPattern(word.Text, word.Quoted, e.parameter)
+	}, func(groups []string) {
+		e.variables.SetArray("BASH_REMATCH", groups)
+	})
+	if err != nil {
+		fmt.Fprintf(e.stderr, "gosh: %v\n", err)
+		return 2
+	}
+	if result {
+		return 0
+	}
+	return 1
+}
+
 func (e *Executor) executeFunction(funcCmd *ast.FunctionCommand) int {
 	if funcCmd == nil {
 		return 1
 	}
 
+	e.functions[funcCmd.Name] = funcCmd.Body
 	return 0
 }
 
+// callFunction runs a function body in a new variable scope, with args
+// as its positional parameters.
+func (e *Executor) callFunction(body *ast.Command, args []string) int {
+	e.variables.PushScope()
+	defer e.variables.PopScope()
+
+	params := map[string]string{
+		"#": strconv.Itoa(len(args)),
+		"@": strings.Join(args, " "),
+		"*": strings.Join(args, " "),
+	}
+	for i, arg := range args {
+		params[strconv.Itoa(i+1)] = arg
+	}
+	for name, value := range params {
+		e.variables.SetLocal(name, value)
+	}
+
+	code := e.Execute(body)
+	e.Returned()
+	return code
+}
+
+// Return makes the running function or sourced script stop once the
+// command that called it, the return builtin, finishes.
+func (e *Executor) Return() {
+	e.returning.Store(true)
+}
+
+// Returning reports whether a return is stopping the running commands.
+func (e *Executor) Returning() bool {
+	return e.returning.Load()
+}
+
+// Returned ends a return once it reaches the function call or sourced
+// script it returns from, and reports whether there was one.
+func (e *Executor) Returned() bool {
+	return e.returning.Swap(false)
+}
+
 func (e *Executor) executeSubshell(subCmd *ast.SubshellCommand) int {
 	if subCmd == nil {
 		return 1
@@ -428,11 +1270,24 @@ func (e *Executor) executeGroup(groupCmd *ast.GroupCommand) int {
 	var exitCode int
 	for _, cmd := range groupCmd.Commands {
 		exitCode = e.Execute(cmd)
+		if e.Returning() {
+			break
+		}
 	}
 
 	return exitCode
 }
 
+// parameter returns the value of the parameter expr for expansion. $? is
+// this executor's own status, which for a background job is not the
+// shell's.
+func (e *Executor) parameter(expr string) string {
+	if expr == "?" {
+		return strconv.Itoa(e.lastExitCode)
+	}
+	return e.variables.Parameter(expr)
+}
+
 func (e *Executor) GetLastExitCode() int {
 	return e.lastExitCode
 }
@@ -441,6 +1296,199 @@ func (e *Executor) SetLastExitCode(code int) {
 	e.lastExitCode = code
 }
 
+func (e *Executor) SetTimeout(timeout time.Duration) {
+	e.timeout = timeout
+}
+
+func (e *Executor) Timeout() time.Duration {
+	return e.timeout
+}
+
+// SetNoClobber makes > and &> refuse to overwrite existing files; >|
+// still does.
+func (e *Executor) SetNoClobber(enabled bool) {
+	e.noclobber = enabled
+}
+
+// SetNoGlob turns pathname expansion off, for set -f.
+func (e *Executor) SetNoGlob(enabled bool) {
+	e.noglob = enabled
+}
+
+// SetNoUnset makes expanding an unset variable an error, for set -u.
+func (e *Executor) SetNoUnset(enabled bool) {
+	e.nounset = enabled
+}
+
+// SetPipeFail makes a pipeline fail with the status of its rightmost
+// failing command rather than always that of the last, for set -o
+// pipefail.
+func (e *Executor) SetPipeFail(enabled bool) {
+	e.pipefail = enabled
+}
+
+// SetXTrace makes each simple command print its expanded words to
+// stderr, after $PS4, before it runs, for set -x.
+func (e *Executor) SetXTrace(enabled bool) {
+	e.xtrace = enabled
+}
+
+// trace prints words for set -x, quoting those that would not read back
+// as the same word.
+func (e *Executor) trace(words []string) {
+	ps4 := e.variables.Get("PS4")
+	if !e.variables.IsSet("PS4") {
+		ps4 = "+ "
+	}
+
+	quoted := make([]string, len(words))
+	for i, word := range words {
+		quoted[i] = word
+		if word == "" || strings.ContainsAny(word, " \t\n'\"\\$`*?[]{}()<>|&;#~") {
+			quoted[i] = "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+		}
+	}
+	fmt.Fprintf(e.stderr, "%s%s\n", ps4, strings.Join(quoted, " "))
+}
+
+// SetGlobOptions sets the options that change pathname expansion.
+func (e *Executor) SetGlobOptions(opts parser.GlobOptions) {
+	e.glob = opts
+}
+
+// SetPOSIX installs the check for POSIX mode, which turns off the bash
+// expansions, braces and the ** of globstar, as commands run.
+func (e *Executor) SetPOSIX(posix func() bool) {
+	e.posix = posix
+}
+
+// SetTerminal installs give, which makes a process group the terminal's
+// foreground group and returns the function that takes the terminal
+// back. Commands run with a timeout, which have a process group of their
+// own, are given the terminal while they run.
+func (e *Executor) SetTerminal(give func(pgid int) func()) {
+	e.terminal = give
+}
+
+func (e *Executor) posixMode() bool {
+	return e.posix != nil && e.posix()
+}
+
+// expandBraces expands the braces in word, except in POSIX mode, where
+// they are literal.
+func (e *Executor) expandBraces(word string) []string {
+	if e.posixMode() {
+		return []string{word}
+	}
+	return parser.ExpandBraces(word)
+}
+
+// redirectStdio returns the streams for a builtin run with redirects,
+// and a function that closes the files they opened.
+func (e *Executor) redirectStdio(redirects []*ast.Redirect) (builtin.IO, func(), error) {
+	if len(redirects) == 0 {
+		return e.stdio(), func() {}, nil
+	}
+
+	cmd := &exec.Cmd{}
+	err := e.setupRedirects(cmd, redirects)
+	streams := []any{cmd.Stdin, cmd.Stdout, cmd.Stderr}
+	closeFiles := func() {
+		closeOpened(streams, e.stdin, e.stdout, e.stderr, os.Stdin, os.Stdout, os.Stderr)
+	}
+	if err != nil {
+		closeFiles()
+		return builtin.IO{}, nil, err
+	}
+
+	// A closed descriptor reads as empty and discards what is written.
+	stdio := builtin.IO{Stdin: cmd.Stdin, Stdout: cmd.Stdout, Stderr: cmd.Stderr, Status: e.lastExitCode}
+	if stdio.Stdin == nil {
+		stdio.Stdin = strings.NewReader("")
+	}
+	if stdio.Stdout == nil {
+		stdio.Stdout = io.Discard
+	}
+	if stdio.Stderr == nil {
+		stdio.Stderr = io.Discard
+	}
+	return stdio, closeFiles, nil
+}
+
+// stdio returns the streams a builtin run now should use.
+func (e *Executor) stdio() builtin.IO {
+	return builtin.IO{Stdin: e.stdin, Stdout: e.stdout, Stderr: e.stderr, Status: e.lastExitCode}
+}
+
+// withStdio returns an executor sharing e's state but running commands
+// with the given streams, for one side of a pipeline.
+func (e *Executor) withStdio(stdio builtin.IO) *Executor {
+	sub := *e
+	sub.stdin, sub.stdout, sub.stderr = stdio.Stdin, stdio.Stdout, stdio.Stderr
+	return &sub
+}
+
+// subshell returns a copy of e for commands that run alongside the
+// shell, so that what the executor records as they run is their own. Its
+// functions and foreground commands are its own too, and it never takes
+// the terminal. Variables are shared, as they are with the builtins,
+// which use the shell's.
+func (e *Executor) subshell() *Executor {
+	sub := *e
+	sub.functions = make(map[string]*ast.Command, len(e.functions))
+	for name, body := range e.functions {
+		sub.functions[name] = body
+	}
+	sub.fgMu = &sync.Mutex{}
+	sub.foreground = make(map[*exec.Cmd]bool)
+	sub.terminal = nil
+	return &sub
+}
+
+// SetStdio sets the streams commands read from and write to when they
+// are not redirected. Writers that are not files are written to under a
+// lock, since the commands of a pipeline write to them at the same time.
+func (e *Executor) SetStdio(stdin io.Reader, stdout, stderr io.Writer) {
+	mu := &sync.Mutex{}
+	e.stdin = stdin
+	e.stdout = lockWriter(stdout, mu)
+	e.stderr = lockWriter(stderr, mu)
+}
+
+// lockedWriter is a writer that takes mu for every write.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+// lockWriter returns w locked with mu, or as it is if it is a file,
+// which the commands write to directly, or locked already.
+func lockWriter(w io.Writer, mu *sync.Mutex) io.Writer {
+	switch w.(type) {
+	case *os.File, lockedWriter:
+		return w
+	}
+	return lockedWriter{mu: mu, w: w}
+}
+
+func (e *Executor) Stdin() io.Reader {
+	return e.stdin
+}
+
+func (e *Executor) Stdout() io.Writer {
+	return e.stdout
+}
+
+func (e *Executor) Stderr() io.Writer {
+	return e.stderr
+}
+
 func PipeCommands(commands [][]string) error {
 	if len(commands) < 2 {
 		return fmt.Errorf("pipe requires at least 2 commands")
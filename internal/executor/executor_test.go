@@ -0,0 +1,205 @@
+package executor
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"gosh/internal/ast"
+	"gosh/internal/builtin"
+	"gosh/internal/jobs"
+	"gosh/internal/variables"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestExecutor returns an executor with no builtins, writing to the
+// returned buffers.
+func newTestExecutor() (*Executor, *bytes.Buffer, *bytes.Buffer) {
+	var stdout, stderr bytes.Buffer
+	e := New(variables.NewWithEnv(nil), builtin.New(), jobs.New())
+	e.SetStdio(&bytes.Buffer{}, &stdout, &stderr)
+	return e, &stdout, &stderr
+}
+
+func TestExecuteNilParts(t *testing.T) {
+	truth := &ast.Command{Type: ast.CommandArithmetic, Arithmetic: &ast.ArithmeticCommand{Expression: "1"}}
+	falsity := &ast.Command{Type: ast.CommandArithmetic, Arithmetic: &ast.ArithmeticCommand{Expression: "0"}}
+
+	tests := []struct {
+		name string
+		cmd  *ast.Command
+		want int
+	}{
+		{"nil command", nil, 0},
+		{"if without then", &ast.Command{Type: ast.CommandIf, If: &ast.IfCommand{Condition: truth}}, 0},
+		{"if without else", &ast.Command{Type: ast.CommandIf, If: &ast.IfCommand{Condition: falsity}}, 0},
+		{"while without body", &ast.Command{Type: ast.CommandWhile, While: &ast.WhileCommand{Condition: falsity}}, 0},
+		{"for without body", &ast.Command{Type: ast.CommandFor, For: &ast.ForCommand{Variable: "x", Values: []ast.Word{{Text: "a"}}}}, 0},
+		{"for over nothing", &ast.Command{Type: ast.CommandFor, For: &ast.ForCommand{Variable: "x"}}, 0},
+		{"empty list", &ast.Command{Type: ast.CommandList, List: &ast.List{}}, 0},
+		{"empty group", &ast.Command{Type: ast.CommandGroup, Group: &ast.GroupCommand{}}, 0},
+		{"case without clauses", &ast.Command{Type: ast.CommandCase, Case: &ast.CaseCommand{Word: "a"}}, 0},
+		{"case clause without body", &ast.Command{Type: ast.CommandCase, Case: &ast.CaseCommand{Word: "a", Cases: []*ast.CaseItem{{Patterns: []string{"a"}}}}}, 0},
+		{"negation of nothing", &ast.Command{Type: ast.CommandNegation, Negation: &ast.NegationCommand{}}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, _, _ := newTestExecutor()
+			if got := e.Execute(tt.cmd); got != tt.want {
+				t.Errorf("Execute() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNeedsExpansion(t *testing.T) {
+	tests := []struct {
+		word string
+		want bool
+	}{
+		{"ls", false},
+		{"-la", false},
+		{"/usr/bin/env", false},
+		{"a=b", false},
+		{"$HOME", true},
+		{"`date`", true},
+		{"*.go", true},
+		{"file?", true},
+		{"[ab]", true},
+		{"{a,b}", true},
+		{"~/src", true},
+		{`\*`, true},
+		{"'x'", true},
+		{`"x"`, true},
+	}
+	for _, tt := range tests {
+		if got := needsExpansion(tt.word); got != tt.want {
+			t.Errorf("needsExpansion(%q) = %v, want %v", tt.word, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkExpandCommand(b *testing.B) {
+	e, _, _ := newTestExecutor()
+	e.variables.Set("dir", "/tmp")
+	benchmarks := []struct {
+		name string
+		cmd  *ast.SimpleCommand
+	}{
+		{"plain", &ast.SimpleCommand{Name: "ls", Args: []string{"-la", "/usr/bin", "--color=auto"}}},
+		{"expanding", &ast.SimpleCommand{Name: "ls", Args: []string{"-la", "$dir", "~/x"}}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				e.expandCommand(bm.cmd)
+			}
+		})
+	}
+}
+
+func TestExecFailureRestoresFds(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	bad := filepath.Join(dir, "bad")
+	if err := os.WriteFile(bad, []byte("\x00\x01not a program\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	stat := func() [3]unix.Stat_t {
+		var st [3]unix.Stat_t
+		for fd := range st {
+			if err := unix.Fstat(fd, &st[fd]); err != nil {
+				t.Fatalf("descriptor %d: %v", fd, err)
+			}
+		}
+		return st
+	}
+	before := stat()
+
+	e, _, _ := newTestExecutor()
+	e.redirects = []*ast.Redirect{
+		{Type: ast.RedirectOutput, Source: 1, Target: log},
+		{Type: ast.RedirectDup, Source: 2, Target: "1"},
+	}
+	status, err := e.Exec([]string{bad})
+	if status != 126 || err == nil {
+		t.Errorf("Exec(%q) = %d, %v; want 126 and an error", bad, status, err)
+	}
+
+	after := stat()
+	for fd := range before {
+		if before[fd].Dev != after[fd].Dev || before[fd].Ino != after[fd].Ino {
+			t.Errorf("descriptor %d was not restored", fd)
+		}
+	}
+	if _, err := os.Stat(log); err != nil {
+		t.Errorf("the redirect was not opened: %v", err)
+	}
+}
+
+func TestSetStdioLocks(t *testing.T) {
+	var out bytes.Buffer
+	e := New(variables.NewWithEnv(nil), builtin.New(), jobs.New())
+	e.SetStdio(os.Stdin, &out, &out)
+
+	if _, ok := e.Stdout().(lockedWriter); !ok {
+		t.Errorf("stdout is a %T, want it locked", e.Stdout())
+	}
+	e.SetStdio(os.Stdin, os.Stdout, e.Stderr())
+	if e.Stdout() != io.Writer(os.Stdout) {
+		t.Errorf("stdout is a %T, want the file itself", e.Stdout())
+	}
+	if _, ok := e.Stderr().(lockedWriter).w.(*bytes.Buffer); !ok {
+		t.Error("a locked stderr was locked again")
+	}
+
+	// Two commands of a pipeline writing to the same buffer.
+	e.SetStdio(os.Stdin, &out, &out)
+	var wg sync.WaitGroup
+	for _, w := range []io.Writer{e.Stdout(), e.Stderr()} {
+		wg.Add(1)
+		go func(w io.Writer) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				w.Write([]byte("x"))
+			}
+		}(w)
+	}
+	wg.Wait()
+	if out.Len() != 2000 {
+		t.Errorf("%d bytes written, want 2000", out.Len())
+	}
+}
+
+func TestTimeoutTakesTerminal(t *testing.T) {
+	e, _, _ := newTestExecutor()
+	var given, taken []int
+	e.SetTerminal(func(pgid int) func() {
+		given = append(given, pgid)
+		return func() { taken = append(taken, pgid) }
+	})
+
+	if code := e.RunWithTimeout(e.stdio(), "true", nil, time.Minute); code != 0 {
+		t.Fatalf("RunWithTimeout() = %d, want 0", code)
+	}
+	if len(given) != 1 || given[0] <= 0 || !reflect.DeepEqual(taken, given) {
+		t.Errorf("terminal given to %v and taken back from %v, want one group both times", given, taken)
+	}
+
+	// Without a timeout the command stays in the shell's group, which has
+	// the terminal already, and a background job never takes it.
+	given, taken = nil, nil
+	e.Execute(&ast.Command{Type: ast.CommandSimple, Simple: &ast.SimpleCommand{Name: "true"}})
+	e.subshell().RunWithTimeout(e.stdio(), "true", nil, time.Minute)
+	if given != nil {
+		t.Errorf("terminal given to %v, want it kept", given)
+	}
+}
@@ -2,18 +2,39 @@ package history
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+// Entry is a single history record. Time is zero for entries loaded
+// from a file written without timestamps.
+type Entry struct {
+	Command string
+	Time    time.Time
+
+	// saved is set once the entry is in the history file, so that
+	// AppendFile writes only the entries added since.
+	saved bool
+}
+
 type Manager struct {
-	entries  []string
+	entries  []Entry
 	file     string
 	maxSize  int
+	fileSize int
 	position int
+
+	control    func() string
+	timestamps bool
+	appendMode bool
 }
 
 func New() *Manager {
@@ -21,36 +42,76 @@ func New() *Manager {
 	histFile := filepath.Join(home, ".gosh_history")
 
 	m := &Manager{
-		file:    histFile,
-		maxSize: 1000,
+		file:     histFile,
+		maxSize:  1000,
+		fileSize: -1,
 	}
 
 	m.Load()
 	return m
 }
 
+// SetControlFunc sets the lookup for the HISTCONTROL value consulted by
+// Add. Without one, Add behaves as if HISTCONTROL were "ignoredups".
+func (m *Manager) SetControlFunc(control func() string) {
+	m.control = control
+}
+
+func (m *Manager) controlOptions() map[string]bool {
+	value := "ignoredups"
+	if m.control != nil {
+		value = m.control()
+	}
+
+	opts := make(map[string]bool)
+	for _, opt := range strings.Split(value, ":") {
+		if opt == "ignoreboth" {
+			opts["ignorespace"] = true
+			opts["ignoredups"] = true
+			continue
+		}
+		opts[opt] = true
+	}
+	return opts
+}
+
 func (m *Manager) Add(command string) {
+	opts := m.controlOptions()
+
+	if opts["ignorespace"] && strings.HasPrefix(command, " ") {
+		return
+	}
+
 	command = strings.TrimSpace(command)
 	if command == "" {
 		return
 	}
 
-	if len(m.entries) > 0 && m.entries[len(m.entries)-1] == command {
+	if opts["ignoredups"] && len(m.entries) > 0 && m.entries[len(m.entries)-1].Command == command {
 		return
 	}
 
-	m.entries = append(m.entries, command)
-
-	if len(m.entries) > m.maxSize {
-		m.entries = m.entries[len(m.entries)-m.maxSize:]
+	if opts["erasedups"] {
+		kept := m.entries[:0]
+		for _, entry := range m.entries {
+			if entry.Command != command {
+				kept = append(kept, entry)
+			}
+		}
+		m.entries = kept
 	}
 
-	m.position = len(m.entries)
+	entry := Entry{Command: command, Time: time.Now()}
+	if m.appendMode {
+		entry.saved = m.appendEntry(entry) == nil
+	}
+	m.entries = append(m.entries, entry)
+	m.trim()
 }
 
 func (m *Manager) Get(index int) string {
 	if index >= 0 && index < len(m.entries) {
-		return m.entries[index]
+		return m.entries[index].Command
 	}
 	return ""
 }
@@ -58,7 +119,7 @@ func (m *Manager) Get(index int) string {
 func (m *Manager) Previous() string {
 	if m.position > 0 {
 		m.position--
-		return m.entries[m.position]
+		return m.entries[m.position].Command
 	}
 	return ""
 }
@@ -66,7 +127,7 @@ func (m *Manager) Previous() string {
 func (m *Manager) Next() string {
 	if m.position < len(m.entries)-1 {
 		m.position++
-		return m.entries[m.position]
+		return m.entries[m.position].Command
 	} else if m.position == len(m.entries)-1 {
 		m.position++
 		return ""
@@ -81,15 +142,29 @@ func (m *Manager) Reset() {
 func (m *Manager) Search(query string) []string {
 	var results []string
 	for _, entry := range m.entries {
-		if strings.Contains(entry, query) {
-			results = append(results, entry)
+		if strings.Contains(entry.Command, query) {
+			results = append(results, entry.Command)
 		}
 	}
 	return results
 }
 
 func (m *Manager) All() []string {
-	return append([]string{}, m.entries...)
+	commands := make([]string, len(m.entries))
+	for i, entry := range m.entries {
+		commands[i] = entry.Command
+	}
+	return commands
+}
+
+func (m *Manager) Entries() []Entry {
+	return append([]Entry{}, m.entries...)
+}
+
+// SetTimestamps controls whether Save writes a "#<epoch>" line before
+// each entry, as bash does when HISTTIMEFORMAT is set.
+func (m *Manager) SetTimestamps(enabled bool) {
+	m.timestamps = enabled
 }
 
 func (m *Manager) Clear() {
@@ -97,94 +172,442 @@ func (m *Manager) Clear() {
 	m.position = 0
 }
 
+// Delete removes the entry at index, counting from 0, and reports
+// whether there was one.
+func (m *Manager) Delete(index int) bool {
+	if index < 0 || index >= len(m.entries) {
+		return false
+	}
+	m.entries = append(m.entries[:index], m.entries[index+1:]...)
+	m.position = len(m.entries)
+	return true
+}
+
 func (m *Manager) Size() int {
 	return len(m.entries)
 }
 
+// SetMaxSize limits the list to the last size entries, as $HISTSIZE
+// does. A negative size means no limit.
 func (m *Manager) SetMaxSize(size int) {
 	m.maxSize = size
-	if len(m.entries) > size {
-		m.entries = m.entries[len(m.entries)-size:]
-		m.position = len(m.entries)
+	m.trim()
+}
+
+// SetFileSize limits the history file to the last size entries when it
+// is written, as $HISTFILESIZE does. A negative size means no limit.
+func (m *Manager) SetFileSize(size int) {
+	m.fileSize = size
+}
+
+// trim drops the oldest entries beyond the maximum size and resets the
+// browsing position.
+func (m *Manager) trim() {
+	if m.maxSize >= 0 && len(m.entries) > m.maxSize {
+		m.entries = m.entries[len(m.entries)-m.maxSize:]
+	}
+	m.position = len(m.entries)
+}
+
+// tail returns the last entries of entries that fit in the history file.
+func (m *Manager) tail(entries []Entry) []Entry {
+	if m.fileSize >= 0 && len(entries) > m.fileSize {
+		return entries[len(entries)-m.fileSize:]
 	}
+	return entries
 }
 
+// Load reads the history file into the list. A missing file is not an
+// error.
 func (m *Manager) Load() error {
-	file, err := os.Open(m.file)
-	if err != nil {
+	err := m.ReadFile(m.file)
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil
 	}
+	return err
+}
+
+// ReadFile adds the entries in path to the end of the list.
+func (m *Manager) ReadFile(path string) error {
+	entries, err := readEntries(path)
+	m.entries = append(m.entries, entries...)
+	m.trim()
+	return err
+}
+
+// readEntries parses a history file.
+func readEntries(path string) ([]Entry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
 
+	var entries []Entry
+	var stamp time.Time
+	var continued []string
 	scanner := bufio.NewScanner(file)
 	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line != "" {
-			m.entries = append(m.entries, line)
+		line := scanner.Text()
+		if continued == nil {
+			line = strings.TrimSpace(line)
+			if t, ok := parseTimestamp(line); ok {
+				stamp = t
+				continue
+			}
+		}
+		if strings.HasSuffix(line, "\\") {
+			continued = append(continued, strings.TrimSuffix(line, "\\"))
+			continue
 		}
+
+		command := strings.TrimSpace(strings.Join(append(continued, line), "\n"))
+		continued = nil
+		if command != "" {
+			entries = append(entries, Entry{Command: command, Time: stamp, saved: true})
+		}
+		stamp = time.Time{}
 	}
+	return entries, scanner.Err()
+}
 
-	if len(m.entries) > m.maxSize {
-		m.entries = m.entries[len(m.entries)-m.maxSize:]
+func (m *Manager) Save() error {
+	return m.WriteFile(m.file)
+}
+
+// WriteFile replaces the contents of path with the list, or as much of
+// its end as the file size allows.
+func (m *Manager) WriteFile(path string) error {
+	lock, err := lockFile(path, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
 	}
+	defer lock.Close()
 
-	m.position = len(m.entries)
-	return scanner.Err()
+	if err := replace(path, m.tail(m.entries), m.timestamps); err != nil {
+		return err
+	}
+	markSaved(m.entries)
+	return nil
 }
 
-func (m *Manager) Save() error {
-	file, err := os.Create(m.file)
+// AppendFile adds to the end of path the entries not yet written to a
+// history file, then truncates it to the file size.
+func (m *Manager) AppendFile(path string) error {
+	var unsaved []Entry
+	first := len(m.entries)
+	for i, entry := range m.entries {
+		if !entry.saved {
+			unsaved = append(unsaved, entry)
+			first = min(first, i)
+		}
+	}
+	if len(unsaved) == 0 {
+		return nil
+	}
+
+	if err := m.appendEntries(path, unsaved); err != nil {
+		return err
+	}
+	markSaved(m.entries[first:])
+	return m.truncate(path)
+}
+
+// Truncate cuts the history file down to the file size, for sessions
+// that append to it rather than save it whole.
+func (m *Manager) Truncate() error {
+	return m.truncate(m.file)
+}
+
+func (m *Manager) truncate(path string) error {
+	if m.fileSize < 0 {
+		return nil
+	}
+	lock, err := lockFile(path, os.O_RDONLY)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer lock.Close()
 
-	for _, entry := range m.entries {
-		if _, err := fmt.Fprintln(file, entry); err != nil {
-			return err
+	entries, err := readEntries(path)
+	if err != nil || len(entries) <= m.fileSize {
+		return err
+	}
+	// Timestamps already in the file are kept whatever the setting.
+	return replace(path, m.tail(entries), true)
+}
+
+// lockFile opens path with flag and takes the exclusive lock that every
+// write to a history file holds; closing the file releases it. A rewrite
+// renames a new file over path, so one opened before that is dropped and
+// path opened again until the file locked is the one at path.
+func lockFile(path string, flag int) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, flag, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+			file.Close()
+			return nil, err
+		}
+
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
 		}
 	}
+}
+
+// replace writes entries to a new file and renames it over path, so that
+// no session ever reads the history file half written. The caller holds
+// the lock on path.
+func replace(path string, entries []Entry, stamps bool) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
 
+	w := bufio.NewWriter(file)
+	err = write(w, entries, stamps)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// write writes entries to w in the history file format, with the time
+// of each before it if stamps is set.
+func write(w io.Writer, entries []Entry, stamps bool) error {
+	for _, entry := range entries {
+		if stamps && !entry.Time.IsZero() {
+			if _, err := fmt.Fprintf(w, "#%d\n", entry.Time.Unix()); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintln(w, encodeEntry(entry.Command)); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+func markSaved(entries []Entry) {
+	for i := range entries {
+		entries[i].saved = true
+	}
+}
+
+// SetAppend switches the manager to writing each added entry to the end
+// of the history file immediately, so concurrent sessions interleave
+// their commands instead of overwriting each other on exit.
+func (m *Manager) SetAppend(enabled bool) {
+	m.appendMode = enabled
+}
+
+func (m *Manager) Appending() bool {
+	return m.appendMode
+}
+
+func (m *Manager) appendEntry(entry Entry) error {
+	return m.appendEntries(m.file, []Entry{entry})
+}
+
+// appendEntries adds entries to the end of path, holding its lock so
+// that concurrent sessions do not interleave them.
+func (m *Manager) appendEntries(path string, entries []Entry) error {
+	file, err := lockFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err := write(w, entries, m.timestamps); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// encodeEntry prepares a command for the history file. Each embedded
+// newline is preceded by a backslash, so a line ending in a backslash
+// continues onto the next one when the file is loaded.
+func encodeEntry(command string) string {
+	return strings.ReplaceAll(command, "\n", "\\\n")
+}
+
+// parseTimestamp recognizes the "#<epoch>" lines bash writes ahead of
+// each command when timestamps are enabled.
+func parseTimestamp(line string) (time.Time, bool) {
+	if len(line) < 2 || line[0] != '#' {
+		return time.Time{}, false
+	}
+	secs, err := strconv.ParseInt(line[1:], 10, 64)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(secs, 0), true
+}
+
+// Expand performs csh-style history expansion on input: the events !!,
+// !N, !-N and !string, optionally followed by a :N, :^, :$ or :* word
+// designator, and the shorthands !$, !^ and !*. Text inside single
+// quotes, a backslash-escaped ! and a ! ending a double-quoted word are
+// left alone.
 func (m *Manager) Expand(input string) (string, error) {
 	if !strings.Contains(input, "!") {
 		return input, nil
 	}
 
-	result := input
-
-	if strings.Contains(result, "!!") {
-		if len(m.entries) > 0 {
-			last := m.entries[len(m.entries)-1]
-			result = strings.ReplaceAll(result, "!!", last)
-		} else {
-			return "", fmt.Errorf("no previous command")
+	var b strings.Builder
+	inSingle, inDouble := false, false
+
+	for i := 0; i < len(input); i++ {
+		ch := input[i]
+
+		// A ! followed by a blank, =, ( or the " ending a double-quoted
+		// word, as in "hi!", is left alone, as bash does.
+		switch {
+		case ch == '\\' && i+1 < len(input):
+			b.WriteByte(ch)
+			b.WriteByte(input[i+1])
+			i++
+			continue
+		case ch == '\'' && !inDouble:
+			inSingle = !inSingle
+		case ch == '"' && !inSingle:
+			inDouble = !inDouble
+		case ch == '!' && !inSingle && i+1 < len(input) && !strings.ContainsRune(" \t\n=(\"", rune(input[i+1])):
+			text, n, err := m.expandEvent(input[i+1:])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(text)
+			i += n
+			continue
 		}
+
+		b.WriteByte(ch)
 	}
 
-	if strings.Contains(result, "!") && len(result) > 1 {
-		for i := 0; i < len(result)-1; i++ {
-			if result[i] == '!' && result[i+1] >= '0' && result[i+1] <= '9' {
-				end := i + 1
-				for end < len(result) && result[end] >= '0' && result[end] <= '9' {
-					end++
-				}
+	return b.String(), nil
+}
+
+// expandEvent expands the history reference at the start of s (just past
+// the !) and returns the replacement and the number of bytes consumed.
+func (m *Manager) expandEvent(s string) (string, int, error) {
+	n := 0
+	var event string
+
+	switch {
+	case s[0] == '!':
+		n = 1
+		if len(m.entries) == 0 {
+			return "", 0, fmt.Errorf("!!: event not found")
+		}
+		event = m.entries[len(m.entries)-1].Command
+	case s[0] == '$' || s[0] == '^' || s[0] == '*':
+		if len(m.entries) == 0 {
+			return "", 0, fmt.Errorf("!%c: event not found", s[0])
+		}
+		event = m.entries[len(m.entries)-1].Command
+		return m.selectWords(event, s[:1], s[:1])
+	case s[0] == '-' || (s[0] >= '0' && s[0] <= '9'):
+		end := 1
+		for end < len(s) && s[end] >= '0' && s[end] <= '9' {
+			end++
+		}
+		num, err := strconv.Atoi(s[:end])
+		if err != nil {
+			return "", 0, fmt.Errorf("!%s: event not found", s[:end])
+		}
+		index := num - 1
+		if num < 0 {
+			index = len(m.entries) + num
+		}
+		if index < 0 || index >= len(m.entries) {
+			return "", 0, fmt.Errorf("!%s: event not found", s[:end])
+		}
+		n = end
+		event = m.entries[index].Command
+	default:
+		end := 0
+		for end < len(s) && !strings.ContainsRune(" \t\n:;|&", rune(s[end])) {
+			end++
+		}
+		prefix := s[:end]
+		found := false
+		for i := len(m.entries) - 1; i >= 0; i-- {
+			if strings.HasPrefix(m.entries[i].Command, prefix) {
+				event = m.entries[i].Command
+				found = true
+				break
+			}
+		}
+		if !found {
+			return "", 0, fmt.Errorf("!%s: event not found", prefix)
+		}
+		n = end
+	}
 
-				numStr := result[i+1 : end]
-				if num, err := strconv.Atoi(numStr); err == nil {
-					if num > 0 && num <= len(m.entries) {
-						cmd := m.entries[num-1]
-						result = result[:i] + cmd + result[end:]
-						i += len(cmd) - 1
-					}
-				}
+	if n < len(s) && s[n] == ':' && n+1 < len(s) {
+		d := s[n+1]
+		if d == '$' || d == '^' || d == '*' || (d >= '0' && d <= '9') {
+			end := n + 2
+			for d >= '0' && d <= '9' && end < len(s) && s[end] >= '0' && s[end] <= '9' {
+				end++
 			}
+			text, _, err := m.selectWords(event, s[n+1:end], s[:end])
+			return text, end, err
 		}
 	}
 
-	return result, nil
+	return event, n, nil
+}
+
+// selectWords applies a word designator to a history event.
+func (m *Manager) selectWords(event, designator, ref string) (string, int, error) {
+	words := strings.Fields(event)
+
+	switch designator {
+	case "$":
+		return words[len(words)-1], 1, nil
+	case "^":
+		if len(words) < 2 {
+			return "", 0, fmt.Errorf("!%s: bad word specifier", ref)
+		}
+		return words[1], 1, nil
+	case "*":
+		if len(words) < 2 {
+			return "", 1, nil
+		}
+		return strings.Join(words[1:], " "), 1, nil
+	}
+
+	index, err := strconv.Atoi(designator)
+	if err != nil || index >= len(words) {
+		return "", 0, fmt.Errorf("!%s: bad word specifier", ref)
+	}
+	return words[index], len(designator), nil
 }
 
 func (m *Manager) GetFile() string {
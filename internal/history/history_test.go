@@ -0,0 +1,287 @@
+package history
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// newTestManager returns a manager holding commands, with a fresh $HOME
+// so that no history file of the user's is read.
+func newTestManager(t *testing.T, commands ...string) *Manager {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	m := New()
+	for _, command := range commands {
+		m.Add(command)
+	}
+	return m
+}
+
+// commands returns the commands of entries.
+func commands(entries []Entry) []string {
+	var list []string
+	for _, entry := range entries {
+		list = append(list, entry.Command)
+	}
+	return list
+}
+
+func TestExpand(t *testing.T) {
+	m := newTestManager(t, "echo one two", "ls -l /tmp")
+	tests := []struct {
+		input string
+		want  string
+	}{
+		{"!!", "ls -l /tmp"},
+		{"sudo !!", "sudo ls -l /tmp"},
+		{"echo !$", "echo /tmp"},
+		{"echo !^", "echo -l"},
+		{"!1", "echo one two"},
+		{"!-2:2", "two"},
+		{"!ec", "echo one two"},
+		{`echo "!!"`, `echo "ls -l /tmp"`},
+		{`echo "hi!"`, `echo "hi!"`},
+		{`echo "it's !$"`, `echo "it's /tmp"`},
+		{`echo 'hi!!'`, `echo 'hi!!'`},
+		{`echo hi\!!`, `echo hi\!!`},
+		{"echo hi!", "echo hi!"},
+		{"echo ! x", "echo ! x"},
+		{"[ ! -f x ]", "[ ! -f x ]"},
+		{"a!=b", "a!=b"},
+	}
+	for _, tt := range tests {
+		got, err := m.Expand(tt.input)
+		if err != nil {
+			t.Errorf("Expand(%q): %v", tt.input, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestExpandNotFound(t *testing.T) {
+	m := newTestManager(t, "echo one")
+	for _, input := range []string{"!nope", "!5", "!-3"} {
+		if _, err := m.Expand(input); err == nil {
+			t.Errorf("Expand(%q) succeeded, want event not found", input)
+		}
+	}
+}
+
+// runSessions has sessions managers add count commands each to the
+// history file path at the same time, calling also after every add.
+func runSessions(t *testing.T, path string, sessions, count int, also func(m *Manager)) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		m := New()
+		m.SetFile(path)
+		m.SetAppend(true)
+		m.SetFileSize(10)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				m.Add(fmt.Sprintf("echo %d %d", i, j))
+				also(m)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestConcurrentAppend(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	path := filepath.Join(t.TempDir(), "history")
+
+	runSessions(t, path, 4, 25, func(*Manager) {})
+
+	entries, err := readEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		seen[entry.Command] = true
+	}
+	for i := 0; i < 4; i++ {
+		for j := 0; j < 25; j++ {
+			if command := fmt.Sprintf("echo %d %d", i, j); !seen[command] {
+				t.Errorf("%q is missing from the history file", command)
+			}
+		}
+	}
+	if len(entries) != 100 {
+		t.Errorf("history file has %d entries, want 100", len(entries))
+	}
+}
+
+func TestConcurrentTruncate(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history")
+
+	runSessions(t, path, 4, 25, func(m *Manager) {
+		if err := m.Truncate(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	entries, err := readEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 10 {
+		t.Errorf("history file has %d entries, want 10", len(entries))
+	}
+	for _, entry := range entries {
+		var i, j int
+		if _, err := fmt.Sscanf(entry.Command, "echo %d %d", &i, &j); err != nil {
+			t.Errorf("history file has the mangled entry %q", entry.Command)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the history directory, want 1", len(files))
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileSize int
+		want     []string
+	}{
+		{"no limit", -1, []string{"a", "b", "c"}},
+		{"limited", 2, []string{"b", "c"}},
+		{"empty", 0, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newTestManager(t, "a", "b", "c")
+			m.SetFileSize(tt.fileSize)
+			path := filepath.Join(t.TempDir(), "history")
+			if err := os.WriteFile(path, []byte("old\nolder\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := m.WriteFile(path); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := readEntries(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := commands(entries); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("history file holds %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConcurrentWriteFile(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	dir := t.TempDir()
+	path := filepath.Join(dir, "history")
+
+	runSessions(t, path, 4, 25, func(m *Manager) {
+		if err := m.WriteFile(path); err != nil {
+			t.Error(err)
+		}
+	})
+
+	entries, err := readEntries(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) == 0 || len(entries) > 10 {
+		t.Errorf("history file has %d entries, want 1 to 10", len(entries))
+	}
+	for _, entry := range entries {
+		var i, j int
+		if _, err := fmt.Sscanf(entry.Command, "echo %d %d", &i, &j); err != nil {
+			t.Errorf("history file has the mangled entry %q", entry.Command)
+		}
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("%d files left in the history directory, want 1", len(files))
+	}
+}
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		index int
+		ok    bool
+		want  []string
+	}{
+		{0, true, []string{"b", "c"}},
+		{1, true, []string{"a", "c"}},
+		{2, true, []string{"a", "b"}},
+		{3, false, []string{"a", "b", "c"}},
+		{-1, false, []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		m := newTestManager(t, "a", "b", "c")
+		if ok := m.Delete(tt.index); ok != tt.ok {
+			t.Errorf("Delete(%d) = %v, want %v", tt.index, ok, tt.ok)
+		}
+		if got := commands(m.Entries()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("after Delete(%d) the list is %q, want %q", tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestAppendFile(t *testing.T) {
+	m := newTestManager(t, "a", "b")
+	path := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(path, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		add  []string
+		want []string
+	}{
+		{nil, []string{"old", "a", "b"}},
+		{nil, []string{"old", "a", "b"}},
+		{[]string{"c"}, []string{"old", "a", "b", "c"}},
+	}
+	for i, step := range steps {
+		for _, command := range step.add {
+			m.Add(command)
+		}
+		if err := m.AppendFile(path); err != nil {
+			t.Fatal(err)
+		}
+		entries, err := readEntries(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := commands(entries); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("after append %d the file holds %q, want %q", i+1, got, step.want)
+		}
+	}
+}
+
+func TestReadFile(t *testing.T) {
+	m := newTestManager(t, "a")
+	path := filepath.Join(t.TempDir(), "history")
+	if err := os.WriteFile(path, []byte("x\ny\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.ReadFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := commands(m.Entries()), []string{"a", "x", "y"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the list is %q, want %q", got, want)
+	}
+	if err := m.ReadFile(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("ReadFile of a missing file succeeded")
+	}
+}
@@ -2,8 +2,12 @@ package jobs
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -43,12 +47,22 @@ type Job struct {
 	ExitCode int
 	Process  *os.Process
 	Cmd      *exec.Cmd
+
+	done chan struct{}
 }
 
 type Manager struct {
 	jobs   map[int]*Job
 	nextID int
 	mu     sync.RWMutex
+
+	// recent lists job IDs from least to most recently started or
+	// stopped; the last is the current job and the one before it the
+	// previous job.
+	recent []int
+
+	// finished holds the jobs that ended since the last Notifications.
+	finished []*Job
 }
 
 func New() *Manager {
@@ -70,9 +84,11 @@ func (m *Manager) Add(cmd *exec.Cmd, command string) *Job {
 		Started: time.Now(),
 		Process: cmd.Process,
 		Cmd:     cmd,
+		done:    make(chan struct{}),
 	}
 
 	m.jobs[m.nextID] = job
+	m.touch(job.ID)
 	m.nextID++
 
 	go m.monitor(job)
@@ -80,6 +96,33 @@ func (m *Manager) Add(cmd *exec.Cmd, command string) *Job {
 	return job
 }
 
+// AddFunc registers run, started in its own goroutine, as a job without
+// a process of its own, for background commands that the shell runs
+// itself. The job's exit code is run's result.
+func (m *Manager) AddFunc(command string, run func() int) *Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job := &Job{
+		ID:      m.nextID,
+		Command: command,
+		State:   JobRunning,
+		Started: time.Now(),
+		done:    make(chan struct{}),
+	}
+
+	m.jobs[m.nextID] = job
+	m.touch(job.ID)
+	m.nextID++
+
+	go func() {
+		code := run()
+		m.finish(job, code, JobDone)
+	}()
+
+	return job
+}
+
 func (m *Manager) Get(id int) *Job {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -87,6 +130,98 @@ func (m *Manager) Get(id int) *Job {
 	return m.jobs[id]
 }
 
+// State returns the state of job id, which its monitor changes when it
+// ends. A job that is not found is reported as done.
+func (m *Manager) State(id int) JobState {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if job, exists := m.jobs[id]; exists {
+		return job.State
+	}
+	return JobDone
+}
+
+// touch makes job id the current job. The caller holds m.mu.
+func (m *Manager) touch(id int) {
+	m.forget(id)
+	m.recent = append(m.recent, id)
+}
+
+// forget drops job id from the current and previous designations. The
+// caller holds m.mu.
+func (m *Manager) forget(id int) {
+	for i, recent := range m.recent {
+		if recent == id {
+			m.recent = append(m.recent[:i], m.recent[i+1:]...)
+			return
+		}
+	}
+}
+
+// Resolve returns the job named by a job spec: %n for job n, %+ or %%
+// for the current job, %- for the previous one, %string for the job
+// whose command starts with string and %?string for the job whose
+// command contains it. The current job is the most recently started or
+// stopped job still alive. A spec without % is taken as a job number.
+func (m *Manager) Resolve(spec string) (*Job, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	name := strings.TrimPrefix(spec, "%")
+	if id, err := strconv.Atoi(name); err == nil {
+		if job := m.jobs[id]; job != nil {
+			return job, nil
+		}
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+
+	// Only jobs still running or stopped can be current or previous.
+	var live []*Job
+	for _, id := range m.recent {
+		if job := m.jobs[id]; job.State == JobRunning || job.State == JobStopped {
+			live = append(live, job)
+		}
+	}
+
+	switch name {
+	case "", "+", "%":
+		if len(live) > 0 {
+			return live[len(live)-1], nil
+		}
+		return nil, fmt.Errorf("%s: no current job", spec)
+	case "-":
+		if len(live) > 1 {
+			return live[len(live)-2], nil
+		}
+		if len(live) > 0 {
+			return live[0], nil
+		}
+		return nil, fmt.Errorf("%s: no previous job", spec)
+	}
+
+	var found *Job
+	for _, job := range m.jobs {
+		var matched bool
+		if text, ok := strings.CutPrefix(name, "?"); ok {
+			matched = strings.Contains(job.Command, text)
+		} else {
+			matched = strings.HasPrefix(job.Command, name)
+		}
+		if !matched {
+			continue
+		}
+		if found != nil {
+			return nil, fmt.Errorf("%s: ambiguous job spec", spec)
+		}
+		found = job
+	}
+	if found == nil {
+		return nil, fmt.Errorf("%s: no such job", spec)
+	}
+	return found, nil
+}
+
 func (m *Manager) GetByPID(pid int) *Job {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
@@ -136,7 +271,9 @@ func (m *Manager) Stopped() []*Job {
 	return jobs
 }
 
-func (m *Manager) Kill(id int) error {
+// Signal sends sig to job id. Stopping or continuing the job is
+// reflected in its state at once; its end is recorded when it is reaped.
+func (m *Manager) Signal(id int, sig syscall.Signal) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -149,22 +286,27 @@ func (m *Manager) Kill(id int) error {
 		return fmt.Errorf("job %d is not running", id)
 	}
 
-	if job.Process != nil {
-		err := job.Process.Signal(syscall.SIGTERM)
-		if err != nil {
-			err = job.Process.Kill()
-		}
-
-		if err == nil {
-			job.State = JobKilled
-			now := time.Now()
-			job.Finished = &now
-		}
+	if job.Process == nil {
+		return fmt.Errorf("no process for job %d", id)
+	}
 
+	if err := job.Process.Signal(sig); err != nil {
 		return err
 	}
-
-	return fmt.Errorf("no process for job %d", id)
+	switch sig {
+	case syscall.SIGSTOP, syscall.SIGTSTP, syscall.SIGTTIN, syscall.SIGTTOU:
+		job.State = JobStopped
+		m.touch(id)
+	case syscall.SIGCONT:
+		job.State = JobRunning
+	case syscall.SIGTERM, syscall.SIGHUP:
+		// A stopped job is continued, as bash does, so it can act on
+		// the signal.
+		if job.State == JobStopped {
+			job.Process.Signal(syscall.SIGCONT)
+		}
+	}
+	return nil
 }
 
 func (m *Manager) Stop(id int) error {
@@ -184,6 +326,7 @@ func (m *Manager) Stop(id int) error {
 		err := job.Process.Signal(syscall.SIGSTOP)
 		if err == nil {
 			job.State = JobStopped
+			m.touch(id)
 		}
 		return err
 	}
@@ -215,22 +358,47 @@ func (m *Manager) Continue(id int) error {
 	return fmt.Errorf("no process for job %d", id)
 }
 
+// Hangup sends SIGHUP to every running or stopped job, as a shell does
+// when it exits. Stopped jobs are continued afterwards so they can act on
+// the signal.
+func (m *Manager) Hangup() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for _, job := range m.jobs {
+		if job.Process == nil || (job.State != JobRunning && job.State != JobStopped) {
+			continue
+		}
+		job.Process.Signal(syscall.SIGHUP)
+		if job.State == JobStopped {
+			job.Process.Signal(syscall.SIGCONT)
+		}
+	}
+}
+
 func (m *Manager) Foreground(id int) error {
 	job := m.Get(id)
 	if job == nil {
 		return fmt.Errorf("job %d not found", id)
 	}
-
-	if job.State == JobStopped {
-		if err := m.Continue(id); err != nil {
-			return err
-		}
+	state := m.State(id)
+	if state == JobDone || state == JobKilled {
+		return fmt.Errorf("job %d has terminated", id)
 	}
 
-	if job.Cmd != nil {
-		return job.Cmd.Wait()
+	// A job can be stopped without the shell seeing it, as by SIGTTIN
+	// for reading the terminal in the background, so its process group
+	// is continued whatever its state.
+	if job.Process != nil {
+		m.mu.Lock()
+		job.State = JobRunning
+		m.mu.Unlock()
+		syscall.Kill(-job.PID, syscall.SIGCONT)
+	} else if state == JobStopped {
+		return fmt.Errorf("no process for job %d", id)
 	}
 
+	<-job.done
 	return nil
 }
 
@@ -239,6 +407,9 @@ func (m *Manager) Background(id int) error {
 	if job == nil {
 		return fmt.Errorf("job %d not found", id)
 	}
+	if job.State == JobDone || job.State == JobKilled {
+		return fmt.Errorf("job %d has terminated", id)
+	}
 
 	if job.State == JobStopped {
 		return m.Continue(id)
@@ -254,31 +425,30 @@ func (m *Manager) Clean() {
 	for id, job := range m.jobs {
 		if job.State == JobDone || job.State == JobKilled {
 			delete(m.jobs, id)
+			m.forget(id)
 		}
 	}
 }
 
+// Wait blocks until every job has finished.
 func (m *Manager) Wait() {
-	for {
-		running := m.Running()
-		if len(running) == 0 {
-			break
-		}
-		time.Sleep(100 * time.Millisecond)
+	for _, job := range m.List() {
+		<-job.done
 	}
 }
 
-func (m *Manager) WaitJob(id int) error {
+// WaitJob blocks until job id has finished and returns its exit code.
+func (m *Manager) WaitJob(id int) (int, error) {
 	job := m.Get(id)
 	if job == nil {
-		return fmt.Errorf("job %d not found", id)
+		return 127, fmt.Errorf("job %d not found", id)
 	}
 
-	if job.Cmd != nil {
-		return job.Cmd.Wait()
-	}
+	<-job.done
 
-	return nil
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return job.ExitCode, nil
 }
 
 func (m *Manager) monitor(job *Job) {
@@ -288,58 +458,102 @@ func (m *Manager) monitor(job *Job) {
 
 	err := job.Cmd.Wait()
 
+	code, state := 0, JobDone
+	if exitError, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			code, state = 128+int(status.Signal()), JobKilled
+		} else {
+			code = exitError.ExitCode()
+		}
+	} else if err != nil {
+		code = 1
+	}
+	m.finish(job, code, state)
+}
+
+// finish records that job has ended and wakes anyone waiting for it.
+func (m *Manager) finish(job *Job, code int, state JobState) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
 	now := time.Now()
 	job.Finished = &now
+	job.ExitCode = code
+	job.State = state
+	close(job.done)
+	m.finished = append(m.finished, job)
+}
 
-	if err != nil {
-		if exitError, ok := err.(*exec.ExitError); ok {
-			if status, ok := exitError.Sys().(syscall.WaitStatus); ok {
-				job.ExitCode = status.ExitStatus()
-			}
-		}
-		job.State = JobKilled
-	} else {
-		job.ExitCode = 0
-		job.State = JobDone
+// Notifications returns a bash-style line, like "[1]+  Done  sleep 1",
+// for each job that ended since the last call, and forgets those jobs.
+func (m *Manager) Notifications() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.Slice(m.finished, func(i, j int) bool { return m.finished[i].ID < m.finished[j].ID })
+
+	var notices []string
+	for _, job := range m.finished {
+		notices = append(notices, fmt.Sprintf("[%d]%c  %-24s%s", job.ID, m.mark(job.ID), job.status(), job.Command))
+	}
+	for _, job := range m.finished {
+		delete(m.jobs, job.ID)
+		m.forget(job.ID)
 	}
+	m.finished = nil
+
+	return notices
 }
 
-func (m *Manager) Print() {
-	jobs := m.List()
-	if len(jobs) == 0 {
-		fmt.Println("No jobs")
-		return
+// mark returns '+' for the current job, '-' for the previous one and a
+// space for any other. The caller holds m.mu.
+func (m *Manager) mark(id int) rune {
+	switch {
+	case len(m.recent) > 0 && m.recent[len(m.recent)-1] == id:
+		return '+'
+	case len(m.recent) > 1 && m.recent[len(m.recent)-2] == id:
+		return '-'
 	}
+	return ' '
+}
+
+// status describes how a finished job ended.
+func (job *Job) status() string {
+	switch {
+	case job.State == JobKilled && job.ExitCode > 128:
+		name := syscall.Signal(job.ExitCode - 128).String()
+		return strings.ToUpper(name[:1]) + name[1:]
+	case job.State == JobKilled:
+		return "Killed"
+	case job.ExitCode != 0:
+		return fmt.Sprintf("Exit %d", job.ExitCode)
+	}
+	return "Done"
+}
 
-	fmt.Printf("%-3s %-8s %-10s %-8s %s\n", "ID", "PID", "STATE", "TIME", "COMMAND")
-	fmt.Printf("%-3s %-8s %-10s %-8s %s\n", "---", "-----", "-----", "----", "-------")
+// Print writes jobs in order of their IDs the way bash's jobs does, as
+// "[1]+  Running                 sleep 10 &", with each PID after the
+// job number if long is set.
+func (m *Manager) Print(w io.Writer, jobs []*Job, long bool) {
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
 	for _, job := range jobs {
-		duration := time.Since(job.Started)
-		if job.Finished != nil {
-			duration = job.Finished.Sub(job.Started)
+		status, command := job.status(), job.Command
+		switch job.State {
+		case JobRunning:
+			status, command = "Running", command+" &"
+		case JobStopped:
+			status = "Stopped"
 		}
 
-		fmt.Printf("%-3d %-8d %-10s %-8s %s\n",
-			job.ID,
-			job.PID,
-			job.State.String(),
-			formatDuration(duration),
-			job.Command,
-		)
-	}
-}
-
-func formatDuration(d time.Duration) string {
-	if d < time.Minute {
-		return fmt.Sprintf("%.0fs", d.Seconds())
-	} else if d < time.Hour {
-		return fmt.Sprintf("%.0fm", d.Minutes())
-	} else {
-		return fmt.Sprintf("%.1fh", d.Hours())
+		if long {
+			fmt.Fprintf(w, "[%d]%c %d %-24s%s\n", job.ID, m.mark(job.ID), job.PID, status, command)
+		} else {
+			fmt.Fprintf(w, "[%d]%c  %-24s%s\n", job.ID, m.mark(job.ID), status, command)
+		}
 	}
 }
 
@@ -0,0 +1,75 @@
+package jobs
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// signals maps the names kill and trap accept, without the SIG prefix,
+// to their signals.
+var signals = map[string]syscall.Signal{
+	"HUP":    syscall.SIGHUP,
+	"INT":    syscall.SIGINT,
+	"QUIT":   syscall.SIGQUIT,
+	"ILL":    syscall.SIGILL,
+	"TRAP":   syscall.SIGTRAP,
+	"ABRT":   syscall.SIGABRT,
+	"BUS":    syscall.SIGBUS,
+	"FPE":    syscall.SIGFPE,
+	"KILL":   syscall.SIGKILL,
+	"USR1":   syscall.SIGUSR1,
+	"SEGV":   syscall.SIGSEGV,
+	"USR2":   syscall.SIGUSR2,
+	"PIPE":   syscall.SIGPIPE,
+	"ALRM":   syscall.SIGALRM,
+	"TERM":   syscall.SIGTERM,
+	"CHLD":   syscall.SIGCHLD,
+	"CONT":   syscall.SIGCONT,
+	"STOP":   syscall.SIGSTOP,
+	"TSTP":   syscall.SIGTSTP,
+	"TTIN":   syscall.SIGTTIN,
+	"TTOU":   syscall.SIGTTOU,
+	"URG":    syscall.SIGURG,
+	"XCPU":   syscall.SIGXCPU,
+	"XFSZ":   syscall.SIGXFSZ,
+	"VTALRM": syscall.SIGVTALRM,
+	"PROF":   syscall.SIGPROF,
+	"WINCH":  syscall.SIGWINCH,
+	"IO":     syscall.SIGIO,
+	"SYS":    syscall.SIGSYS,
+}
+
+// ParseSignal returns the signal spec names: a number, or a name such as
+// TERM or SIGTERM in either case. 0 is accepted, as kill uses it to test
+// whether a process exists.
+func ParseSignal(spec string) (syscall.Signal, bool) {
+	if n, err := strconv.Atoi(spec); err == nil {
+		return syscall.Signal(n), n >= 0 && n <= 64
+	}
+	name := strings.TrimPrefix(strings.ToUpper(spec), "SIG")
+	sig, ok := signals[name]
+	return sig, ok
+}
+
+// SignalName returns the name of sig without the SIG prefix, or its
+// number if it has none.
+func SignalName(sig syscall.Signal) string {
+	for name, s := range signals {
+		if s == sig {
+			return name
+		}
+	}
+	return strconv.Itoa(int(sig))
+}
+
+// Signals returns the named signals in numeric order.
+func Signals() []syscall.Signal {
+	list := make([]syscall.Signal, 0, len(signals))
+	for _, sig := range signals {
+		list = append(list, sig)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i] < list[j] })
+	return list
+}
@@ -0,0 +1,248 @@
+package parser
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// GlobOptions are the shell options that change pathname expansion.
+type GlobOptions struct {
+	GlobStar   bool // ** alone as a component matches any number of directories
+	NullGlob   bool // a pattern that matches nothing expands to nothing
+	FailGlob   bool // a pattern that matches nothing is an error
+	DotGlob    bool // wildcards match a leading dot too
+	NoCaseGlob bool // letters match regardless of case
+}
+
+// HasGlob reports whether a word from the lexer holds an unquoted *, ?
+// or bracket expression outside any $ expansion, which makes it a
+// pattern for pathname expansion.
+func HasGlob(word string) bool {
+	for i := 0; i < len(word); i++ {
+		switch word[i] {
+		case '\\':
+			i++
+		case '$':
+			i = expansionEnd(word, i) - 1
+		case '*', '?':
+			return true
+		case '[':
+			if _, _, ok := bracket(word, i); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ExpandGlobs returns the paths that pattern, a word from the lexer,
+// matches, sorted, or nil if there are none. Unless opts.DotGlob is set,
+// a wildcard only matches a leading dot in a name when the pattern's
+// component starts with one.
+func ExpandGlobs(pattern string, opts GlobOptions) []string {
+	prefix, parts := "", splitComponents(pattern)
+	if parts[0] == "" && len(parts) > 1 {
+		prefix, parts = "/", parts[1:]
+	}
+
+	matches := glob(prefix, parts, opts)
+	sort.Strings(matches)
+	return matches
+}
+
+// splitComponents splits pattern at each slash, quoted or not. An
+// absolute pattern starts with an empty component.
+func splitComponents(pattern string) []string {
+	var parts []string
+	start := 0
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '/':
+			parts = append(parts, pattern[start:i])
+			start = i + 1
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			if pattern[i+1] == '/' {
+				parts = append(parts, pattern[start:i])
+				start = i + 2
+			}
+			i++
+		}
+	}
+	return append(parts, pattern[start:])
+}
+
+// glob returns the paths under prefix, which is empty or ends in a
+// slash, that match the components in parts.
+func glob(prefix string, parts []string, opts GlobOptions) []string {
+	part, rest := parts[0], parts[1:]
+
+	switch {
+	case part == "":
+		// A trailing slash only matches directories, which prefix
+		// already is; a doubled one is the same as one.
+		if len(rest) == 0 {
+			if prefix == "" {
+				return nil
+			}
+			return []string{prefix}
+		}
+		return glob(prefix, rest, opts)
+
+	case !HasGlob(part):
+		path := prefix + Unescape(part)
+		if len(rest) == 0 {
+			if _, err := os.Lstat(path); err != nil {
+				return nil
+			}
+			return []string{path}
+		}
+		return glob(path+"/", rest, opts)
+
+	case part == "**" && opts.GlobStar:
+		if len(rest) == 0 {
+			return walk(prefix, opts.DotGlob)
+		}
+		// ** matches no directory at all, or any one and then ** again.
+		matches := glob(prefix, rest, opts)
+		for _, dir := range readDir(prefix) {
+			if (opts.DotGlob || !strings.HasPrefix(dir.Name(), ".")) && dir.IsDir() {
+				matches = append(matches, glob(prefix+dir.Name()+"/", parts, opts)...)
+			}
+		}
+		return matches
+	}
+
+	re := componentRegexp(part, opts.NoCaseGlob)
+	if re == nil {
+		return nil
+	}
+	dots := opts.DotGlob || strings.HasPrefix(part, ".") || strings.HasPrefix(part, "\\.")
+
+	var matches []string
+	for _, entry := range readDir(prefix) {
+		name := entry.Name()
+		if strings.HasPrefix(name, ".") && !dots || !re.MatchString(name) {
+			continue
+		}
+		if len(rest) == 0 {
+			matches = append(matches, prefix+name)
+			continue
+		}
+		if info, err := os.Stat(prefix + name); err == nil && info.IsDir() {
+			matches = append(matches, glob(prefix+name+"/", rest, opts)...)
+		}
+	}
+	return matches
+}
+
+// walk returns every file and directory below prefix, for a trailing
+// **. Hidden names are left out unless dots is set, and symbolic links
+// are not followed.
+func walk(prefix string, dots bool) []string {
+	var paths []string
+	for _, entry := range readDir(prefix) {
+		if !dots && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		path := prefix + entry.Name()
+		paths = append(paths, path)
+		if entry.IsDir() {
+			paths = append(paths, walk(path+"/", dots)...)
+		}
+	}
+	return paths
+}
+
+func readDir(prefix string) []os.DirEntry {
+	dir := prefix
+	if dir == "" {
+		dir = "."
+	}
+	entries, _ := os.ReadDir(dir)
+	return entries
+}
+
+// componentRegexp translates one component of a pattern into an anchored
+// regular expression, ignoring case if nocase is set, or returns nil if
+// it has an invalid class such as [[:foo:]].
+func componentRegexp(part string, nocase bool) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^(?s:")
+	if nocase {
+		b.WriteString("(?i)")
+	}
+	for i := 0; i < len(part); i++ {
+		switch c := part[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '\\':
+			if i+1 < len(part) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(part[i : i+1]))
+		case '[':
+			class, end, ok := bracket(part, i)
+			if !ok {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(class)
+			i = end - 1
+		default:
+			b.WriteString(regexp.QuoteMeta(part[i : i+1]))
+		}
+	}
+	b.WriteString(")$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return nil
+	}
+	return re
+}
+
+// bracket translates the bracket expression that starts at pattern[i]
+// into a regular expression class, and returns the index just past it.
+// A ! or ^ first negates it, a ] first is literal, and [:alpha:] and the
+// other POSIX classes may appear inside. ok is false if it is not
+// closed.
+func bracket(pattern string, i int) (class string, end int, ok bool) {
+	var b strings.Builder
+	b.WriteByte('[')
+	j := i + 1
+	if j < len(pattern) && (pattern[j] == '!' || pattern[j] == '^') {
+		b.WriteByte('^')
+		j++
+	}
+
+	for first := true; j < len(pattern); j, first = j+1, false {
+		c := pattern[j]
+		switch {
+		case c == ']' && !first:
+			b.WriteByte(']')
+			return b.String(), j + 1, true
+		case c == '[' && j+1 < len(pattern) && pattern[j+1] == ':':
+			close := strings.Index(pattern[j+2:], ":]")
+			if close < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(pattern[j : j+2+close+2])
+			j += 2 + close + 1
+		case c == '\\' && j+1 < len(pattern):
+			j++
+			fmt.Fprintf(&b, `\x{%x}`, pattern[j])
+		case c == '-' || c >= 0x80 || isAlnum(c):
+			b.WriteByte(c)
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		}
+	}
+	return "", i, false
+}
@@ -0,0 +1,143 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// globTree creates the files and directories named in paths under a new
+// temporary directory, which it makes the working directory for the test.
+func globTree(t *testing.T, paths ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, path := range paths {
+		path = filepath.Join(dir, path)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestComponentRegexp(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		nomatch []string
+	}{
+		{"[[:alpha:]]", []string{"a", "Z"}, []string{"1", "_", "ab"}},
+		{"[[:digit:]]x", []string{"0x", "9x"}, []string{"ax", "0"}},
+		{"[[:alnum:]]", []string{"a", "7"}, []string{"-"}},
+		{"[[:upper:]][[:lower:]]", []string{"Ab"}, []string{"ab", "AB"}},
+		{"[[:space:]]", []string{" ", "\t"}, []string{"x"}},
+		{"[[:punct:]]", []string{"!", "-"}, []string{"a"}},
+		{"[a-z]", []string{"a", "m", "z"}, []string{"A", "0"}},
+		{"[!abc]", []string{"d", "1"}, []string{"a", "b", "c"}},
+		{"[^abc]", []string{"d"}, []string{"a"}},
+		{"[]a]", []string{"]", "a"}, []string{"b"}},
+		{"[!]a]", []string{"b"}, []string{"]", "a"}},
+		{"[a-]", []string{"a", "-"}, []string{"b"}},
+		{"[\\*]", []string{"*"}, []string{"a"}},
+		{"[.]", []string{"."}, []string{"a"}},
+		{"*.[ch]", []string{"a.c", "b.h"}, []string{"a.o", "a.ch"}},
+		{"[ab", []string{"[ab"}, []string{"a"}},
+	}
+	for _, tt := range tests {
+		re := componentRegexp(tt.pattern, false)
+		if re == nil {
+			t.Errorf("componentRegexp(%q) = nil", tt.pattern)
+			continue
+		}
+		for _, name := range tt.match {
+			if !re.MatchString(name) {
+				t.Errorf("%q does not match %q", tt.pattern, name)
+			}
+		}
+		for _, name := range tt.nomatch {
+			if re.MatchString(name) {
+				t.Errorf("%q matches %q", tt.pattern, name)
+			}
+		}
+	}
+
+	if re := componentRegexp("[[:foo:]]", false); re != nil {
+		t.Errorf("componentRegexp(%q) = %v, want nil", "[[:foo:]]", re)
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	globTree(t,
+		"a.go", "b.go", "c.txt", ".hidden.go", "1.go",
+		"dir/d.go", "dir/sub/e.go", "dir/.dot/f.go", "other/g.txt",
+	)
+	tests := []struct {
+		pattern string
+		opts    GlobOptions
+		want    []string
+	}{
+		{"*.go", GlobOptions{}, []string{"1.go", "a.go", "b.go"}},
+		{"[[:alpha:]].go", GlobOptions{}, []string{"a.go", "b.go"}},
+		{"[[:digit:]].go", GlobOptions{}, []string{"1.go"}},
+		{"[a-b].go", GlobOptions{}, []string{"a.go", "b.go"}},
+		{"[!a].go", GlobOptions{}, []string{"1.go", "b.go"}},
+		{"?.txt", GlobOptions{}, []string{"c.txt"}},
+		{"*/*.go", GlobOptions{}, []string{"dir/d.go"}},
+		{"*.GO", GlobOptions{NoCaseGlob: true}, []string{"1.go", "a.go", "b.go"}},
+		{"*.go", GlobOptions{DotGlob: true}, []string{".hidden.go", "1.go", "a.go", "b.go"}},
+		{".*.go", GlobOptions{}, []string{".hidden.go"}},
+		{"*.none", GlobOptions{}, nil},
+
+		// Without globstar, ** is the same as *.
+		{"**/*.go", GlobOptions{}, []string{"dir/d.go"}},
+		{"**/*.go", GlobOptions{GlobStar: true}, []string{
+			"1.go", "a.go", "b.go", "dir/d.go", "dir/sub/e.go",
+		}},
+		{"dir/**/*.go", GlobOptions{GlobStar: true}, []string{"dir/d.go", "dir/sub/e.go"}},
+		{"**/*.go", GlobOptions{GlobStar: true, DotGlob: true}, []string{
+			".hidden.go", "1.go", "a.go", "b.go", "dir/.dot/f.go", "dir/d.go", "dir/sub/e.go",
+		}},
+		{"dir/**", GlobOptions{GlobStar: true}, []string{"dir/d.go", "dir/sub", "dir/sub/e.go"}},
+		{"**/*.txt", GlobOptions{GlobStar: true}, []string{"c.txt", "other/g.txt"}},
+		{"**/", GlobOptions{GlobStar: true}, []string{"dir/", "dir/sub/", "other/"}},
+	}
+	for _, tt := range tests {
+		if got := ExpandGlobs(tt.pattern, tt.opts); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ExpandGlobs(%q, %+v) = %q, want %q", tt.pattern, tt.opts, got, tt.want)
+		}
+	}
+}
+
+func TestHasGlob(t *testing.T) {
+	tests := []struct {
+		word string
+		want bool
+	}{
+		{"*.go", true},
+		{"a?", true},
+		{"[[:alpha:]]", true},
+		{"[ab]", true},
+		{"[ab", false},
+		{`\*.go`, false},
+		{"${x}", false},
+		{"$((2*3))", false},
+		{"plain", false},
+	}
+	for _, tt := range tests {
+		if got := HasGlob(tt.word); got != tt.want {
+			t.Errorf("HasGlob(%q) = %v, want %v", tt.word, got, tt.want)
+		}
+	}
+}
@@ -1,29 +1,69 @@
 package parser
 
 import (
+	"errors"
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 	"unicode"
+	"unicode/utf8"
 
 	"gosh/internal/ast"
 )
 
+// ErrIncomplete is returned by Parse when the input ends in the middle of
+// a command, such as an unclosed quote, a trailing pipe or a loop without
+// its done. Interactive callers use it to prompt for more input.
+var ErrIncomplete = errors.New("syntax error: unexpected end of file")
+
+// UnmatchedError is the ErrIncomplete returned when the input ends inside
+// quotes. It names the quote that was never closed.
+type UnmatchedError struct {
+	Quote byte
+}
+
+func (e *UnmatchedError) Error() string {
+	return fmt.Sprintf("syntax error: unexpected EOF while looking for matching `%c'", e.Quote)
+}
+
+func (e *UnmatchedError) Unwrap() error {
+	return ErrIncomplete
+}
+
 type Parser struct {
 	lexer  *Lexer
 	tokens []Token
 	pos    int
+	posix  func() bool
 }
 
 func New() *Parser {
 	return &Parser{}
 }
 
+// SetPOSIX installs the check for POSIX mode, consulted on every parse.
+// In POSIX mode bash extensions are syntax errors or ordinary words.
+func (p *Parser) SetPOSIX(posix func() bool) {
+	p.posix = posix
+}
+
+func (p *Parser) posixMode() bool {
+	return p.posix != nil && p.posix()
+}
+
 func (p *Parser) Parse(input string) ([]*ast.Command, error) {
 	p.lexer = NewLexer(input)
 	p.tokens = p.lexer.Tokenize()
 	p.pos = 0
 
+	if p.lexer.unterminated {
+		if quote := p.lexer.unmatched; quote != 0 {
+			return nil, &UnmatchedError{Quote: quote}
+		}
+		return nil, ErrIncomplete
+	}
+
 	var commands []*ast.Command
 
 	for p.pos < len(p.tokens) {
@@ -35,12 +75,23 @@ func (p *Parser) Parse(input string) ([]*ast.Command, error) {
 			break
 		}
 
+		start := p.current().Pos
 		cmd, err := p.parseCommand()
 		if err != nil {
 			return nil, err
 		}
+		if cmd != nil && p.current().Type == TokenBackground {
+			cmd = p.background(cmd, start)
+		}
+
+		if cmd == nil && p.current().Type != TokenSemicolon && p.current().Type != TokenNewline {
+			return nil, fmt.Errorf("syntax error near unexpected token `%s'", p.current().Value)
+		}
 
 		if cmd != nil {
+			if p.pos > 0 && p.pos <= len(p.tokens) {
+				cmd.Text = input[start:p.tokens[p.pos-1].End]
+			}
 			commands = append(commands, cmd)
 		}
 
@@ -53,17 +104,7 @@ func (p *Parser) Parse(input string) ([]*ast.Command, error) {
 }
 
 func (p *Parser) parseCommand() (*ast.Command, error) {
-	if tok := p.current(); tok.Type == TokenWord {
-		switch tok.Value {
-		case "if":
-			return p.parseIf()
-		case "while":
-			return p.parseWhile()
-		case "for":
-			return p.parseFor()
-		}
-	}
-	left, err := p.parsePipeline()
+	left, err := p.parseAndOrElement()
 	if err != nil {
 		return nil, err
 	}
@@ -72,10 +113,17 @@ func (p *Parser) parseCommand() (*ast.Command, error) {
 	for p.pos < len(p.tokens) && (p.current().Type == TokenAnd || p.current().Type == TokenOr) {
 		opTok := p.current()
 		p.advance()
-		right, err := p.parsePipeline()
+		p.skipNewlines()
+		right, err := p.parseAndOrElement()
 		if err != nil {
 			return nil, err
 		}
+		if right == nil {
+			if p.current().Type == TokenEOF {
+				return nil, ErrIncomplete
+			}
+			return nil, fmt.Errorf("syntax error near unexpected token `%s'", p.current().Value)
+		}
 		cmds = append(cmds, right)
 		if opTok.Type == TokenAnd {
 			ops = append(ops, "&&")
@@ -89,19 +137,153 @@ func (p *Parser) parseCommand() (*ast.Command, error) {
 	return &ast.Command{Type: ast.CommandList, List: &ast.List{Commands: cmds, Operators: ops}}, nil
 }
 
+func (p *Parser) parseAndOrElement() (*ast.Command, error) {
+	if tok := p.current(); tok.Type == TokenWord && !tok.Quoted {
+		switch tok.Value {
+		case "!":
+			return p.parseNegation()
+		case "function":
+			if p.posixMode() {
+				break
+			}
+			p.advance()
+			return p.parseFunction()
+		}
+		if len(tok.Value) > 2 && strings.HasSuffix(tok.Value, "()") || p.peek().Value == "()" {
+			return p.parseFunction()
+		}
+	}
+	return p.parsePipeline()
+}
+
+// parsePipelineCommand parses one stage of a pipeline: a compound command
+// or a simple one. It returns nil if there is no command.
+func (p *Parser) parsePipelineCommand() (*ast.Command, error) {
+	if tok := p.current(); tok.Type == TokenArithmetic {
+		p.advance()
+		return &ast.Command{
+			Type:       ast.CommandArithmetic,
+			Arithmetic: &ast.ArithmeticCommand{Expression: tok.Value},
+		}, nil
+	}
+	if tok := p.current(); tok.Type == TokenWord && !tok.Quoted {
+		switch tok.Value {
+		case "if":
+			return p.parseIf()
+		case "while":
+			return p.parseWhile()
+		case "for":
+			return p.parseFor()
+		case "case":
+			return p.parseCase()
+		case "[[":
+			if p.posixMode() {
+				break
+			}
+			return p.parseConditional()
+		case "{":
+			return p.parseGroup()
+		}
+	}
+	return p.parseSimpleCommand()
+}
+
+func (p *Parser) parseNegation() (*ast.Command, error) {
+	p.advance() // skip '!'
+
+	cmd, err := p.parseAndOrElement()
+	if err != nil {
+		return nil, err
+	}
+	if cmd == nil {
+		if p.current().Type == TokenEOF {
+			return nil, ErrIncomplete
+		}
+		return nil, fmt.Errorf("syntax error near unexpected token `%s'", p.current().Value)
+	}
+
+	return &ast.Command{
+		Type:     ast.CommandNegation,
+		Negation: &ast.NegationCommand{Command: cmd},
+	}, nil
+}
+
+// parseFunction parses a function definition from its name onwards, in
+// either the name() { ...; } or the function name { ...; } form.
+func (p *Parser) parseFunction() (*ast.Command, error) {
+	tok := p.current()
+	if tok.Type == TokenEOF {
+		return nil, ErrIncomplete
+	}
+	if tok.Type != TokenWord {
+		return nil, fmt.Errorf("syntax error near unexpected token `%s'", tok.Value)
+	}
+	name := strings.TrimSuffix(tok.Value, "()")
+	p.advance()
+	if name == tok.Value && p.current().Value == "()" {
+		p.advance()
+	}
+
+	p.skipNewlines()
+	switch {
+	case p.current().Type == TokenEOF:
+		return nil, ErrIncomplete
+	case p.current().Value != "{":
+		return nil, fmt.Errorf("syntax error near unexpected token `%s'", p.current().Value)
+	}
+
+	body, err := p.parseGroup()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ast.Command{
+		Type: ast.CommandFunction,
+		Function: &ast.FunctionCommand{
+			Name: name,
+			Body: body,
+		},
+	}, nil
+}
+
+func (p *Parser) parseGroup() (*ast.Command, error) {
+	p.advance() // skip '{'
+
+	cmds, err := p.parseCompoundCommands("}")
+	if err != nil {
+		return nil, err
+	}
+	p.advance() // skip '}'
+
+	return &ast.Command{
+		Type:  ast.CommandGroup,
+		Group: &ast.GroupCommand{Commands: cmds},
+	}, nil
+}
+
 func (p *Parser) parsePipeline() (*ast.Command, error) {
-	left, err := p.parseSimpleCommand()
+	left, err := p.parsePipelineCommand()
 	if err != nil {
 		return nil, err
 	}
 
 	for p.pos < len(p.tokens) && p.current().Type == TokenPipe {
+		if left == nil {
+			return nil, fmt.Errorf("syntax error near unexpected token `|'")
+		}
 		p.advance()
+		p.skipNewlines()
 
-		right, err := p.parseSimpleCommand()
+		right, err := p.parsePipelineCommand()
 		if err != nil {
 			return nil, err
 		}
+		if right == nil {
+			if p.current().Type == TokenEOF {
+				return nil, ErrIncomplete
+			}
+			return nil, fmt.Errorf("syntax error near unexpected token `%s'", p.current().Value)
+		}
 
 		left = &ast.Command{
 			Type: ast.CommandPipeline,
@@ -118,15 +300,24 @@ func (p *Parser) parsePipeline() (*ast.Command, error) {
 func (p *Parser) parseSimpleCommand() (*ast.Command, error) {
 	var args []string
 	var redirects []*ast.Redirect
+	var assignments []string
 
 	for p.pos < len(p.tokens) {
 		token := p.current()
 
 		switch token.Type {
 		case TokenWord:
-			args = append(args, token.Value)
+			if !token.Quoted && IsArrayAssignment(token.Value) && p.posixMode() {
+				return nil, fmt.Errorf("syntax error near unexpected token `('")
+			}
+			if len(args) == 0 && token.Assignment {
+				assignments = append(assignments, token.Value)
+			} else {
+				args = append(args, token.Value)
+			}
 			p.advance()
-		case TokenRedirectOut, TokenRedirectIn, TokenRedirectAppend:
+		case TokenRedirectOut, TokenRedirectIn, TokenRedirectAppend, TokenHereString, TokenHereDoc,
+			TokenRedirectBoth, TokenRedirectBothAppend, TokenDupOut, TokenDupIn, TokenClobber:
 			redirect, err := p.parseRedirect()
 			if err != nil {
 				return nil, err
@@ -140,6 +331,19 @@ func (p *Parser) parseSimpleCommand() (*ast.Command, error) {
 	}
 
 done:
+	// Assignments with no command after them set shell variables and are
+	// left as the command's words; otherwise they form its environment.
+	var env map[string]string
+	if len(args) == 0 {
+		args = assignments
+	} else if len(assignments) > 0 {
+		env = make(map[string]string, len(assignments))
+		for _, assignment := range assignments {
+			name, value, _ := strings.Cut(assignment, "=")
+			env[name] = value
+		}
+	}
+
 	if len(args) == 0 {
 		return nil, nil
 	}
@@ -150,35 +354,74 @@ done:
 			Name:      args[0],
 			Args:      args[1:],
 			Redirects: redirects,
+			Env:       env,
 		},
 	}, nil
 }
 
 func (p *Parser) parseRedirect() (*ast.Redirect, error) {
 	token := p.current()
+	op := strings.TrimLeft(token.Value, "0123456789")
+	fd := -1
+	if n := len(token.Value) - len(op); n > 0 {
+		fd, _ = strconv.Atoi(token.Value[:n])
+	}
+
+	switch token.Type {
+	case TokenHereString, TokenRedirectBoth, TokenRedirectBothAppend:
+		if p.posixMode() {
+			return nil, fmt.Errorf("syntax error near unexpected token `%s'", op)
+		}
+	}
 	p.advance()
 
 	if p.pos >= len(p.tokens) || p.current().Type != TokenWord {
 		return nil, fmt.Errorf("expected filename after redirect")
 	}
 
-	target := p.current().Value
+	target := p.current()
 	p.advance()
 
-	var redirectType ast.RedirectType
+	redirect := &ast.Redirect{Target: target.Value, Source: fd, Quoted: target.Quoted}
 	switch token.Type {
 	case TokenRedirectOut:
-		redirectType = ast.RedirectOutput
+		redirect.Type = ast.RedirectOutput
 	case TokenRedirectIn:
-		redirectType = ast.RedirectInput
+		redirect.Type = ast.RedirectInput
 	case TokenRedirectAppend:
-		redirectType = ast.RedirectAppend
+		redirect.Type = ast.RedirectAppend
+	case TokenClobber:
+		redirect.Type = ast.RedirectClobber
+	case TokenHereString:
+		redirect.Type = ast.RedirectHereString
+	case TokenHereDoc:
+		redirect.Type = ast.RedirectHereDoc
+		redirect.HereDoc = target.HereDoc
+	case TokenRedirectBoth:
+		redirect.Type = ast.RedirectBoth
+	case TokenRedirectBothAppend:
+		redirect.Type = ast.RedirectBothAppend
+	case TokenDupOut, TokenDupIn:
+		// >&1 and <&0 duplicate a descriptor; >&file is bash's synonym
+		// for &>file.
+		switch {
+		case isDigits(target.Value) || target.Value == "-":
+			redirect.Type = ast.RedirectDup
+		case token.Type == TokenDupOut && fd <= 1 && !p.posixMode():
+			redirect.Type = ast.RedirectBoth
+		default:
+			return nil, fmt.Errorf("%s: ambiguous redirect", target.Value)
+		}
 	}
 
-	return &ast.Redirect{
-		Type:   redirectType,
-		Target: target,
-	}, nil
+	if redirect.Source < 0 {
+		redirect.Source = 1
+		switch token.Type {
+		case TokenRedirectIn, TokenHereString, TokenHereDoc, TokenDupIn:
+			redirect.Source = 0
+		}
+	}
+	return redirect, nil
 }
 
 func (p *Parser) current() Token {
@@ -188,6 +431,13 @@ func (p *Parser) current() Token {
 	return p.tokens[p.pos]
 }
 
+func (p *Parser) peek() Token {
+	if p.pos+1 >= len(p.tokens) {
+		return Token{Type: TokenEOF}
+	}
+	return p.tokens[p.pos+1]
+}
+
 func (p *Parser) advance() {
 	if p.pos < len(p.tokens) {
 		p.pos++
@@ -202,24 +452,48 @@ const (
 	TokenRedirectOut
 	TokenRedirectIn
 	TokenRedirectAppend
+	TokenHereString
+	TokenHereDoc
+	TokenRedirectBoth
+	TokenRedirectBothAppend
+	TokenDupOut
+	TokenDupIn
+	TokenClobber
 	TokenSemicolon
+	TokenCaseBreak
 	TokenNewline
 	TokenAnd
 	TokenOr
 	TokenBackground
+	TokenArithmetic
 	TokenEOF
 )
 
 type Token struct {
-	Type  TokenType
-	Value string
-	Pos   int
+	Type   TokenType
+	Value  string
+	Pos    int
+	End    int
+	Quoted bool
+
+	// Assignment is set for a word that starts with an unquoted name=,
+	// which can be an assignment even if the value is quoted.
+	Assignment bool
+
+	// HereDoc is the body of the here-document whose delimiter this
+	// token is.
+	HereDoc string
 }
 
 type Lexer struct {
-	input  string
-	pos    int
-	tokens []Token
+	input        string
+	pos          int
+	start        int
+	tokens       []Token
+	unterminated bool
+	unmatched    byte // the quote left open, if that is why
+	ioNumber     string
+	hereDocs     []int
 }
 
 func NewLexer(input string) *Lexer {
@@ -230,11 +504,19 @@ func NewLexer(input string) *Lexer {
 }
 
 func (l *Lexer) Tokenize() []Token {
+	// Shell input averages a token for every few bytes; sizing for that
+	// up front saves regrowing the slice on large scripts.
+	if l.tokens == nil {
+		l.tokens = make([]Token, 0, len(l.input)/4+1)
+	}
+
 	for l.pos < len(l.input) {
+		l.start = l.pos
 		if unicode.IsSpace(rune(l.input[l.pos])) {
 			if l.input[l.pos] == '\n' {
-				l.addToken(TokenNewline, "\n")
 				l.pos++
+				l.addToken(TokenNewline, "\n")
+				l.readHereDocs()
 			} else {
 				l.skipWhitespace()
 			}
@@ -244,47 +526,124 @@ func (l *Lexer) Tokenize() []Token {
 		switch l.input[l.pos] {
 		case '|':
 			if l.pos+1 < len(l.input) && l.input[l.pos+1] == '|' {
-				l.addToken(TokenOr, "||")
 				l.pos += 2
+				l.addToken(TokenOr, "||")
 			} else {
-				l.addToken(TokenPipe, "|")
 				l.pos++
+				l.addToken(TokenPipe, "|")
 			}
 		case '&':
 			if l.pos+1 < len(l.input) && l.input[l.pos+1] == '&' {
+				l.pos += 2
 				l.addToken(TokenAnd, "&&")
+			} else if strings.HasPrefix(l.input[l.pos:], "&>>") {
+				l.pos += 3
+				l.addToken(TokenRedirectBothAppend, "&>>")
+			} else if strings.HasPrefix(l.input[l.pos:], "&>") {
+				// Only an immediately following '>' makes this a redirect;
+				// "cmd &" and "cmd & >file" still run cmd in the background.
 				l.pos += 2
+				l.addToken(TokenRedirectBoth, "&>")
 			} else {
-				l.addToken(TokenBackground, "&")
 				l.pos++
+				l.addToken(TokenBackground, "&")
 			}
 		case '>':
-			if l.pos+1 < len(l.input) && l.input[l.pos+1] == '>' {
-				l.addToken(TokenRedirectAppend, ">>")
+			switch {
+			case strings.HasPrefix(l.input[l.pos:], ">>"):
+				l.addRedirect(TokenRedirectAppend, ">>")
+			case strings.HasPrefix(l.input[l.pos:], ">&"):
+				l.addRedirect(TokenDupOut, ">&")
+			case strings.HasPrefix(l.input[l.pos:], ">|"):
+				l.addRedirect(TokenClobber, ">|")
+			default:
+				l.addRedirect(TokenRedirectOut, ">")
+			}
+		case '<':
+			switch {
+			case strings.HasPrefix(l.input[l.pos:], "<<<"):
+				l.addRedirect(TokenHereString, "<<<")
+			case strings.HasPrefix(l.input[l.pos:], "<<-"):
+				l.addRedirect(TokenHereDoc, "<<-")
+				l.hereDocs = append(l.hereDocs, len(l.tokens))
+			case strings.HasPrefix(l.input[l.pos:], "<<"):
+				l.addRedirect(TokenHereDoc, "<<")
+				l.hereDocs = append(l.hereDocs, len(l.tokens))
+			case strings.HasPrefix(l.input[l.pos:], "<&"):
+				l.addRedirect(TokenDupIn, "<&")
+			default:
+				l.addRedirect(TokenRedirectIn, "<")
+			}
+		case ';':
+			if strings.HasPrefix(l.input[l.pos:], ";;") {
 				l.pos += 2
+				l.addToken(TokenCaseBreak, ";;")
 			} else {
-				l.addToken(TokenRedirectOut, ">")
 				l.pos++
+				l.addToken(TokenSemicolon, ";")
 			}
-		case '<':
-			l.addToken(TokenRedirectIn, "<")
-			l.pos++
-		case ';':
-			l.addToken(TokenSemicolon, ";")
-			l.pos++
-		case '"', '\'':
-			l.tokenizeQuotedString()
 		case '#':
 			l.skipComment()
+		case '(':
+			if strings.HasPrefix(l.input[l.pos:], "((") {
+				l.tokenizeArithmetic()
+			} else {
+				l.tokenizeWord()
+			}
 		default:
 			l.tokenizeWord()
 		}
 	}
 
+	if len(l.hereDocs) > 0 {
+		l.unterminated = true
+	}
+
+	l.start = l.pos
 	l.addToken(TokenEOF, "")
 	return l.tokens
 }
 
+// readHereDocs reads the bodies of the here-documents opened on the line
+// just ended, in order, into their delimiter tokens. For <<-, leading
+// tabs, and only tabs, are removed from each line and the delimiter.
+func (l *Lexer) readHereDocs() {
+	for len(l.hereDocs) > 0 {
+		index := l.hereDocs[0]
+		l.hereDocs = l.hereDocs[1:]
+		if index >= len(l.tokens) || l.tokens[index].Type != TokenWord {
+			continue
+		}
+
+		tok := &l.tokens[index]
+		delimiter := Unescape(tok.Value)
+		tok.Value = delimiter
+		stripTabs := strings.HasSuffix(l.tokens[index-1].Value, "<<-")
+
+		var body strings.Builder
+		for {
+			if l.pos >= len(l.input) {
+				l.unterminated = true
+				return
+			}
+			end := strings.IndexByte(l.input[l.pos:], '\n')
+			if end < 0 {
+				end = len(l.input) - l.pos
+			}
+			line := l.input[l.pos : l.pos+end]
+			l.pos = min(l.pos+end+1, len(l.input))
+			if stripTabs {
+				line = strings.TrimLeft(line, "\t")
+			}
+			if line == delimiter {
+				break
+			}
+			body.WriteString(line + "\n")
+		}
+		tok.HereDoc = body.String()
+	}
+}
+
 func (l *Lexer) skipWhitespace() {
 	for l.pos < len(l.input) && unicode.IsSpace(rune(l.input[l.pos])) && l.input[l.pos] != '\n' {
 		l.pos++
@@ -297,77 +656,503 @@ func (l *Lexer) skipComment() {
 	}
 }
 
+// tokenizeWord reads a word of unquoted, single-quoted and double-quoted
+// parts up to an unquoted delimiter, so that a"b"c is the single word abc.
+// Quotes are removed, and the characters they protected, like those
+// escaped with a backslash, are left escaped in the value: expansion then
+// takes them literally and removes the backslashes, and patterns match
+// them literally.
 func (l *Lexer) tokenizeWord() {
-	start := l.pos
+	// Most words are the input as it is, and are sliced from it; the
+	// builder is used only from the first quote or escape on.
+	var b strings.Builder
+	begin, copied := l.pos, false
+	text := func() string {
+		if copied {
+			return b.String()
+		}
+		return l.input[begin:l.pos]
+	}
+	copyText := func() {
+		if !copied {
+			b.WriteString(l.input[begin:l.pos])
+			copied = true
+		}
+	}
+	quoted, assignment := false, false
 
+scan:
 	for l.pos < len(l.input) {
 		ch := l.input[l.pos]
-		if unicode.IsSpace(rune(ch)) || ch == '|' || ch == '&' || ch == '>' || ch == '<' || ch == ';' {
-			break
+		switch {
+		case unicode.IsSpace(rune(ch)) || ch == '|' || ch == '&' || ch == '>' || ch == '<' || ch == ';':
+			break scan
+		case ch == '\\' && l.pos+1 >= len(l.input):
+			// A backslash ending the input continues the line.
+			copyText()
+			l.unterminated = true
+			l.pos++
+			break scan
+		case ch == '\\' && l.input[l.pos+1] == '\n':
+			copyText()
+			l.pos += 2
+		case ch == '\\':
+			copyText()
+			quoted = true
+			writeQuoted(&b, l.input[l.pos+1])
+			l.pos += 2
+		case ch == '\'':
+			copyText()
+			quoted = true
+			end := strings.IndexByte(l.input[l.pos+1:], '\'')
+			if end < 0 {
+				l.unterminated, l.unmatched = true, '\''
+				end = len(l.input) - l.pos - 1
+			}
+			for i := l.pos + 1; i < l.pos+1+end; i++ {
+				writeQuoted(&b, l.input[i])
+			}
+			l.pos = min(l.pos+end+2, len(l.input))
+		case ch == '"':
+			copyText()
+			quoted = true
+			l.readDoubleQuoted(&b)
+		case ch == '=' && !quoted && !assignment && isName(text()):
+			assignment = true
+			if copied {
+				b.WriteByte(ch)
+			}
+			l.pos++
+		case ch == '(' && assignment && strings.HasSuffix(text(), "=") && isName(strings.TrimSuffix(text(), "=")):
+			// An array literal name=(...) is one word, spaces and all,
+			// with its quotes left for ArrayElements.
+			end := arrayLiteralEnd(l.input, l.pos)
+			if end < 0 {
+				l.unterminated = true
+				end = len(l.input) - 1
+			}
+			if copied {
+				b.WriteString(l.input[l.pos : end+1])
+			}
+			l.pos = end + 1
+		case ch == '$' && strings.HasPrefix(l.input[l.pos:], "$(("):
+			// Arithmetic $((...)) is part of the word, spaces and all.
+			end := expansionEnd(l.input, l.pos)
+			if copied {
+				b.WriteString(l.input[l.pos:end])
+			}
+			l.pos = end
+		default:
+			if copied {
+				b.WriteByte(ch)
+			}
+			l.pos++
 		}
-		l.pos++
 	}
 
-	word := l.input[start:l.pos]
+	word := text()
+	if !quoted && isDigits(word) && l.pos < len(l.input) && (l.input[l.pos] == '>' || l.input[l.pos] == '<') {
+		// A descriptor number like the 2 in 2>file belongs to the
+		// redirect that follows it.
+		l.ioNumber = word
+		return
+	}
+	if word == "" && !quoted {
+		// Only a line continuation.
+		return
+	}
 	l.addToken(TokenWord, word)
+	l.tokens[len(l.tokens)-1].Quoted = quoted
+	l.tokens[len(l.tokens)-1].Assignment = assignment
 }
 
-func (l *Lexer) tokenizeQuotedString() {
-	quote := l.input[l.pos]
-	l.pos++
-	start := l.pos
+// tokenizeArithmetic reads an arithmetic command ((...)) as one token
+// holding the expression, which may contain spaces, < and > and nested
+// parentheses.
+func (l *Lexer) tokenizeArithmetic() {
+	depth := 0
+	for i := l.pos + 2; i < len(l.input); i++ {
+		switch l.input[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth > 0 {
+				depth--
+				continue
+			}
+			if i+1 < len(l.input) && l.input[i+1] == ')' {
+				expr := l.input[l.pos+2 : i]
+				l.pos = i + 2
+				l.addToken(TokenArithmetic, expr)
+				return
+			}
+		}
+	}
 
-	for l.pos < len(l.input) && l.input[l.pos] != quote {
-		if l.input[l.pos] == '\\' && l.pos+1 < len(l.input) {
+	l.unterminated = true
+	expr := l.input[l.pos+2:]
+	l.pos = len(l.input)
+	l.addToken(TokenArithmetic, expr)
+}
+
+// readDoubleQuoted reads a double-quoted part of a word into b, starting
+// at the opening quote. Expansions inside are copied as they are, to be
+// expanded later, and a backslash escapes only $, `, ", \ and newline.
+func (l *Lexer) readDoubleQuoted(b *strings.Builder) {
+	l.pos++
+	for l.pos < len(l.input) {
+		ch := l.input[l.pos]
+		switch {
+		case ch == '"':
+			l.pos++
+			return
+		case ch == '\\' && l.pos+1 < len(l.input) && strings.IndexByte("$`\"\\\n", l.input[l.pos+1]) >= 0:
+			if next := l.input[l.pos+1]; next != '\n' {
+				writeQuoted(b, next)
+			}
 			l.pos += 2
-		} else {
+		case ch == '$':
+			end := expansionEnd(l.input, l.pos)
+			if end == l.pos+1 {
+				writeQuoted(b, ch)
+			} else {
+				b.WriteString(l.input[l.pos:end])
+			}
+			l.pos = end
+		default:
+			writeQuoted(b, ch)
 			l.pos++
 		}
 	}
+	l.unterminated, l.unmatched = true, '"'
+}
 
-	if l.pos >= len(l.input) {
-		l.addToken(TokenWord, l.input[start:])
-		return
+// expansionEnd returns the end of the expansion starting with the $ at
+// input[start], or start+1 if the $ does not begin one.
+func expansionEnd(input string, start int) int {
+	rest := input[start+1:]
+	switch {
+	case strings.HasPrefix(rest, "("):
+		if end := MatchingParen(input, start+1); end >= 0 {
+			return end + 1
+		}
+	case strings.HasPrefix(rest, "{"):
+		if end := strings.IndexByte(rest, '}'); end >= 0 {
+			return start + 1 + end + 1
+		}
+	case rest != "" && strings.IndexByte("#@*!?$-0123456789", rest[0]) >= 0:
+		return start + 2
+	default:
+		end := start + 1
+		for end < len(input) && (input[end] == '_' || isAlnum(input[end])) {
+			end++
+		}
+		return end
 	}
+	return start + 1
+}
 
-	word := l.input[start:l.pos]
-	l.pos++
-	l.addToken(TokenWord, word)
+// UnsetParameter returns the first parameter that a word from the lexer
+// refers to and isSet reports unset, for set -u. The special parameters,
+// such as $@ and $#, and expansions with a default or an alternative,
+// such as ${x:-y}, never count.
+func UnsetParameter(word string, isSet func(string) bool) (string, bool) {
+	for i := 0; i < len(word); i++ {
+		switch word[i] {
+		case '\\':
+			i++
+			continue
+		case '$':
+		default:
+			continue
+		}
+
+		end := expansionEnd(word, i)
+		ref := word[i+1 : end]
+		i = end - 1
+		if strings.HasPrefix(ref, "{") {
+			ref = strings.TrimPrefix(ref[1:len(ref)-1], "#")
+			name := ref
+			if n := strings.IndexFunc(ref, func(r rune) bool { return r != '_' && !isAlnum(byte(r)) }); n >= 0 {
+				name = ref[:n]
+				if op := strings.TrimPrefix(ref[n:], ":"); op != "" && strings.IndexByte("-=?+", op[0]) >= 0 {
+					continue
+				}
+			}
+			ref = name
+		}
+		if ref == "" || ref == "0" || !isAlnum(ref[0]) && ref[0] != '_' {
+			continue
+		}
+		if !isSet(ref) {
+			return ref, true
+		}
+	}
+	return "", false
+}
+
+// MatchingParen returns the index of the ) closing the ( at s[open], or
+// -1 if there is none. Parentheses that are quoted or escaped with a
+// backslash do not count.
+func MatchingParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		case '\'':
+			end := strings.IndexByte(s[i+1:], '\'')
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+		case '"':
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(s) {
+				return -1
+			}
+		}
+	}
+	return -1
+}
+
+// writeQuoted writes the quoted or escaped character c to b, behind a
+// backslash if it is ASCII punctuation, which expansion or a pattern might
+// otherwise treat as special.
+func writeQuoted(b *strings.Builder, c byte) {
+	if c < utf8.RuneSelf && c > ' ' && c != 0x7f && !isAlnum(c) {
+		b.WriteByte('\\')
+	}
+	b.WriteByte(c)
+}
+
+func isAlnum(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9'
+}
+
+// Unescape removes the backslashes the lexer leaves before quoted
+// characters, for words that are used as they are rather than expanded.
+func Unescape(word string) string {
+	if !strings.Contains(word, "\\") {
+		return word
+	}
+	var b strings.Builder
+	for i := 0; i < len(word); i++ {
+		if word[i] == '\\' && i+1 < len(word) {
+			i++
+		}
+		b.WriteByte(word[i])
+	}
+	return b.String()
+}
+
+// unescapedIndex is strings.IndexByte for a word from the lexer, skipping
+// escaped characters.
+func unescapedIndex(word string, c byte) int {
+	for i := 0; i < len(word); i++ {
+		switch word[i] {
+		case '\\':
+			i++
+		case c:
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *Lexer) addRedirect(tokenType TokenType, op string) {
+	l.pos += len(op)
+	l.addToken(tokenType, l.ioNumber+op)
+	l.ioNumber = ""
+}
+
+// arrayLiteralEnd returns the index of the parenthesis closing the array
+// literal opened at open, skipping quoted and escaped text, or -1 if it
+// is unclosed.
+func arrayLiteralEnd(input string, open int) int {
+	for i := open + 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '\'':
+			end := strings.IndexByte(input[i+1:], '\'')
+			if end < 0 {
+				return -1
+			}
+			i += end + 1
+		case '"':
+			end := doubleQuoteEnd(input, i)
+			if end < 0 {
+				return -1
+			}
+			i = end
+		case ')':
+			return i
+		}
+	}
+	return -1
+}
+
+// doubleQuoteEnd returns the index of the quote closing the double-quoted
+// text opened at open, past any backslash-escaped characters, or -1 if
+// there is none.
+func doubleQuoteEnd(input string, open int) int {
+	for i := open + 1; i < len(input); i++ {
+		switch input[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+func isDigits(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// IsArrayAssignment reports whether word assigns an array literal, as in
+// name=(a b c).
+func IsArrayAssignment(word string) bool {
+	eq := strings.IndexByte(word, '=')
+	return eq > 0 && isName(word[:eq]) && strings.HasPrefix(word[eq+1:], "(")
+}
+
+func isName(word string) bool {
+	for i, r := range word {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return word != ""
+}
+
+// ArrayElements splits the inside of an array literal into its elements.
+// Quotes are removed, and variables are expanded except within single
+// quotes.
+func ArrayElements(literal string, getVar func(string) string) []string {
+	var elems []string
+	var elem strings.Builder
+	inElem := false
+
+	for i := 0; i < len(literal); i++ {
+		ch := literal[i]
+		switch {
+		case ch == '\'':
+			end := strings.IndexByte(literal[i+1:], ch)
+			if end < 0 {
+				end = len(literal) - i - 1
+			}
+			elem.WriteString(literal[i+1 : i+1+end])
+			i += end + 1
+			inElem = true
+		case ch == '"':
+			end := doubleQuoteEnd(literal, i)
+			if end < 0 {
+				end = len(literal)
+			}
+			elem.WriteString(expandDoubleQuoted(literal[i+1:end], getVar))
+			i = end
+			inElem = true
+		case ch == '\\' && i+1 < len(literal):
+			elem.WriteByte(literal[i+1])
+			i++
+			inElem = true
+		case unicode.IsSpace(rune(ch)):
+			if inElem {
+				elems = append(elems, elem.String())
+				elem.Reset()
+				inElem = false
+			}
+		default:
+			end := i
+			for end < len(literal) && !unicode.IsSpace(rune(literal[end])) && literal[end] != '\'' && literal[end] != '"' && literal[end] != '\\' {
+				end++
+			}
+			elem.WriteString(ExpandVariables(literal[i:end], getVar))
+			i = end - 1
+			inElem = true
+		}
+	}
+
+	if inElem {
+		elems = append(elems, elem.String())
+	}
+	return elems
+}
+
+// expandDoubleQuoted expands the text between double quotes. A backslash
+// before $, `, " or \ makes that character literal and is removed.
+func expandDoubleQuoted(text string, getVar func(string) string) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) && strings.IndexByte("$`\"\\", text[i+1]) >= 0 {
+			b.WriteString(ExpandVariables(text[start:i], getVar))
+			b.WriteByte(text[i+1])
+			i++
+			start = i + 1
+		}
+	}
+	b.WriteString(ExpandVariables(text[start:], getVar))
+	return b.String()
 }
 
 func (l *Lexer) addToken(tokenType TokenType, value string) {
 	l.tokens = append(l.tokens, Token{
 		Type:  tokenType,
 		Value: value,
-		Pos:   l.pos,
+		Pos:   l.start,
+		End:   l.pos,
 	})
 }
 
+// The parameters ExpandVariables expands: $name, $#, $@, $*, $!, $? and
+// ${...}.
+var varRe = regexp.MustCompile(`\$(\w+|[#@*!?])|\$\{([^}]+)\}`)
+
+// A default assignment ${name:=word} or ${name=word}, split into name:=
+// or name= and the word.
+var assignDefaultRe = regexp.MustCompile(`^(\w+:?=)(.*)$`)
+
+// ExpandVariables expands the arithmetic $((...)) and the parameters in
+// text. getVar returns the value of a parameter, or of an arithmetic
+// expression given in parentheses as (expression); a reference that has
+// no value is left as it is. The word in ${name:=word} and ${name=word}
+// is expanded before getVar sees it, so that getVar can assign it.
 func ExpandVariables(text string, getVar func(string) string) string {
-	arithRe := regexp.MustCompile(`\$\(\(([^)]+)\)\)`)
-	text = arithRe.ReplaceAllStringFunc(text, func(m string) string {
-		inner := strings.TrimSpace(m[3 : len(m)-2])
-		if getVar == nil {
-			return m
-		}
-		varRe := regexp.MustCompile(`[A-Za-z_][A-Za-z0-9_]*`)
-		replaced := varRe.ReplaceAllStringFunc(inner, func(v string) string {
-			return getVar(v)
-		})
-		parts := strings.FieldsFunc(replaced, func(r rune) bool {
-			return r == '+' || r == '-' || r == '*' || r == '/'
-		})
-		if len(parts) == 2 {
-			inner = replaced
-		}
-		return replaced
-	})
+	if !strings.Contains(text, "$") {
+		return text
+	}
+	text = expandArithmetic(text, getVar)
 
-	varRegex := regexp.MustCompile(`\$(\w+)|\$\{([^}]+)\}`)
-	return varRegex.ReplaceAllStringFunc(text, func(match string) string {
+	return varRe.ReplaceAllStringFunc(text, func(match string) string {
 		var varName string
 		if strings.HasPrefix(match, "${") {
 			varName = match[2 : len(match)-1]
+			if m := assignDefaultRe.FindStringSubmatch(varName); m != nil {
+				varName = m[1] + ExpandVariables(m[2], getVar)
+			}
 		} else {
 			varName = match[1:]
 		}
@@ -379,196 +1164,662 @@ func ExpandVariables(text string, getVar func(string) string) string {
 	})
 }
 
-func ExpandGlobs(pattern string) ([]string, error) {
-	if !strings.ContainsAny(pattern, "*?[]") {
-		return []string{pattern}, nil
+// expandArithmetic replaces each $((expression)) in text with its value,
+// after expanding the parameters inside the expression.
+func expandArithmetic(text string, getVar func(string) string) string {
+	if !strings.Contains(text, "$((") {
+		return text
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(text, "$((")
+		if start < 0 {
+			break
+		}
+		// $((a) (b)) is a command substitution of a subshell, not
+		// arithmetic: the inner ( must close right before the outer one.
+		end := MatchingParen(text, start+1)
+		if end < 0 || MatchingParen(text, start+2) != end-1 {
+			b.WriteString(text[:start+1])
+			text = text[start+1:]
+			continue
+		}
+		b.WriteString(text[:start])
+		expr := ExpandVariables(text[start+3:end-1], getVar)
+		if value := getVar("(" + expr + ")"); value != "" {
+			b.WriteString(value)
+		} else {
+			b.WriteString(text[start : end+1])
+		}
+		text = text[end+1:]
 	}
+	b.WriteString(text)
+	return b.String()
+}
 
-	return []string{pattern}, nil
+// ExpandWord expands a word from the lexer: the unquoted parts with
+// ExpandVariables, while the characters the lexer escaped are taken as
+// they are.
+func ExpandWord(word string, getVar func(string) string) string {
+	if !strings.Contains(word, "\\") {
+		return ExpandVariables(word, getVar)
+	}
+	return expandEscaped(word, false, getVar)
 }
 
-func (p *Parser) parseIf() (*ast.Command, error) {
-	p.advance()
+// ExpandPattern expands a word used as a pattern, keeping the escapes of
+// quoted characters so that they match literally. If quoted is set, the
+// values of variables match literally too.
+func ExpandPattern(word string, quoted bool, getVar func(string) string) string {
+	expand := getVar
+	if quoted {
+		expand = func(name string) string {
+			return Quote(getVar(name))
+		}
+	}
+	return expandEscaped(word, true, expand)
+}
 
-	condTokens := []Token{}
-	for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && p.current().Value == "then") {
-		condTokens = append(condTokens, p.current())
-		p.advance()
+func expandEscaped(word string, keep bool, getVar func(string) string) string {
+	var b strings.Builder
+	start := 0
+	for i := 0; i < len(word); i++ {
+		if word[i] != '\\' || i+1 == len(word) {
+			continue
+		}
+		b.WriteString(ExpandVariables(word[start:i], getVar))
+		if keep {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(word[i+1])
+		i++
+		start = i + 1
 	}
-	if p.pos >= len(p.tokens) {
-		return nil, fmt.Errorf("expected 'then' keyword in if statement")
+	b.WriteString(ExpandVariables(word[start:], getVar))
+	return b.String()
+}
+
+// Quote escapes the punctuation in s the way the lexer escapes quoted
+// characters, so that expansion and patterns take s literally.
+func Quote(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		writeQuoted(&b, s[i])
 	}
-	p.advance()
+	return b.String()
+}
 
-	thenTokens := []Token{}
-	for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && (p.current().Value == "else" || p.current().Value == "fi")) {
-		thenTokens = append(thenTokens, p.current())
-		p.advance()
+// ExpandTilde replaces the unquoted tilde-prefix at the start of a word,
+// ~ or ~name up to the first /, with the directory home returns for the
+// name. In an assignment value the prefixes after each unquoted : are
+// replaced as well. Names home does not know are left as written.
+func ExpandTilde(word string, assignment bool, home func(string) (string, bool)) string {
+	if !strings.Contains(word, "~") {
+		return word
 	}
 
-	var elseTokens []Token
-	if p.pos < len(p.tokens) && p.current().Type == TokenWord && p.current().Value == "else" {
-		p.advance() // skip 'else'
-		for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && p.current().Value == "fi") {
-			elseTokens = append(elseTokens, p.current())
-			p.advance()
+	end := "/"
+	if assignment {
+		end = "/:"
+	}
+	var b strings.Builder
+	for {
+		part := word
+		if i := unescapedIndex(word, ':'); assignment && i >= 0 {
+			part = word[:i+1]
+		}
+		word = word[len(part):]
+
+		name, rest := part, ""
+		if i := strings.IndexAny(part, end); i >= 0 {
+			name, rest = part[:i], part[i:]
+		}
+		if strings.HasPrefix(name, "~") && !strings.Contains(name, "\\") {
+			if dir, ok := home(name[1:]); ok {
+				part = Quote(dir) + rest
+			}
+		}
+		b.WriteString(part)
+		if word == "" {
+			return b.String()
 		}
 	}
+}
 
-	if p.pos >= len(p.tokens) {
-		return nil, fmt.Errorf("expected 'fi' to close if statement")
+// ExpandBraces performs brace expansion on a word from the lexer: a{b,c}d
+// becomes abd and acd, and {1..5} and {a..e}, with an optional step as in
+// {0..10..2}, become the sequence. Expansions nest, and braces that hold
+// neither a comma nor a sequence, quoted braces and ${...} are left alone.
+func ExpandBraces(word string) []string {
+	return expandBraces(word, 0)
+}
+
+func expandBraces(word string, from int) []string {
+	open, close := braceSpan(word, from)
+	if open < 0 {
+		return []string{word}
 	}
-	p.advance() // skip 'fi'
 
-	condParser := &Parser{tokens: condTokens, pos: 0}
-	condCmds, err := condParser.parsePipeline()
-	if err != nil {
-		return nil, err
+	prefix, inner, suffix := word[:open], word[open+1:close], word[close+1:]
+	alternatives := splitAlternatives(inner)
+	if len(alternatives) < 2 {
+		var ok bool
+		if alternatives, ok = braceSequence(inner); !ok {
+			// Not an expansion; look for one further on.
+			return expandBraces(word, open+1)
+		}
 	}
-	thenParser := &Parser{tokens: thenTokens, pos: 0}
-	thenCmd, err := thenParser.Parse(strings.Join(tokensToStrings(thenTokens), " "))
-	if err != nil {
-		return nil, err
+
+	var words []string
+	for _, alternative := range alternatives {
+		words = append(words, expandBraces(prefix+alternative+suffix, len(prefix))...)
 	}
-	var thenCmdNode *ast.Command
-	if len(thenCmd) > 0 {
-		thenCmdNode = thenCmd[0]
+	return words
+}
+
+// braceSpan returns the positions of the first unescaped { at or after
+// from that is not part of ${...}, and of the } that closes it.
+func braceSpan(word string, from int) (int, int) {
+	open, depth := -1, 0
+	for i := from; i < len(word); i++ {
+		switch word[i] {
+		case '\\':
+			i++
+		case '$':
+			if i+1 < len(word) && word[i+1] == '{' {
+				end := strings.IndexByte(word[i:], '}')
+				if end < 0 {
+					return -1, -1
+				}
+				i += end
+			}
+		case '{':
+			if depth == 0 {
+				open = i
+			}
+			depth++
+		case '}':
+			if depth == 0 {
+				continue
+			}
+			depth--
+			if depth == 0 {
+				return open, i
+			}
+		}
 	}
+	return -1, -1
+}
 
-	var elseCmdNode *ast.Command
-	if len(elseTokens) > 0 {
-		elseParser := &Parser{tokens: elseTokens, pos: 0}
-		elseCmds, _ := elseParser.Parse(strings.Join(tokensToStrings(elseTokens), " "))
-		if len(elseCmds) > 0 {
-			elseCmdNode = elseCmds[0]
+// splitAlternatives splits the inside of braces at the commas that are
+// not escaped or inside nested braces.
+func splitAlternatives(inner string) []string {
+	var parts []string
+	start, depth := 0, 0
+	for i := 0; i < len(inner); i++ {
+		switch inner[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, inner[start:i])
+				start = i + 1
+			}
 		}
 	}
+	return append(parts, inner[start:])
+}
 
-	var elifTokens [][]Token
-	for p.pos < len(p.tokens) && p.current().Type == TokenWord && p.current().Value == "elif" {
-		p.advance() // skip 'elif'
-		condElif := []Token{}
-		for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && p.current().Value == "then") {
-			condElif = append(condElif, p.current())
-			p.advance()
+// braceSequence expands x..y or x..y..step, where x and y are both
+// integers or both single letters. Integers written with leading zeros
+// are padded to the same width.
+func braceSequence(inner string) ([]string, bool) {
+	fields := strings.Split(inner, "..")
+	if len(fields) != 2 && len(fields) != 3 {
+		return nil, false
+	}
+	step := 1
+	if len(fields) == 3 {
+		n, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, false
 		}
-		if p.pos >= len(p.tokens) {
-			return nil, fmt.Errorf("expected 'then' in elif")
+		step = max(n, -n, 1)
+	}
+
+	first, errFirst := strconv.Atoi(fields[0])
+	last, errLast := strconv.Atoi(fields[1])
+	letters := false
+	switch {
+	case errFirst == nil && errLast == nil:
+	case len(fields[0]) == 1 && len(fields[1]) == 1 && isLetter(fields[0][0]) && isLetter(fields[1][0]):
+		first, last, letters = int(fields[0][0]), int(fields[1][0]), true
+	default:
+		return nil, false
+	}
+
+	width := 0
+	for _, field := range fields[:2] {
+		if digits := strings.TrimPrefix(field, "-"); len(digits) > 1 && digits[0] == '0' {
+			width = max(len(fields[0]), len(fields[1]))
 		}
-		p.advance() // skip 'then'
-		bodyElif := []Token{}
-		for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && (p.current().Value == "elif" || p.current().Value == "else" || p.current().Value == "fi")) {
-			bodyElif = append(bodyElif, p.current())
-			p.advance()
+	}
+	if last < first {
+		step = -step
+	}
+
+	var words []string
+	for n := first; step > 0 && n <= last || step < 0 && n >= last; n += step {
+		switch {
+		case letters:
+			words = append(words, Quote(string(rune(n))))
+		case n < 0:
+			words = append(words, fmt.Sprintf("-%0*d", max(width-1, 0), -n))
+		default:
+			words = append(words, fmt.Sprintf("%0*d", width, n))
+		}
+	}
+	return words, true
+}
+
+func isLetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+func (p *Parser) parseIf() (*ast.Command, error) {
+	p.advance() // skip 'if' or 'elif'
+
+	cond, err := p.parseCompoundList("then")
+	if err != nil {
+		return nil, err
+	}
+	p.advance() // skip 'then'
+
+	thenCmd, err := p.parseCompoundList("elif", "else", "fi")
+	if err != nil {
+		return nil, err
+	}
+
+	var elseCmd *ast.Command
+	switch p.current().Value {
+	case "elif":
+		// elif is parsed as an if nested in the else branch; it consumes
+		// the closing fi.
+		if elseCmd, err = p.parseIf(); err != nil {
+			return nil, err
+		}
+	case "else":
+		p.advance()
+		if elseCmd, err = p.parseCompoundList("fi"); err != nil {
+			return nil, err
 		}
-		elifTokens = append(elifTokens, append(condElif, Token{Type: TokenSemicolon, Value: ";;"}))
-		elifTokens = append(elifTokens, bodyElif)
+		p.advance() // skip 'fi'
+	default:
+		p.advance() // skip 'fi'
 	}
 
 	return &ast.Command{
 		Type: ast.CommandIf,
 		If: &ast.IfCommand{
-			Condition: condCmds,
-			Then:      thenCmdNode,
-			Else:      elseCmdNode,
+			Condition: cond,
+			Then:      thenCmd,
+			Else:      elseCmd,
 		},
 	}, nil
 }
 
-func tokensToStrings(ts []Token) []string {
-	var s []string
-	for _, t := range ts {
-		s = append(s, t.Value)
-	}
-	return s
-}
-
 func (p *Parser) parseWhile() (*ast.Command, error) {
 	p.advance()
-	condTokens := []Token{}
-	for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && p.current().Value == "do") {
-		condTokens = append(condTokens, p.current())
-		p.advance()
-	}
-	if p.pos >= len(p.tokens) {
-		return nil, fmt.Errorf("expected 'do' in while")
-	}
-	p.advance()
 
-	bodyTokens := []Token{}
-	for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && p.current().Value == "done") {
-		bodyTokens = append(bodyTokens, p.current())
-		p.advance()
-	}
-	if p.pos >= len(p.tokens) {
-		return nil, fmt.Errorf("expected 'done' in while")
+	cond, err := p.parseCompoundList("do")
+	if err != nil {
+		return nil, err
 	}
-	p.advance()
+	p.advance() // skip 'do'
 
-	condParser := &Parser{tokens: condTokens, pos: 0}
-	condCmd, _ := condParser.parsePipeline()
-	bodyParser := &Parser{tokens: bodyTokens, pos: 0}
-	bodyCmds, _ := bodyParser.Parse(strings.Join(tokensToStrings(bodyTokens), " "))
-	var bodyCmd *ast.Command
-	if len(bodyCmds) > 0 {
-		bodyCmd = bodyCmds[0]
+	body, err := p.parseCompoundList("done")
+	if err != nil {
+		return nil, err
 	}
+	p.advance() // skip 'done'
+
 	return &ast.Command{
 		Type: ast.CommandWhile,
 		While: &ast.WhileCommand{
-			Condition: condCmd,
-			Body:      bodyCmd,
+			Condition: cond,
+			Body:      body,
 		},
 	}, nil
 }
 
 func (p *Parser) parseFor() (*ast.Command, error) {
 	p.advance()
+	if p.current().Type == TokenEOF {
+		return nil, ErrIncomplete
+	}
 	if p.current().Type != TokenWord {
 		return nil, fmt.Errorf("expected variable after for")
 	}
 	varName := p.current().Value
 	p.advance()
+	p.skipNewlines()
+	if p.current().Type == TokenEOF {
+		return nil, ErrIncomplete
+	}
 	if !(p.current().Type == TokenWord && p.current().Value == "in") {
 		return nil, fmt.Errorf("expected 'in' after for variable")
 	}
 	p.advance()
 
-	values := []string{}
-	for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && p.current().Value == "do") {
-		if p.current().Type == TokenWord {
-			values = append(values, p.current().Value)
-		}
+	values := []ast.Word{}
+	for p.current().Type == TokenWord {
+		values = append(values, ast.Word{Text: p.current().Value, Quoted: p.current().Quoted})
 		p.advance()
 	}
-	if p.pos >= len(p.tokens) {
-		return nil, fmt.Errorf("expected 'do' in for")
-	}
-	p.advance()
-
-	bodyTokens := []Token{}
-	for p.pos < len(p.tokens) && !(p.current().Type == TokenWord && p.current().Value == "done") {
-		bodyTokens = append(bodyTokens, p.current())
+	if p.current().Type == TokenSemicolon {
 		p.advance()
 	}
-	if p.pos >= len(p.tokens) {
-		return nil, fmt.Errorf("expected 'done' to close for")
+	p.skipNewlines()
+	if p.current().Type == TokenEOF {
+		return nil, ErrIncomplete
+	}
+	if !(p.current().Type == TokenWord && p.current().Value == "do") {
+		return nil, fmt.Errorf("expected 'do' in for")
 	}
 	p.advance()
 
-	bodyParser := &Parser{tokens: bodyTokens, pos: 0}
-	bodyCmds, _ := bodyParser.Parse(strings.Join(tokensToStrings(bodyTokens), " "))
-	var bodyCmd *ast.Command
-	if len(bodyCmds) > 0 {
-		bodyCmd = bodyCmds[0]
+	body, err := p.parseCompoundList("done")
+	if err != nil {
+		return nil, err
 	}
+	p.advance() // skip 'done'
 
 	return &ast.Command{
 		Type: ast.CommandFor,
 		For: &ast.ForCommand{
 			Variable: varName,
 			Values:   values,
-			Body:     bodyCmd,
+			Body:     body,
 		},
 	}, nil
 }
+
+// parseCompoundList parses the commands of a compound command body up to
+// one of the given reserved words, which is left as the current token.
+// Running out of input first yields ErrIncomplete.
+// parseConditional parses [[ expression ]]. The lexer splits &&, ||, <
+// and > into operator tokens, which are turned back into words here, and
+// keeps parentheses inside words, which are split off.
+func (p *Parser) parseConditional() (*ast.Command, error) {
+	p.advance() // skip '[['
+
+	var words []ast.Word
+	for {
+		tok := p.current()
+		switch tok.Type {
+		case TokenEOF:
+			return nil, ErrIncomplete
+		case TokenNewline:
+		case TokenAnd, TokenOr, TokenRedirectIn, TokenRedirectOut:
+			words = append(words, ast.Word{Text: tok.Value})
+		case TokenWord:
+			if n := len(words); n > 0 && !words[n-1].Quoted && words[n-1].Text == "=~" {
+				words = append(words, p.parseRegexWord())
+				continue
+			}
+			if tok.Value == "]]" && !tok.Quoted {
+				p.advance()
+				return &ast.Command{
+					Type:        ast.CommandConditional,
+					Conditional: &ast.ConditionalCommand{Words: words},
+				}, nil
+			}
+			words = append(words, splitParens(tok.Value, tok.Quoted)...)
+		default:
+			return nil, fmt.Errorf("syntax error near unexpected token `%s'", tok.Value)
+		}
+		p.advance()
+	}
+}
+
+// parseRegexWord parses the right side of =~. The lexer may have cut an
+// unquoted regex like ^(a|b)$ into several tokens, so all tokens that
+// follow each other without a space are joined. Their quoted parts are
+// already escaped to match literally.
+func (p *Parser) parseRegexWord() ast.Word {
+	var word ast.Word
+	for {
+		tok := p.current()
+		word.Text += tok.Value
+		word.Quoted = word.Quoted || tok.Quoted
+		joined := p.adjacent()
+		p.advance()
+		if !joined {
+			return word
+		}
+	}
+}
+
+// adjacent reports whether the token after the current one follows it
+// without a space and can continue a regex.
+func (p *Parser) adjacent() bool {
+	if p.pos+1 >= len(p.tokens) {
+		return false
+	}
+	next := p.tokens[p.pos+1]
+	if next.Pos != p.current().End || next.Type == TokenWord && !next.Quoted && next.Value == "]]" {
+		return false
+	}
+	switch next.Type {
+	case TokenWord, TokenPipe, TokenOr, TokenRedirectIn, TokenRedirectOut:
+		return true
+	}
+	return false
+}
+
+// splitParens splits leading "(" and trailing ")" off a word inside
+// [[ ]], so that ($a == x) groups like ( $a == x ). Quoted parentheses
+// are escaped and stay in the word.
+func splitParens(word string, quoted bool) []ast.Word {
+	var words []ast.Word
+	for len(word) > 1 && word[0] == '(' {
+		words = append(words, ast.Word{Text: "("})
+		word = word[1:]
+	}
+	closing := 0
+	for len(word) > 1 && word[len(word)-1] == ')' && word[len(word)-2] != '\\' && unescapedIndex(word, '(') < 0 {
+		closing++
+		word = word[:len(word)-1]
+	}
+	words = append(words, ast.Word{Text: word, Quoted: quoted})
+	for ; closing > 0; closing-- {
+		words = append(words, ast.Word{Text: ")"})
+	}
+	return words
+}
+
+// parseCase parses case word in [(]pattern[|pattern]...) list;; ... esac.
+// The ;; after the last clause may be left out, and the whole statement
+// may sit on one line.
+func (p *Parser) parseCase() (*ast.Command, error) {
+	p.advance()
+	if p.current().Type == TokenEOF {
+		return nil, ErrIncomplete
+	}
+	if p.current().Type != TokenWord {
+		return nil, fmt.Errorf("syntax error near unexpected token `%s'", p.current().Value)
+	}
+	caseCmd := &ast.CaseCommand{Word: p.current().Value}
+	p.advance()
+
+	p.skipNewlines()
+	if p.current().Type == TokenEOF {
+		return nil, ErrIncomplete
+	}
+	if !(p.current().Type == TokenWord && p.current().Value == "in") {
+		return nil, fmt.Errorf("syntax error near unexpected token `%s'", p.current().Value)
+	}
+	p.advance()
+
+	for {
+		p.skipNewlines()
+		tok := p.current()
+		if tok.Type == TokenEOF {
+			return nil, ErrIncomplete
+		}
+		if tok.Type == TokenWord && !tok.Quoted && tok.Value == "esac" {
+			p.advance()
+			break
+		}
+
+		patterns, err := p.parseCasePatterns()
+		if err != nil {
+			return nil, err
+		}
+		body, err := p.parseCompoundList(";;", "esac")
+		if err != nil {
+			return nil, err
+		}
+		if p.current().Type == TokenCaseBreak {
+			p.advance()
+		}
+
+		caseCmd.Cases = append(caseCmd.Cases, &ast.CaseItem{Patterns: patterns, Command: body})
+	}
+
+	return &ast.Command{Type: ast.CommandCase, Case: caseCmd}, nil
+}
+
+// parseCasePatterns parses the patterns of a case clause up to and
+// including the closing parenthesis. The lexer keeps parentheses inside
+// words, so a pattern token may carry a leading "(" or a trailing ")"
+// followed by the start of the clause body.
+func (p *Parser) parseCasePatterns() ([]string, error) {
+	var patterns []string
+	first := true
+
+	for {
+		tok := p.current()
+		if tok.Type == TokenEOF {
+			return nil, ErrIncomplete
+		}
+		if tok.Type != TokenWord {
+			return nil, fmt.Errorf("syntax error near unexpected token `%s'", tok.Value)
+		}
+
+		value := tok.Value
+		if first && strings.HasPrefix(value, "(") {
+			value = value[1:]
+		}
+		first = false
+
+		if close := unescapedIndex(value, ')'); close >= 0 {
+			if close > 0 {
+				patterns = append(patterns, value[:close])
+			}
+			if rest := value[close+1:]; rest != "" {
+				p.tokens[p.pos].Value = rest
+			} else {
+				p.advance()
+			}
+			if len(patterns) == 0 {
+				return nil, fmt.Errorf("syntax error near unexpected token `)'")
+			}
+			return patterns, nil
+		}
+
+		if value != "" {
+			patterns = append(patterns, value)
+		}
+		p.advance()
+
+		if p.current().Type == TokenPipe {
+			p.advance()
+		}
+	}
+}
+
+func (p *Parser) parseCompoundList(terminators ...string) (*ast.Command, error) {
+	cmds, err := p.parseCompoundCommands(terminators...)
+	if err != nil {
+		return nil, err
+	}
+	return commandList(cmds), nil
+}
+
+func (p *Parser) parseCompoundCommands(terminators ...string) ([]*ast.Command, error) {
+	var cmds []*ast.Command
+
+	for {
+		tok := p.current()
+		switch {
+		case tok.Type == TokenEOF:
+			return nil, ErrIncomplete
+		case tok.Type == TokenNewline || tok.Type == TokenSemicolon:
+			p.advance()
+			continue
+		case tok.Type == TokenWord && !tok.Quoted && isOneOf(tok.Value, terminators):
+			return cmds, nil
+		case tok.Type == TokenCaseBreak && isOneOf(tok.Value, terminators):
+			return cmds, nil
+		}
+
+		cmd, err := p.parseCommand()
+		if err != nil {
+			return nil, err
+		}
+		if cmd == nil {
+			return nil, fmt.Errorf("syntax error near unexpected token `%s'", tok.Value)
+		}
+		if p.current().Type == TokenBackground {
+			cmd = p.background(cmd, tok.Pos)
+		}
+		cmds = append(cmds, cmd)
+	}
+}
+
+// background wraps cmd, which starts at start and ends at the current &
+// token, to run in the background, and skips the &.
+func (p *Parser) background(cmd *ast.Command, start int) *ast.Command {
+	cmd.Text = strings.TrimSpace(p.lexer.input[start:p.current().Pos])
+	p.advance()
+
+	return &ast.Command{
+		Type:       ast.CommandBackground,
+		Background: &ast.BackgroundCommand{Command: cmd},
+	}
+}
+
+func commandList(cmds []*ast.Command) *ast.Command {
+	switch len(cmds) {
+	case 0:
+		return nil
+	case 1:
+		return cmds[0]
+	}
+
+	ops := make([]string, len(cmds)-1)
+	for i := range ops {
+		ops[i] = ";"
+	}
+	return &ast.Command{Type: ast.CommandList, List: &ast.List{Commands: cmds, Operators: ops}}
+}
+
+func (p *Parser) skipNewlines() {
+	for p.current().Type == TokenNewline {
+		p.advance()
+	}
+}
+
+func isOneOf(word string, words []string) bool {
+	for _, w := range words {
+		if word == w {
+			return true
+		}
+	}
+	return false
+}
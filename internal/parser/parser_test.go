@@ -0,0 +1,333 @@
+package parser
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gosh/internal/ast"
+)
+
+// vars returns a lookup of the given variables for expansion.
+func vars(values map[string]string) func(string) string {
+	return func(name string) string { return values[name] }
+}
+
+func TestArrayElements(t *testing.T) {
+	getVar := vars(map[string]string{"x": "X"})
+	tests := []struct {
+		literal string
+		want    []string
+	}{
+		{`a b c`, []string{"a", "b", "c"}},
+		{`"a b" c`, []string{"a b", "c"}},
+		{`"b\"c"`, []string{`b"c`}},
+		{`"d\\e"`, []string{`d\e`}},
+		{`"\$x" "$x"`, []string{"$x", "X"}},
+		{`'$x' 'a"b'`, []string{"$x", `a"b`}},
+		{`g\ h i`, []string{"g h", "i"}},
+		{`[0]="a" [1]="b\"c"`, []string{"[0]=a", `[1]=b"c`}},
+	}
+	for _, tt := range tests {
+		if got := ArrayElements(tt.literal, getVar); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ArrayElements(%q) = %q, want %q", tt.literal, got, tt.want)
+		}
+	}
+}
+
+func TestArrayLiteralEnd(t *testing.T) {
+	tests := []struct {
+		input string
+		want  int
+	}{
+		{`(a b)`, 4},
+		{`("a)" b)`, 7},
+		{`('a)' b)`, 7},
+		{`("b\"c")`, 7},
+		{`(a\) b)`, 6},
+		{`("b\")`, -1},
+		{`(a`, -1},
+	}
+	for _, tt := range tests {
+		if got := arrayLiteralEnd(tt.input, 0); got != tt.want {
+			t.Errorf("arrayLiteralEnd(%q) = %d, want %d", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestMatchingParen(t *testing.T) {
+	tests := []struct {
+		input string
+		open  int
+		want  int
+	}{
+		{`(a)`, 0, 2},
+		{`((1+2))`, 0, 6},
+		{`((1+2))`, 1, 5},
+		{`$(echo ")")`, 1, 10},
+		{`$(echo ')')`, 1, 10},
+		{`$(echo "\")")`, 1, 12},
+		{`$(echo \))`, 1, 9},
+		{`(echo "a`, 0, -1},
+		{`(echo 'a`, 0, -1},
+		{`(a`, 0, -1},
+	}
+	for _, tt := range tests {
+		if got := MatchingParen(tt.input, tt.open); got != tt.want {
+			t.Errorf("MatchingParen(%q, %d) = %d, want %d", tt.input, tt.open, got, tt.want)
+		}
+	}
+}
+
+func TestExpandVariables(t *testing.T) {
+	getVar := vars(map[string]string{
+		"x":         "3",
+		"(1+2)":     "3",
+		"( 3 + 1 )": "4",
+		"((1+2)*3)": "9",
+		"(x*2)":     "6",
+		"(2*(1+2))": "6",
+		"(4 > 3)":   "1",
+		"y:=3":      "3",
+		"y=3":       "3",
+	})
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"$x", "3"},
+		{"${x}y", "3y"},
+		{"$unset", "$unset"},
+		{"$((1+2))", "3"},
+		{"a$((1+2))b", "a3b"},
+		{"$(( $x + 1 ))", "4"},
+		{"$(((1+2)*3))", "9"},
+		{"$((x*2))$((2*(1+2)))", "66"},
+		{"$((4 > 3))", "1"},
+		{"$((1/0))", "$((1/0))"},
+		{"$((a) (b))", "$((a) (b))"},
+		{"$((1+2)", "$((1+2)"},
+		{"${y:=3}", "3"},
+		{"${y:=$x}", "3"},
+		{"${y=$((1+2))}", "3"},
+	}
+	for _, tt := range tests {
+		if got := ExpandVariables(tt.text, getVar); got != tt.want {
+			t.Errorf("ExpandVariables(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func BenchmarkExpandVariables(b *testing.B) {
+	getVar := vars(map[string]string{"i": "42", "name": "gosh", "(i+1)": "43"})
+	benchmarks := []struct {
+		name string
+		text string
+	}{
+		{"plain", "hello"},
+		{"parameter", "$name"},
+		{"braces", "${name}-$i"},
+		{"arithmetic", "$((i+1))"},
+		{"mixed", "loop $i of ${name}: $((i+1))"},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				ExpandVariables(bm.text, getVar)
+			}
+		})
+	}
+}
+
+func TestParseCase(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  [][]string // the patterns of each clause
+	}{
+		{"one line", "case x in y) echo y;; x) echo x;; esac", [][]string{{"y"}, {"x"}}},
+		{"leading paren", "case x in (x) echo p;; esac", [][]string{{"x"}}},
+		{"leading paren with alternatives", "case x in (a*|b) echo g;; *) echo n; esac", [][]string{{"a*", "b"}, {"*"}}},
+		{"no final ;;", "case x in x) echo last; esac", [][]string{{"x"}}},
+		{"no final ;; before a newline", "case x in\n  x) echo last\nesac", [][]string{{"x"}}},
+		{"esac after ;;", "case x in x) echo a;;esac", [][]string{{"x"}}},
+		{"no clauses", "case x in esac", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := New().Parse(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(commands) != 1 || commands[0].Case == nil {
+				t.Fatalf("Parse(%q) did not give one case command", tt.input)
+			}
+			var got [][]string
+			for _, item := range commands[0].Case.Cases {
+				got = append(got, item.Patterns)
+				if item.Command == nil {
+					t.Errorf("the clause %q has no command", item.Patterns)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("patterns = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePipeline(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []ast.CommandType // the type of each stage, nil for an error
+	}{
+		{"a | b | c", []ast.CommandType{ast.CommandSimple, ast.CommandSimple, ast.CommandSimple}},
+		{"printf x | while read l; do echo $l; done", []ast.CommandType{ast.CommandSimple, ast.CommandWhile}},
+		{"{ echo a; echo b; } | wc -l", []ast.CommandType{ast.CommandGroup, ast.CommandSimple}},
+		{"if true; then echo a; fi | cat", []ast.CommandType{ast.CommandIf, ast.CommandSimple}},
+		{"for i in 1 2; do echo $i; done | cat", []ast.CommandType{ast.CommandFor, ast.CommandSimple}},
+		{"echo a |\n cat", []ast.CommandType{ast.CommandSimple, ast.CommandSimple}},
+		{"| wc -l", nil},
+		{"echo a | | wc -l", nil},
+		{"echo a | ;", nil},
+	}
+	for _, tt := range tests {
+		commands, err := New().Parse(tt.input)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("Parse(%q) succeeded, want a syntax error", tt.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.input, err)
+			continue
+		}
+		if len(commands) != 1 {
+			t.Errorf("Parse(%q) gave %d commands, want 1", tt.input, len(commands))
+			continue
+		}
+		var got []ast.CommandType
+		for cmd := commands[0]; ; cmd = cmd.Pipeline.Left {
+			if cmd.Type != ast.CommandPipeline {
+				got = append([]ast.CommandType{cmd.Type}, got...)
+				break
+			}
+			got = append([]ast.CommandType{cmd.Pipeline.Right.Type}, got...)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Parse(%q) stages = %v, want %v", tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestParseUnterminated(t *testing.T) {
+	tests := []struct {
+		input string
+		quote byte // 0 if the input is complete or not in quotes
+		err   error
+	}{
+		{`echo "hello`, '"', ErrIncomplete},
+		{`echo 'hello`, '\'', ErrIncomplete},
+		{`echo $'hello`, '\'', ErrIncomplete},
+		{`echo "a\"`, '"', ErrIncomplete},
+		{`echo "a'b`, '"', ErrIncomplete},
+		{`echo 'a"b`, '\'', ErrIncomplete},
+		{"echo \"a\nb", '"', ErrIncomplete},
+		{`echo "a" 'b'`, 0, nil},
+		{`echo \`, 0, ErrIncomplete},
+		{"if true; then", 0, ErrIncomplete},
+	}
+	for _, tt := range tests {
+		_, err := New().Parse(tt.input)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.input, err, tt.err)
+			continue
+		}
+		var unmatched *UnmatchedError
+		switch {
+		case errors.As(err, &unmatched) && unmatched.Quote != tt.quote:
+			t.Errorf("Parse(%q) looks for %c, want %c", tt.input, unmatched.Quote, tt.quote)
+		case unmatched == nil && tt.quote != 0:
+			t.Errorf("Parse(%q) = %v, want an unmatched %c", tt.input, err, tt.quote)
+		}
+	}
+}
+
+func TestHereDocStripTabs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"tabs", "cat <<-EOF\n\t\tone\n\ttwo\n\tEOF\n", "one\ntwo\n"},
+		{"spaces stay", "cat <<-EOF\n  one\n\tEOF\n", "  one\n"},
+		{"tabs after spaces stay", "cat <<-EOF\n  \ttwo\n\t  three\nEOF\n", "  \ttwo\n  three\n"},
+		{"inner and trailing tabs stay", "cat <<-EOF\na\tb\t\nEOF\n", "a\tb\t\n"},
+		{"delimiter with spaces is not one", "cat <<-EOF\n  EOF\n\tEOF\n", "  EOF\n"},
+		{"plain << keeps tabs", "cat <<EOF\n\tone\nEOF\n", "\tone\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			commands, err := New().Parse(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(commands) != 1 || commands[0].Simple == nil || len(commands[0].Simple.Redirects) != 1 {
+				t.Fatalf("Parse(%q) did not give one command with a here-document", tt.input)
+			}
+			if got := commands[0].Simple.Redirects[0].HereDoc; got != tt.want {
+				t.Errorf("here-document = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		input  string
+		values []string
+		types  []TokenType
+	}{
+		{"ls -l", []string{"ls", "-l", ""}, []TokenType{TokenWord, TokenWord, TokenEOF}},
+		{"a|b && c", []string{"a", "|", "b", "&&", "c", ""}, []TokenType{TokenWord, TokenPipe, TokenWord, TokenAnd, TokenWord, TokenEOF}},
+		{`echo 'a b' "c d"`, []string{"echo", "a b", "c d", ""}, []TokenType{TokenWord, TokenWord, TokenWord, TokenEOF}},
+		{"echo $((1 + 2))", []string{"echo", "$((1 + 2))", ""}, []TokenType{TokenWord, TokenWord, TokenEOF}},
+		{"x=1; y", []string{"x=1", ";", "y", ""}, []TokenType{TokenWord, TokenSemicolon, TokenWord, TokenEOF}},
+		{"echo a#b", []string{"echo", "a#b", ""}, []TokenType{TokenWord, TokenWord, TokenEOF}},
+		{"echo a #b c", []string{"echo", "a", ""}, []TokenType{TokenWord, TokenWord, TokenEOF}},
+		{"echo a;#b", []string{"echo", "a", ";", ""}, []TokenType{TokenWord, TokenWord, TokenSemicolon, TokenEOF}},
+		{`echo "a #b" 'c #d'`, []string{"echo", `a \#b`, `c \#d`, ""}, []TokenType{TokenWord, TokenWord, TokenWord, TokenEOF}},
+		{"echo $# ${#x}", []string{"echo", "$#", "${#x}", ""}, []TokenType{TokenWord, TokenWord, TokenWord, TokenEOF}},
+		{"# only\necho", []string{"\n", "echo", ""}, []TokenType{TokenNewline, TokenWord, TokenEOF}},
+	}
+	for _, tt := range tests {
+		var values []string
+		var types []TokenType
+		for _, tok := range NewLexer(tt.input).Tokenize() {
+			values = append(values, tok.Value)
+			types = append(types, tok.Type)
+		}
+		if !reflect.DeepEqual(values, tt.values) || !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("Tokenize(%q) = %q %v, want %q %v", tt.input, values, types, tt.values, tt.types)
+		}
+	}
+}
+
+// largeScript returns a script of about size bytes mixing the kinds of
+// words the lexer reads.
+func largeScript(size int) string {
+	const chunk = "for f in *.go; do\n\techo \"file: $f\" 'as is' >> out.log 2>&1\n\tx=$((x + 1)) && ls -la | grep \"${f%.go}\"\ndone\n"
+	return strings.Repeat(chunk, size/len(chunk)+1)
+}
+
+func BenchmarkTokenize(b *testing.B) {
+	script := largeScript(1 << 20)
+	b.SetBytes(int64(len(script)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		NewLexer(script).Tokenize()
+	}
+}
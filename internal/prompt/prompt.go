@@ -5,14 +5,23 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"regexp"
 	"strings"
 	"time"
 
+	"gosh/internal/strftime"
 	"gosh/internal/variables"
 )
 
+// dateEscape matches \D{format}, which expands to the time formatted by
+// strftime.
+var dateEscape = regexp.MustCompile(`\\D\{([^}]*)\}`)
+
 type Manager struct {
 	variables *variables.Manager
+
+	// duration is how long the last command line took to run.
+	duration time.Duration
 }
 
 func New(vars *variables.Manager) *Manager {
@@ -30,6 +39,20 @@ func (m *Manager) Generate(exitCode int) string {
 	return m.expandPrompt(ps1, exitCode)
 }
 
+// GenerateRight returns the expanded RPROMPT, or RPS1 if that is unset,
+// to be shown at the right edge of the prompt line.
+func (m *Manager) GenerateRight(exitCode int) string {
+	rprompt := m.variables.Get("RPROMPT")
+	if rprompt == "" {
+		rprompt = m.variables.Get("RPS1")
+	}
+	if rprompt == "" {
+		return ""
+	}
+
+	return m.expandPrompt(rprompt, exitCode)
+}
+
 func (m *Manager) GeneratePS2() string {
 	ps2 := m.variables.Get("PS2")
 	if ps2 == "" {
@@ -45,12 +68,21 @@ func (m *Manager) expandPrompt(prompt string, exitCode int) string {
 	currentUser, _ := user.Current()
 	hostname, _ := os.Hostname()
 	pwd, _ := os.Getwd()
-	home := os.Getenv("HOME")
+	home := m.variables.Get("HOME")
 
+	cwd := pwd
 	if strings.HasPrefix(pwd, home) {
 		pwd = "~" + pwd[len(home):]
 	}
 
+	result = dateEscape.ReplaceAllStringFunc(result, func(escape string) string {
+		format := dateEscape.FindStringSubmatch(escape)[1]
+		if format == "" {
+			format = "%X"
+		}
+		return strftime.Format(format, time.Now())
+	})
+
 	replacements := map[string]string{
 		"\\u": currentUser.Username,
 		"\\h": hostname,
@@ -75,6 +107,8 @@ func (m *Manager) expandPrompt(prompt string, exitCode int) string {
 		"\\j":  fmt.Sprintf("%d", m.getJobsCount()),
 		"\\l":  m.getTTY(),
 		"\\s":  "gosh",
+		"\\g":  gitBranch(cwd),
+		"\\L":  FormatDuration(m.duration),
 		"\\v":  "1.0.4",
 		"\\V":  "1.0.4",
 		"\\\\": "\\",
@@ -93,6 +127,55 @@ func (m *Manager) expandPrompt(prompt string, exitCode int) string {
 	return result
 }
 
+// SetDuration records how long the last command line took, for \\L.
+func (m *Manager) SetDuration(d time.Duration) {
+	m.duration = d
+}
+
+// FormatDuration rounds d to a precision that suits its size, keeping
+// milliseconds only under a second.
+func FormatDuration(d time.Duration) string {
+	switch {
+	case d < time.Second:
+		return d.Round(time.Millisecond).String()
+	case d < time.Minute:
+		return d.Round(100 * time.Millisecond).String()
+	}
+	return d.Round(time.Second).String()
+}
+
+// gitBranch returns the branch checked out in the git work tree holding
+// dir, the abbreviated commit if HEAD is detached, or "" outside a work
+// tree.
+func gitBranch(dir string) string {
+	for {
+		gitDir := filepath.Join(dir, ".git")
+		if data, err := os.ReadFile(gitDir); err == nil {
+			// A linked work tree or submodule points to its git dir.
+			gitDir = strings.TrimSpace(strings.TrimPrefix(string(data), "gitdir:"))
+			if !filepath.IsAbs(gitDir) {
+				gitDir = filepath.Join(dir, gitDir)
+			}
+		}
+		if head, err := os.ReadFile(filepath.Join(gitDir, "HEAD")); err == nil {
+			ref := strings.TrimSpace(string(head))
+			if branch, ok := strings.CutPrefix(ref, "ref: refs/heads/"); ok {
+				return branch
+			}
+			if len(ref) > 7 {
+				ref = ref[:7]
+			}
+			return ref
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
 func (m *Manager) expandColors(prompt string) string {
 	colorMap := map[string]string{
 		"\\[\\033[0m\\]":  "\033[0m",  // reset
@@ -5,11 +5,17 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"os/signal"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"unicode"
 	"unicode/utf8"
 
 	"gosh/internal/history"
 
+	"golang.org/x/sys/unix"
 	"golang.org/x/term"
 )
 
@@ -17,27 +23,81 @@ type Manager struct {
 	history *history.Manager
 	scanner *bufio.Scanner
 	rawMode bool
+
+	// out receives the prompt and everything drawn while editing. It is
+	// stderr, as in other shells, so that it stays out of captured
+	// output.
+	out io.Writer
+
+	// plain is set when stdin is not a terminal: lines are then read as
+	// they come, with no prompt and no editing.
+	plain bool
+
+	// killRing holds the text removed by the kill keys, most recent
+	// last, for Ctrl-Y to yank back. It outlives a single ReadLine.
+	killRing []string
+
+	// viMode selects vi-style editing over the default emacs style.
+	viMode bool
+
+	// rightPrompt is drawn flush right on the prompt's row while the
+	// line leaves room for it.
+	rightPrompt string
+
+	// commands returns the command names starting with a prefix, for
+	// completing the first word of a line.
+	commands func(prefix string) []string
+
+	// specs are the completion specs registered by complete, by
+	// command name, and function runs the function of a -F spec.
+	specs    map[string]*CompletionSpec
+	function func(name string, words []string) []string
 }
 
+// CompletionSpec says how to complete the arguments of a command.
+type CompletionSpec struct {
+	Words    []string // -W: these words
+	Files    bool     // -f: file names
+	Dirs     bool     // -d: directory names
+	Function string   // -F: the words the function leaves in COMPREPLY
+}
+
+// maxKills is how many kills the kill ring remembers.
+const maxKills = 16
+
 func New(hist *history.Manager) *Manager {
 	return &Manager{
 		history: hist,
 		scanner: bufio.NewScanner(os.Stdin),
+		out:     os.Stderr,
 	}
 }
 
+// readPlain reads a line from stdin without editing it.
+func (m *Manager) readPlain() (string, error) {
+	if !m.scanner.Scan() {
+		if err := m.scanner.Err(); err != nil {
+			return "", err
+		}
+		return "", io.EOF
+	}
+	return m.scanner.Text(), nil
+}
+
+// SetTerminal says whether stdin is a terminal. If it is not, ReadLine
+// neither prompts nor edits.
+func (m *Manager) SetTerminal(terminal bool) {
+	m.plain = !terminal
+}
+
 func (m *Manager) ReadLine(prompt string) (string, error) {
+	if m.plain {
+		return m.readPlain()
+	}
 	state, err := makeRaw(int(os.Stdin.Fd()))
 	if err != nil {
-		fmt.Print(prompt)
-		if !m.scanner.Scan() {
-			if err := m.scanner.Err(); err != nil {
-				return "", err
-			}
-			return "", fmt.Errorf("EOF")
-		}
-		line := m.scanner.Text()
-		return line, nil
+		m.WriteString(prompt)
+		return m.readPlain()
 	}
 	defer restore(int(os.Stdin.Fd()), state)
 
@@ -48,96 +108,299 @@ func (m *Manager) ReadLine(prompt string) (string, error) {
 	histIdx := m.history.Size()
 	pending := make([]byte, 0, 4)
 
+	// A line longer than the terminal is wide wraps onto further rows,
+	// so show moves back up to the row the prompt is on before redrawing
+	// everything below it. cursorCol is where the cursor was left,
+	// counted in columns from the start of the prompt.
+	promptWidth := visibleWidth(prompt)
+	cursorCol := promptWidth
 	show := func() {
-		m.WriteString("\r\033[K") // CR + clear line
+		width, _ := m.GetTerminalSize()
+		if up := cursorCol / width; up > 0 {
+			m.WriteString(fmt.Sprintf("\033[%dA", up))
+		}
+		m.WriteString("\r\033[J") // CR + clear to the end of the screen
 		m.WriteString(prompt)
-		m.WriteString(string(buf))
-		right := len(buf) - cur
-		if right > 0 {
-			m.WriteString(fmt.Sprintf("\033[%dD", right))
+		m.WriteString(displayString(buf))
+
+		end := promptWidth + visibleWidth(displayString(buf))
+		if rightWidth := visibleWidth(m.rightPrompt); m.rightPrompt != "" && end+1+rightWidth <= width {
+			m.WriteString(fmt.Sprintf("\033[%dG", width-rightWidth+1))
+			m.WriteString(m.rightPrompt)
+		}
+		cursorCol = promptWidth + visibleWidth(displayString(buf[:cur]))
+		if end%width == 0 && end > 0 {
+			// The terminal keeps the cursor on a full row until more is
+			// written, so move it to the next row by hand.
+			m.WriteString("\r\n")
+		}
+		if up := end/width - cursorCol/width; up > 0 {
+			m.WriteString(fmt.Sprintf("\033[%dA", up))
+		}
+		m.WriteString("\r")
+		if col := cursorCol % width; col > 0 {
+			m.WriteString(fmt.Sprintf("\033[%dC", col))
 		}
 	}
 
-	for {
-		var b [1]byte
-		_, err := os.Stdin.Read(b[:])
-		if err != nil {
-			return "", err
+	// A resized window is redrawn at once, between keys; mu keeps the
+	// redraw from running while a key is being handled.
+	var mu sync.Mutex
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	done := make(chan struct{})
+	defer func() {
+		signal.Stop(winch)
+		mu.Lock()
+		close(done)
+		mu.Unlock()
+	}()
+	go func() {
+		for {
+			select {
+			case <-winch:
+				mu.Lock()
+				select {
+				case <-done:
+				default:
+					show()
+				}
+				mu.Unlock()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	prevHistory := func() {
+		if histIdx > 0 {
+			histIdx--
+			buf = []rune(m.history.Get(histIdx))
+			cur = len(buf)
+			show()
+		}
+	}
+	nextHistory := func() {
+		if histIdx < m.history.Size()-1 {
+			histIdx++
+			buf = []rune(m.history.Get(histIdx))
+		} else {
+			histIdx = m.history.Size()
+			buf = nil
+		}
+		cur = len(buf)
+		show()
+	}
+
+	// In vi mode the line starts in insert mode, and Escape switches to
+	// command mode, where keys move and edit instead of being inserted.
+	// operator is a command such as d waiting for its motion.
+	insert := true
+	var operator byte
+	viCommand := func(c byte) {
+		last := max(len(buf)-1, 0)
+		if operator == 'd' {
+			operator = 0
+			start, end := cur, cur
+			switch c {
+			case 'd':
+				start, end = 0, len(buf)
+			case 'w':
+				end = wordEnd(buf, cur)
+				for end < len(buf) && unicode.IsSpace(buf[end]) {
+					end++
+				}
+			case 'b':
+				start = wordStart(buf, cur)
+			case '$':
+				end = len(buf)
+			case '0':
+				start = 0
+			}
+			m.kill(buf[start:end])
+			buf = append(buf[:start], buf[end:]...)
+			cur = min(start, max(len(buf)-1, 0))
+			show()
+			return
+		}
+
+		switch c {
+		case 'h':
+			cur = max(cur-1, 0)
+		case 'l':
+			cur = min(cur+1, last)
+		case 'w':
+			cur = min(wordEnd(buf, cur), last)
+			for cur < last && unicode.IsSpace(buf[cur]) {
+				cur++
+			}
+		case 'b':
+			cur = wordStart(buf, cur)
+		case '0':
+			cur = 0
+		case '$':
+			cur = last
+		case 'x':
+			if cur < len(buf) {
+				m.kill(buf[cur : cur+1])
+				buf = append(buf[:cur], buf[cur+1:]...)
+				cur = min(cur, max(len(buf)-1, 0))
+			}
+		case 'd':
+			operator = 'd'
+			return
+		case 'p':
+			if len(m.killRing) > 0 {
+				text := []rune(m.killRing[len(m.killRing)-1])
+				at := min(cur+1, len(buf))
+				buf = append(buf[:at], append(text, buf[at:]...)...)
+				cur = at + len(text) - 1
+			}
+		case 'i':
+			insert = true
+		case 'a':
+			insert = true
+			cur = min(cur+1, len(buf))
+		case 'I':
+			insert = true
+			cur = 0
+		case 'A':
+			insert = true
+			cur = len(buf)
+		case 'k':
+			prevHistory()
+			cur = max(len(buf)-1, 0)
+		case 'j':
+			nextHistory()
+			cur = max(len(buf)-1, 0)
 		}
-		byteVal := b[0]
+		show()
+	}
 
+	// key handles one byte of input, and returns the line once it is
+	// complete.
+	key := func(byteVal byte) (string, bool, error) {
+		if len(pending) > 0 && !isContinuation(byteVal) {
+			// The partial character can never be completed, so a
+			// backspace typed in the middle of one only drops it.
+			pending = pending[:0]
+		}
+		if m.viMode && !insert && byteVal >= 32 && byteVal != 127 {
+			viCommand(byteVal)
+			return "", false, nil
+		}
 		if len(pending) == 0 && (byteVal < 32 || byteVal == 127) {
 			switch byteVal {
 			case '\r', '\n':
+				cur = len(buf)
+				show()
 				m.WriteString("\r\n")
-				line := string(buf)
-				if line != "" {
-					m.history.Add(line)
-				}
-				return line, nil
+				return string(buf), true, nil
 			case 127, 8:
-				if len(buf) > 0 {
-					if cur > 0 {
-						buf = append(buf[:cur-1], buf[cur:]...)
-						cur--
+				if cur > 0 {
+					buf = append(buf[:cur-1], buf[cur:]...)
+					cur--
+					show()
+				}
+			case 11: // Ctrl-K: kill to the end of the line
+				m.kill(buf[cur:])
+				buf = buf[:cur]
+				show()
+			case 21: // Ctrl-U: kill to the start of the line
+				m.kill(buf[:cur])
+				buf = append([]rune(nil), buf[cur:]...)
+				cur = 0
+				show()
+			case 23: // Ctrl-W: kill the word before the cursor
+				start := wordStart(buf, cur)
+				m.kill(buf[start:cur])
+				buf = append(buf[:start], buf[cur:]...)
+				cur = start
+				show()
+			case '\t': // Tab: complete the word before the cursor
+				line, pos, list := m.completeWord(buf, cur)
+				switch {
+				case line == nil:
+					m.WriteString("\a")
+				case list != nil:
+					// Below the line, which is drawn again after them.
+					m.WriteString("\r\n" + strings.Join(list, "  ") + "\r\n")
+					cursorCol = 0
+				default:
+					buf, cur = line, pos
+				}
+				show()
+			case 25: // Ctrl-Y: yank the last kill
+				if len(m.killRing) > 0 {
+					text := []rune(m.killRing[len(m.killRing)-1])
+					buf = append(buf[:cur], append(text, buf[cur:]...)...)
+					cur += len(text)
+					show()
+				}
+			case 27:
+				if m.viMode && !inputPending() {
+					// A lone Escape, not the start of an arrow key.
+					if insert {
+						insert = false
+						cur = max(cur-1, 0)
 						show()
 					}
+					operator = 0
+					break
 				}
-				continue
-			case 27:
-				var seq [2]byte
-				if _, err := os.Stdin.Read(seq[:]); err == nil && seq[0] == '[' {
-					switch seq[1] {
+				var next [1]byte
+				if _, err := os.Stdin.Read(next[:]); err != nil {
+					break
+				}
+				switch next[0] {
+				case 'b': // Alt-b: back to the start of the word
+					cur = wordStart(buf, cur)
+					show()
+				case 'f': // Alt-f: forward to the end of the word
+					cur = wordEnd(buf, cur)
+					show()
+				case 'd': // Alt-d: kill the word after the cursor
+					end := wordEnd(buf, cur)
+					m.kill(buf[cur:end])
+					buf = append(buf[:cur], buf[end:]...)
+					show()
+				case '[':
+					if _, err := os.Stdin.Read(next[:]); err != nil {
+						break
+					}
+					switch next[0] {
 					case 'A':
-						if histIdx > 0 {
-							histIdx--
-							buf = []rune(m.history.Get(histIdx))
-							show()
-						}
+						prevHistory()
 					case 'B':
-						if histIdx < m.history.Size()-1 {
-							histIdx++
-							buf = []rune(m.history.Get(histIdx))
-						} else {
-							histIdx = m.history.Size()
-							buf = nil
-						}
-						show()
+						nextHistory()
 					case 'C': // Right
 						if cur < len(buf) {
 							cur++
-							m.WriteString("\033[1C")
+							show()
 						}
 					case 'D': // Left
 						if cur > 0 {
 							cur--
-							m.WriteString("\033[1D")
+							show()
 						}
 					}
 				}
-				continue
 			case 3:
 				m.WriteString("^C\r\n")
-				return "", fmt.Errorf("interrupt")
+				return "", true, fmt.Errorf("interrupt")
 			case 4:
 				if len(buf) == 0 {
 					m.WriteString("\r\n")
-					return "", io.EOF
+					return "", true, io.EOF
 				}
-				continue
 			}
-			continue
+			return "", false, nil
 		}
+
 		pending = append(pending, byteVal)
 		if r, size := utf8.DecodeRune(pending); r != utf8.RuneError {
 			if size == len(pending) {
-				if cur == len(buf) {
-					buf = append(buf, r)
-					m.WriteString(string(pending))
-				} else {
-					// insert in middle
-					buf = append(buf[:cur], append([]rune{r}, buf[cur:]...)...)
-				}
+				buf = append(buf[:cur], append([]rune{r}, buf[cur:]...)...)
 				cur++
 				show()
 				pending = pending[:0]
@@ -145,11 +408,162 @@ func (m *Manager) ReadLine(prompt string) (string, error) {
 		} else if len(pending) >= 4 {
 			pending = pending[:0]
 		}
+		return "", false, nil
+	}
+
+	for {
+		var b [1]byte
+		_, err := os.Stdin.Read(b[:])
+		if err != nil {
+			return "", err
+		}
+
+		mu.Lock()
+		line, complete, err := key(b[0])
+		mu.Unlock()
+		if complete {
+			return line, err
+		}
+	}
+}
+
+// kill adds text to the kill ring, unless it is empty.
+func (m *Manager) kill(text []rune) {
+	if len(text) == 0 {
+		return
+	}
+	m.killRing = append(m.killRing, string(text))
+	if len(m.killRing) > maxKills {
+		m.killRing = m.killRing[1:]
+	}
+}
+
+// wordStart returns where the whitespace-delimited word before cur
+// begins, skipping any spaces just before cur.
+func wordStart(buf []rune, cur int) int {
+	for cur > 0 && unicode.IsSpace(buf[cur-1]) {
+		cur--
+	}
+	for cur > 0 && !unicode.IsSpace(buf[cur-1]) {
+		cur--
+	}
+	return cur
+}
+
+// wordEnd returns where the whitespace-delimited word after cur ends,
+// skipping any spaces just after cur.
+func wordEnd(buf []rune, cur int) int {
+	for cur < len(buf) && unicode.IsSpace(buf[cur]) {
+		cur++
+	}
+	for cur < len(buf) && !unicode.IsSpace(buf[cur]) {
+		cur++
+	}
+	return cur
+}
+
+// SetViMode selects vi-style editing, or the default emacs style.
+func (m *Manager) SetViMode(enabled bool) {
+	m.viMode = enabled
+}
+
+// inputPending reports whether more input arrives on stdin within a
+// moment, which tells an Escape key from the start of an escape sequence.
+func inputPending() bool {
+	fds := []unix.PollFd{{Fd: int32(os.Stdin.Fd()), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 25)
+	return err == nil && n > 0
+}
+
+func isContinuation(b byte) bool {
+	return b&0xc0 == 0x80
+}
+
+// visibleWidth returns how many columns s takes on the terminal, leaving
+// out escape sequences such as colors and the \001 and \002 markers that
+// prompts put around them.
+func visibleWidth(s string) int {
+	width := 0
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '\033' && i+1 < len(s) && s[i+1] == '[':
+			i += 2
+			for i < len(s) && (s[i] < 0x40 || s[i] > 0x7e) {
+				i++
+			}
+		case r == '\n':
+			width = 0
+		case r < 32:
+		default:
+			width += runeWidth(r)
+		}
+		i += size
+	}
+	return width
+}
+
+// wideRanges are the East Asian wide and emoji ranges, which take two
+// columns.
+var wideRanges = [][2]rune{
+	{0x1100, 0x115f}, {0x231a, 0x231b}, {0x2329, 0x232a}, {0x23e9, 0x23ec},
+	{0x23f0, 0x23f0}, {0x23f3, 0x23f3}, {0x25fd, 0x25fe}, {0x2614, 0x2615},
+	{0x2648, 0x2653}, {0x267f, 0x267f}, {0x2693, 0x2693}, {0x26a1, 0x26a1},
+	{0x26aa, 0x26ab}, {0x26bd, 0x26be}, {0x26c4, 0x26c5}, {0x26ce, 0x26ce},
+	{0x26d4, 0x26d4}, {0x26ea, 0x26ea}, {0x26f2, 0x26f5}, {0x26fa, 0x26fd},
+	{0x2705, 0x2705}, {0x270a, 0x270b}, {0x2728, 0x2728}, {0x274c, 0x274c},
+	{0x2753, 0x2755}, {0x2757, 0x2757}, {0x2795, 0x2797}, {0x27b0, 0x27b0},
+	{0x27bf, 0x27bf}, {0x2b1b, 0x2b1c}, {0x2b50, 0x2b50}, {0x2b55, 0x2b55},
+	{0x2e80, 0x303e}, {0x3041, 0x33ff}, {0x3400, 0x4dbf}, {0x4e00, 0x9fff},
+	{0xa000, 0xa4cf}, {0xa960, 0xa97f}, {0xac00, 0xd7a3}, {0xf900, 0xfaff},
+	{0xfe10, 0xfe19}, {0xfe30, 0xfe6f}, {0xff00, 0xff60}, {0xffe0, 0xffe6},
+	{0x16fe0, 0x16fe4}, {0x17000, 0x18cd5}, {0x1b000, 0x1b2ff},
+	{0x1f004, 0x1f004}, {0x1f0cf, 0x1f0cf}, {0x1f18e, 0x1f18e},
+	{0x1f191, 0x1f19a}, {0x1f200, 0x1f251}, {0x1f300, 0x1f64f},
+	{0x1f680, 0x1f6ff}, {0x1f7e0, 0x1f7eb}, {0x1f90c, 0x1f9ff},
+	{0x1fa70, 0x1faff}, {0x20000, 0x2fffd}, {0x30000, 0x3fffd},
+}
+
+// runeWidth returns how many columns r takes: none for combining marks
+// and zero-width characters, two for wide ones and one otherwise.
+func runeWidth(r rune) int {
+	if r == 0x200b || r == 0x200c || r == 0x200d || unicode.In(r, unicode.Mn, unicode.Me) {
+		return 0
+	}
+	if r < wideRanges[0][0] {
+		return 1
+	}
+	i := sort.Search(len(wideRanges), func(i int) bool { return wideRanges[i][1] >= r })
+	if i < len(wideRanges) && wideRanges[i][0] <= r {
+		return 2
+	}
+	return 1
+}
+
+// displayRune returns how r is drawn on the input line. Control
+// characters, including the newlines of recalled multi-line entries, are
+// shown in caret notation so they cannot move the terminal cursor; the
+// buffer itself keeps the original rune.
+func displayRune(r rune) string {
+	switch {
+	case r == 127:
+		return "^?"
+	case r < 32:
+		return "^" + string(r+64)
 	}
+	return string(r)
+}
+
+func displayString(runes []rune) string {
+	var b strings.Builder
+	for _, r := range runes {
+		b.WriteString(displayRune(r))
+	}
+	return b.String()
 }
 
 func (m *Manager) ResetLine() {
-	fmt.Print("\r\033[K")
+	m.WriteString("\r\033[K")
 }
 
 func (m *Manager) Close() {
@@ -158,6 +572,12 @@ func (m *Manager) Close() {
 func (m *Manager) SetPrompt(prompt string) {
 }
 
+// SetRightPrompt sets the prompt drawn flush right by the following
+// ReadLine calls, or none if it is empty.
+func (m *Manager) SetRightPrompt(prompt string) {
+	m.rightPrompt = prompt
+}
+
 func (m *Manager) AddHistory(line string) {
 	if m.history != nil {
 		m.history.Add(line)
@@ -179,10 +599,15 @@ func (m *Manager) SaveHistory() error {
 }
 
 func (m *Manager) ClearScreen() {
-	fmt.Print("\033[2J\033[H")
+	m.WriteString("\033[2J\033[H")
 }
 
+// GetTerminalSize returns the width and height of the terminal, or 80x24
+// if standard error is not one.
 func (m *Manager) GetTerminalSize() (int, int) {
+	if width, height, err := term.GetSize(int(os.Stderr.Fd())); err == nil && width > 0 {
+		return width, height
+	}
 	return 80, 24
 }
 
@@ -223,7 +648,7 @@ func (m *Manager) ReadChar() (rune, error) {
 }
 
 func (m *Manager) WriteString(s string) {
-	fmt.Print(s)
+	io.WriteString(m.out, s)
 }
 
 func (m *Manager) Refresh() {
@@ -244,14 +669,24 @@ func restore(fd int, state interface{}) error {
 	return nil
 }
 
+// SetCompletionCallback sets the function that lists the command names
+// starting with a prefix, which completes the first word of a line.
 func (m *Manager) SetCompletionCallback(callback func(string) []string) {
+	m.commands = callback
 }
 
+// Complete returns the completions of the last word of line: command
+// names for the first word, and for the others what the command's
+// completion spec gives, or file names.
 func (m *Manager) Complete(line string) []string {
 	parts := strings.Fields(line)
 	if len(parts) == 0 {
 		return nil
 	}
+	if strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") {
+		// The cursor is past the last word, on a new empty one.
+		parts = append(parts, "")
+	}
 
 	lastPart := parts[len(parts)-1]
 
@@ -259,6 +694,8 @@ func (m *Manager) Complete(line string) []string {
 
 	if len(parts) == 1 {
 		completions = append(completions, m.completeCommands(lastPart)...)
+	} else if spec := m.specs[parts[0]]; spec != nil {
+		completions = append(completions, m.completeSpec(spec, parts)...)
 	} else {
 		completions = append(completions, m.completeFiles(lastPart)...)
 	}
@@ -266,23 +703,110 @@ func (m *Manager) Complete(line string) []string {
 	return completions
 }
 
-func (m *Manager) completeCommands(prefix string) []string {
-	commands := []string{
-		"cd", "pwd", "ls", "echo", "cat", "grep", "find", "which", "history",
-		"exit", "help", "export", "unset", "set", "source", ".", "alias",
-		"unalias", "jobs", "fg", "bg", "kill", "ps", "top", "date", "whoami",
+// completeWord completes the word that ends at cur in buf. A single
+// completion replaces the word, followed by a space unless it is a
+// directory; several extend it as far as they agree and, if that adds
+// nothing, are returned sorted for listing. With no completion at all
+// the line returned is nil.
+func (m *Manager) completeWord(buf []rune, cur int) ([]rune, int, []string) {
+	completions := m.Complete(string(buf[:cur]))
+	start := cur
+	for start > 0 && !unicode.IsSpace(buf[start-1]) {
+		start--
+	}
+	word := string(buf[start:cur])
+
+	var text string
+	switch len(completions) {
+	case 0:
+		return nil, cur, nil
+	case 1:
+		text = completions[0]
+		if !strings.HasSuffix(text, "/") {
+			text += " "
+		}
+	default:
+		text = commonPrefix(completions)
+		if len(text) <= len(word) {
+			list := append([]string(nil), completions...)
+			sort.Strings(list)
+			return buf, cur, list
+		}
 	}
 
-	var matches []string
-	for _, cmd := range commands {
-		if strings.HasPrefix(cmd, prefix) {
-			matches = append(matches, cmd)
+	line := append(append([]rune(nil), buf[:start]...), []rune(text)...)
+	return append(line, buf[cur:]...), len(line), nil
+}
+
+// commonPrefix returns the longest prefix all of words share.
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
 		}
 	}
+	for !utf8.ValidString(prefix) {
+		prefix = prefix[:len(prefix)-1]
+	}
+	return prefix
+}
+
+// SetCompletionSpec registers how to complete the arguments of name;
+// a nil spec removes it.
+func (m *Manager) SetCompletionSpec(name string, spec *CompletionSpec) {
+	if spec == nil {
+		delete(m.specs, name)
+		return
+	}
+	if m.specs == nil {
+		m.specs = make(map[string]*CompletionSpec)
+	}
+	m.specs[name] = spec
+}
+
+// CompletionSpecs returns the registered completion specs by command
+// name.
+func (m *Manager) CompletionSpecs() map[string]*CompletionSpec {
+	return m.specs
+}
+
+// SetFunctionCallback sets the function that runs the shell function of
+// a -F spec on the words of the line, the last being the one completed,
+// and returns its completions.
+func (m *Manager) SetFunctionCallback(callback func(name string, words []string) []string) {
+	m.function = callback
+}
+
+func (m *Manager) completeSpec(spec *CompletionSpec, words []string) []string {
+	prefix := words[len(words)-1]
 
+	var matches []string
+	for _, word := range spec.Words {
+		if strings.HasPrefix(word, prefix) {
+			matches = append(matches, word)
+		}
+	}
+	if spec.Files || spec.Dirs {
+		for _, name := range m.completeFiles(prefix) {
+			if spec.Files || strings.HasSuffix(name, "/") {
+				matches = append(matches, name)
+			}
+		}
+	}
+	if spec.Function != "" && m.function != nil {
+		matches = append(matches, m.function(spec.Function, words)...)
+	}
 	return matches
 }
 
+func (m *Manager) completeCommands(prefix string) []string {
+	if m.commands == nil {
+		return nil
+	}
+	return m.commands(prefix)
+}
+
 func (m *Manager) completeFiles(prefix string) []string {
 	dir := "."
 	filename := prefix
@@ -306,7 +830,7 @@ func (m *Manager) completeFiles(prefix string) []string {
 		if strings.HasPrefix(entry.Name(), filename) {
 			fullPath := entry.Name()
 			if dir != "." {
-				fullPath = dir + "/" + entry.Name()
+				fullPath = strings.TrimSuffix(dir, "/") + "/" + entry.Name()
 			}
 			if entry.IsDir() {
 				fullPath += "/"
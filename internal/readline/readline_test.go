@@ -0,0 +1,114 @@
+package readline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// newTestManager returns a manager that completes the first word of a
+// line from commands.
+func newTestManager(commands ...string) *Manager {
+	m := &Manager{}
+	m.SetCompletionCallback(func(prefix string) []string {
+		var matches []string
+		for _, name := range commands {
+			if strings.HasPrefix(name, prefix) {
+				matches = append(matches, name)
+			}
+		}
+		return matches
+	})
+	return m
+}
+
+func TestCompleteWord(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"notes.txt", "notes.md"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	m := newTestManager("echo", "exit", "export", "printf")
+	tests := []struct {
+		name string
+		line string
+		cur  int // -1 for the end of the line
+		want string
+		list []string
+	}{
+		{"single command", "pr", -1, "printf ", nil},
+		{"common prefix", "ex", -1, "ex", []string{"exit", "export"}},
+		{"extends to the common prefix", "exp", -1, "export ", nil},
+		{"before the cursor", "pr foo", 2, "printf  foo", nil},
+		{"no match", "zz", -1, "", nil},
+		{"empty line", "", -1, "", nil},
+		{"directory", "cd " + dir + "/s", -1, "cd " + dir + "/src/", nil},
+		{"files", "cat " + dir + "/n", -1, "cat " + dir + "/notes.", nil},
+		{"ambiguous files", "cat " + dir + "/notes.", -1, "cat " + dir + "/notes.", []string{dir + "/notes.md", dir + "/notes.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := []rune(tt.line)
+			cur := tt.cur
+			if cur < 0 {
+				cur = len(buf)
+			}
+			line, _, list := m.completeWord(buf, cur)
+			if string(line) != tt.want || !reflect.DeepEqual(list, tt.list) {
+				t.Errorf("completeWord(%q, %d) = %q, %q; want %q, %q", tt.line, cur, string(line), list, tt.want, tt.list)
+			}
+		})
+	}
+}
+
+func TestCommonPrefix(t *testing.T) {
+	tests := []struct {
+		words []string
+		want  string
+	}{
+		{[]string{"export", "exit"}, "ex"},
+		{[]string{"a", "b"}, ""},
+		{[]string{"same", "same"}, "same"},
+		{[]string{"café", "cafè"}, "caf"},
+	}
+	for _, tt := range tests {
+		if got := commonPrefix(tt.words); got != tt.want {
+			t.Errorf("commonPrefix(%q) = %q, want %q", tt.words, got, tt.want)
+		}
+	}
+}
+
+func TestCompleteWordSpec(t *testing.T) {
+	m := newTestManager("myservice")
+	m.SetCompletionSpec("myservice", &CompletionSpec{Words: []string{"start", "stop", "restart"}})
+	m.SetFunctionCallback(func(name string, words []string) []string {
+		return []string{name + ":" + words[len(words)-1]}
+	})
+	m.SetCompletionSpec("tool", &CompletionSpec{Function: "_tool"})
+
+	tests := []struct {
+		line string
+		want string
+		list []string
+	}{
+		{"myservice st", "myservice st", []string{"start", "stop"}},
+		{"myservice sta", "myservice start ", nil},
+		{"myservice r", "myservice restart ", nil},
+		{"myservice ", "myservice ", []string{"restart", "start", "stop"}},
+		{"myservice x", "", nil},
+		{"tool ab", "tool _tool:ab ", nil},
+	}
+	for _, tt := range tests {
+		line, _, list := m.completeWord([]rune(tt.line), len([]rune(tt.line)))
+		if string(line) != tt.want || !reflect.DeepEqual(list, tt.list) {
+			t.Errorf("completeWord(%q) = %q, %q; want %q, %q", tt.line, string(line), list, tt.want, tt.list)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package shell
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Result is the record written for each top-level command in --json
+// mode, one JSON object per line.
+type Result struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	Error    string `json:"error,omitempty"`
+}
+
+// executeJSON runs src one top-level command at a time, capturing each
+// command's output and writing a Result for it to out.
+func (s *Shell) executeJSON(src string, out io.Writer) {
+	enc := json.NewEncoder(out)
+
+	commands, err := s.parser.Parse(src)
+	if err != nil {
+		s.exitCode = 2
+		enc.Encode(Result{Command: src, ExitCode: s.exitCode, Error: err.Error()})
+		return
+	}
+
+	stdin, stdout, stderr := s.executor.Stdin(), s.executor.Stdout(), s.executor.Stderr()
+	defer s.executor.SetStdio(stdin, stdout, stderr)
+
+	for _, cmd := range commands {
+		var cmdOut, cmdErr bytes.Buffer
+		s.executor.SetStdio(stdin, &cmdOut, &cmdErr)
+
+		exitCode := s.executor.Execute(cmd)
+		if s.running {
+			s.exitCode = exitCode
+		}
+
+		enc.Encode(Result{
+			Command:  cmd.Text,
+			ExitCode: s.exitCode,
+			Stdout:   cmdOut.String(),
+			Stderr:   cmdErr.String(),
+		})
+
+		if !s.running {
+			break
+		}
+	}
+}
+
+func (s *Shell) runJSON() error {
+	out := s.stdout()
+
+	if s.config.HasCommand {
+		s.executeJSON(s.config.Command, out)
+		s.Exit(s.exitCode)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(s.executor.Stdin())
+	for scanner.Scan() && s.running {
+		if line := scanner.Text(); line != "" {
+			s.executeJSON(line, out)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading stdin: %v", err)
+	}
+
+	s.Exit(s.exitCode)
+	return nil
+}
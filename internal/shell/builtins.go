@@ -2,399 +2,2295 @@ package shell
 
 import (
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"gosh/internal/builtin"
+	"gosh/internal/conditional"
+	"gosh/internal/jobs"
+	"gosh/internal/parser"
+	"gosh/internal/readline"
+	"gosh/internal/strftime"
+	"gosh/internal/variables"
+
+	"golang.org/x/sys/unix"
 )
 
-func (s *Shell) builtinExit(args []string) int {
-	code := 0
+func (s *Shell) builtinExit(stdio builtin.IO, args []string) int {
+	code := stdio.Status
 	if len(args) > 0 {
-		if c, err := strconv.Atoi(args[0]); err == nil {
-			code = c
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "exit: %s: numeric argument required\n", args[0])
+			n = 2
+		} else if len(args) > 1 {
+			fmt.Fprintf(stdio.Stderr, "exit: too many arguments\n")
+			return 1
 		}
+		code = n & 0xFF
 	}
 	s.Exit(code)
 	return code
 }
 
-func (s *Shell) builtinCD(args []string) int {
-	var dir string
+func (s *Shell) builtinReturn(stdio builtin.IO, args []string) int {
+	if !s.variables.InFunction() && s.sourcing == 0 {
+		fmt.Fprintf(stdio.Stderr, "return: can only `return' from a function or sourced script\n")
+		return 1
+	}
 
-	if len(args) == 0 {
-		dir = os.Getenv("HOME")
+	code := stdio.Status
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "return: %s: numeric argument required\n", args[0])
+			n = 2
+		}
+		code = n & 0xFF
+	}
+	s.executor.Return()
+	return code
+}
+
+// builtinTrue is true and :, which do nothing beyond the expansions and
+// redirects every command gets.
+func (s *Shell) builtinTrue(stdio builtin.IO, args []string) int {
+	return 0
+}
+
+func (s *Shell) builtinFalse(stdio builtin.IO, args []string) int {
+	return 1
+}
+
+func (s *Shell) builtinCD(stdio builtin.IO, args []string) int {
+	physical := false
+	i := 0
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 'L':
+				physical = false
+			case 'P':
+				physical = true
+			default:
+				fmt.Fprintf(stdio.Stderr, "cd: -%c: invalid option\n", flag)
+				fmt.Fprintf(stdio.Stderr, "cd: usage: cd [-L|-P] [dir]\n")
+				return 2
+			}
+		}
+	}
+	args = args[i:]
+
+	var dir string
+	switch len(args) {
+	case 0:
+		dir = s.variables.Get("HOME")
 		if dir == "" {
-			fmt.Fprintf(os.Stderr, "cd: HOME not set\n")
+			fmt.Fprintf(stdio.Stderr, "cd: HOME not set\n")
 			return 1
 		}
-	} else {
+	case 1:
 		dir = args[0]
+	default:
+		fmt.Fprintf(stdio.Stderr, "cd: too many arguments\n")
+		return 1
 	}
 
+	// The new directory is printed when it is not the one typed: for
+	// cd - and when it was found through $CDPATH.
+	print := false
 	if dir == "-" {
 		prevDir := s.variables.Get("OLDPWD")
 		if prevDir == "" {
-			fmt.Fprintf(os.Stderr, "cd: OLDPWD not set\n")
+			fmt.Fprintf(stdio.Stderr, "cd: OLDPWD not set\n")
 			return 1
 		}
 		dir = prevDir
-		fmt.Println(dir)
+		print = true
 	}
 
 	if strings.HasPrefix(dir, "~") {
-		home := os.Getenv("HOME")
+		home := s.variables.Get("HOME")
 		if home != "" {
 			dir = filepath.Join(home, dir[1:])
 		}
 	}
 
-	oldPwd, _ := os.Getwd()
+	if found, ok := s.searchCDPATH(dir); ok {
+		dir = found
+		print = true
+	}
 
-	if err := os.Chdir(dir); err != nil {
-		fmt.Fprintf(os.Stderr, "cd: %v\n", err)
+	if err := s.changeDir(dir, physical); err != nil {
+		fmt.Fprintf(stdio.Stderr, "cd: %v\n", err)
 		return 1
 	}
-
-	newPwd, _ := os.Getwd()
-	s.variables.Set("OLDPWD", oldPwd)
-	s.variables.Set("PWD", newPwd)
-	s.currentDir = newPwd
+	if print {
+		fmt.Fprintln(stdio.Stdout, s.currentDir)
+	}
 
 	return 0
 }
 
-func (s *Shell) builtinPWD(args []string) int {
-	pwd, err := os.Getwd()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "pwd: %v\n", err)
-		return 1
+// searchCDPATH looks for the relative directory dir under each directory
+// in $CDPATH, and returns the first found unless that is dir itself,
+// found through an empty entry or ".". Names starting with . or .. are
+// not searched for.
+func (s *Shell) searchCDPATH(dir string) (string, bool) {
+	cdpath := s.variables.Get("CDPATH")
+	if cdpath == "" || filepath.IsAbs(dir) || dir == "." || dir == ".." ||
+		strings.HasPrefix(dir, "./") || strings.HasPrefix(dir, "../") {
+		return "", false
 	}
-	fmt.Println(pwd)
-	return 0
-}
 
-func (s *Shell) builtinEcho(args []string) int {
-	output := strings.Join(args, " ")
-	fmt.Println(output)
-	return 0
+	for _, entry := range filepath.SplitList(cdpath) {
+		if entry == "" || entry == "." {
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				return "", false
+			}
+			continue
+		}
+		candidate := filepath.Join(entry, dir)
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, true
+		}
+	}
+	return "", false
 }
 
-func (s *Shell) builtinHelp(args []string) int {
-	if len(args) == 0 {
-		fmt.Println("gosh - Go Shell")
-		fmt.Println()
-		fmt.Println("Builtin commands:")
-
-		builtins := []string{
-			"cd [dir]      - Change directory",
-			"pwd           - Print working directory",
-			"echo [args]   - Print arguments",
-			"exit [code]   - Exit shell",
-			"help [cmd]    - Show help",
-			"history       - Show command history",
-			"export [var]  - Export variable",
-			"unset [var]   - Unset variable",
-			"set           - Show/set shell options",
-			"source [file] - Execute file",
-			". [file]      - Execute file (alias for source)",
-			"jobs          - Show active jobs",
-			"fg [job]      - Bring job to foreground",
-			"bg [job]      - Send job to background",
-			"kill [job]    - Kill job",
-		}
-
-		for _, builtin := range builtins {
-			fmt.Printf("  %s\n", builtin)
-		}
-
-		fmt.Println()
-		fmt.Println("For help on external commands, use 'man <command>'")
-		return 0
+// sameDir reports whether the absolute path dir names the directory at
+// path.
+func sameDir(dir, path string) bool {
+	if !filepath.IsAbs(dir) {
+		return false
 	}
-
-	cmd := args[0]
-	switch cmd {
-	case "cd":
-		fmt.Println("cd [directory] - Change the current directory")
-		fmt.Println("  cd           - Go to home directory")
-		fmt.Println("  cd -         - Go to previous directory")
-		fmt.Println("  cd /path     - Go to specified path")
-	case "pwd":
-		fmt.Println("pwd - Print the current working directory")
-	case "echo":
-		fmt.Println("echo [arguments...] - Display arguments")
-	case "exit":
-		fmt.Println("exit [code] - Exit the shell with optional exit code")
-	case "history":
-		fmt.Println("history - Display command history")
-	case "export":
-		fmt.Println("export [name[=value]] - Export variables to environment")
-	case "unset":
-		fmt.Println("unset [name] - Remove variable")
-	default:
-		fmt.Printf("No help available for '%s'\n", cmd)
-		return 1
+	a, err := os.Stat(dir)
+	if err != nil {
+		return false
 	}
-
-	return 0
+	b, err := os.Stat(path)
+	return err == nil && os.SameFile(a, b)
 }
 
-func (s *Shell) builtinHistory(args []string) int {
-	if len(args) > 0 && args[0] == "-c" {
-		s.history.Clear()
-		return 0
-	}
+// changeDir switches the working directory and keeps PWD and OLDPWD in
+// step with it. PWD is kept logical, dir taken relative to the old PWD
+// so that the symbolic links passed through stay in it, unless physical
+// is set or the logical path cannot be followed.
+func (s *Shell) changeDir(dir string, physical bool) error {
+	oldPwd := s.logicalDir()
 
-	entries := s.history.All()
-	for i, entry := range entries {
-		fmt.Printf("%4d  %s\n", i+1, entry)
+	newPwd := ""
+	if !physical {
+		logical := dir
+		if !filepath.IsAbs(logical) {
+			logical = filepath.Join(oldPwd, logical)
+		}
+		if os.Chdir(logical) == nil {
+			newPwd = filepath.Clean(logical)
+		}
+	}
+	if newPwd == "" {
+		if err := os.Chdir(dir); err != nil {
+			return err
+		}
+		newPwd, _ = physicalDir()
 	}
 
-	return 0
+	s.variables.Set("OLDPWD", oldPwd)
+	s.variables.Set("PWD", newPwd)
+	s.currentDir = newPwd
+
+	return nil
+}
+
+// logicalDir returns the working directory as cd keeps it, through the
+// symbolic links it passed, or the physical one before there is any.
+func (s *Shell) logicalDir() string {
+	if s.currentDir != "" {
+		return s.currentDir
+	}
+	dir, _ := os.Getwd()
+	return dir
 }
 
-func (s *Shell) builtinExport(args []string) int {
+func (s *Shell) builtinPushd(stdio builtin.IO, args []string) int {
+	cwd := s.logicalDir()
+
 	if len(args) == 0 {
-		exported := s.variables.Exported()
-		sort.Strings(exported)
-		for _, env := range exported {
-			fmt.Printf("export %s\n", env)
+		if len(s.dirStack) == 0 {
+			fmt.Fprintf(stdio.Stderr, "pushd: no other directory\n")
+			return 1
+		}
+		if err := s.changeDir(s.dirStack[0], false); err != nil {
+			fmt.Fprintf(stdio.Stderr, "pushd: %v\n", err)
+			return 1
 		}
+		s.dirStack[0] = cwd
+		s.printDirs(stdio)
 		return 0
 	}
 
-	for _, arg := range args {
-		if strings.Contains(arg, "=") {
-			parts := strings.SplitN(arg, "=", 2)
-			name, value := parts[0], parts[1]
-			s.variables.Set(name, value)
-			s.variables.Export(name)
-		} else {
-			s.variables.Export(arg)
+	dir := args[0]
+	if strings.HasPrefix(dir, "~") {
+		if home := s.variables.Get("HOME"); home != "" {
+			dir = filepath.Join(home, dir[1:])
 		}
 	}
 
+	if err := s.changeDir(dir, false); err != nil {
+		fmt.Fprintf(stdio.Stderr, "pushd: %v\n", err)
+		return 1
+	}
+	s.dirStack = append([]string{cwd}, s.dirStack...)
+	s.printDirs(stdio)
 	return 0
 }
 
-func (s *Shell) builtinUnset(args []string) int {
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "unset: not enough arguments\n")
+func (s *Shell) builtinPopd(stdio builtin.IO, args []string) int {
+	if len(s.dirStack) == 0 {
+		fmt.Fprintf(stdio.Stderr, "popd: directory stack empty\n")
 		return 1
 	}
 
-	for _, arg := range args {
-		if err := s.variables.Unset(arg); err != nil {
-			fmt.Fprintf(os.Stderr, "unset: %v\n", err)
+	if err := s.changeDir(s.dirStack[0], false); err != nil {
+		fmt.Fprintf(stdio.Stderr, "popd: %v\n", err)
+		return 1
+	}
+	s.dirStack = s.dirStack[1:]
+	s.printDirs(stdio)
+	return 0
+}
+
+func (s *Shell) builtinDirs(stdio builtin.IO, args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "-c":
+			s.dirStack = nil
+			return 0
+		default:
+			fmt.Fprintf(stdio.Stderr, "dirs: %s: invalid option\n", args[0])
 			return 1
 		}
 	}
 
+	s.printDirs(stdio)
 	return 0
 }
 
-func (s *Shell) builtinSet(args []string) int {
-	if len(args) == 0 {
-		vars := s.variables.All()
-		var names []string
-		for name := range vars {
-			names = append(names, name)
-		}
-		sort.Strings(names)
+func (s *Shell) printDirs(stdio builtin.IO) {
+	cwd := s.logicalDir()
+	home := s.variables.Get("HOME")
 
-		for _, name := range names {
-			v := vars[name]
-			fmt.Printf("%s=%s\n", name, v.Value)
+	dirs := append([]string{cwd}, s.dirStack...)
+	for i, dir := range dirs {
+		if home != "" && (dir == home || strings.HasPrefix(dir, home+"/")) {
+			dirs[i] = "~" + dir[len(home):]
 		}
-		return 0
 	}
+	fmt.Fprintln(stdio.Stdout, strings.Join(dirs, " "))
+}
 
+func (s *Shell) builtinPWD(stdio builtin.IO, args []string) int {
+	physical := false
 	for _, arg := range args {
-		if strings.Contains(arg, "=") {
-			parts := strings.SplitN(arg, "=", 2)
-			name, value := parts[0], parts[1]
-			s.variables.Set(name, value)
-		} else {
-			switch arg {
-			case "-e":
-				s.config.POSIX = true
-			case "+e":
-				s.config.POSIX = false
-			case "-x":
-				s.config.Debug = true
-			case "+x":
-				s.config.Debug = false
-			default:
-				fmt.Printf("Unknown option: %s\n", arg)
-				return 1
-			}
+		switch arg {
+		case "-L":
+			physical = false
+		case "-P":
+			physical = true
+		default:
+			fmt.Fprintf(stdio.Stderr, "pwd: %s: invalid option\n", arg)
+			fmt.Fprintf(stdio.Stderr, "pwd: usage: pwd [-LP]\n")
+			return 2
 		}
 	}
 
+	if !physical && sameDir(s.currentDir, ".") {
+		fmt.Fprintln(stdio.Stdout, s.currentDir)
+		return 0
+	}
+
+	pwd, err := physicalDir()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "pwd: %v\n", err)
+		return 1
+	}
+	fmt.Fprintln(stdio.Stdout, pwd)
 	return 0
 }
 
-func (s *Shell) builtinSource(args []string) int {
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "source: not enough arguments\n")
-		return 1
+// physicalDir returns the working directory with symbolic links
+// resolved, which os.Getwd leaves in when $PWD names the directory.
+func physicalDir() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
 	}
+	return filepath.EvalSymlinks(dir)
+}
 
-	filename := args[0]
+func (s *Shell) builtinEcho(stdio builtin.IO, args []string) int {
+	output := strings.Join(args, " ")
+	if s.posixMode() {
+		// POSIX echo takes no options and always interprets escapes.
+		output, newline := echoEscapes(output)
+		if newline {
+			output += "\n"
+		}
+		fmt.Fprint(stdio.Stdout, output)
+		return 0
+	}
+	fmt.Fprintln(stdio.Stdout, output)
+	return 0
+}
 
-	if !strings.Contains(filename, "/") {
-		path := s.variables.Get("PATH")
-		if path == "" {
-			path = "/usr/local/bin:/usr/bin:/bin"
+// echoEscapes interprets the backslash escapes of POSIX echo. newline is
+// false if the output was cut short by \c.
+func echoEscapes(text string) (output string, newline bool) {
+	var b strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '\\' || i+1 >= len(text) {
+			b.WriteByte(text[i])
+			continue
 		}
+		i++
+		switch text[i] {
+		case 'a':
+			b.WriteByte('\a')
+		case 'b':
+			b.WriteByte('\b')
+		case 'c':
+			return b.String(), false
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'v':
+			b.WriteByte('\v')
+		case '\\':
+			b.WriteByte('\\')
+		case '0':
+			value := 0
+			for n := 0; n < 3 && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '7'; n++ {
+				i++
+				value = value*8 + int(text[i]-'0')
+			}
+			b.WriteByte(byte(value))
+		default:
+			b.WriteByte('\\')
+			b.WriteByte(text[i])
+		}
+	}
+	return b.String(), true
+}
 
-		found := false
-		for _, dir := range strings.Split(path, ":") {
-			fullPath := filepath.Join(dir, filename)
-			if _, err := os.Stat(fullPath); err == nil {
-				filename = fullPath
-				found = true
-				break
+func (s *Shell) builtinRead(stdio builtin.IO, args []string) int {
+	raw := false
+	prompt := ""
+
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "-") && args[i] != "-"; i++ {
+		switch args[i] {
+		case "-r":
+			raw = true
+		case "-p":
+			if i+1 >= len(args) {
+				fmt.Fprintf(stdio.Stderr, "read: -p: option requires an argument\n")
+				return 2
 			}
+			i++
+			prompt = args[i]
+		case "--":
+			i++
+			goto names
+		default:
+			fmt.Fprintf(stdio.Stderr, "read: %s: invalid option\n", args[i])
+			fmt.Fprintf(stdio.Stderr, "read: usage: read [-r] [-p prompt] [name ...]\n")
+			return 2
 		}
+	}
 
-		if !found {
-			if _, err := os.Stat(filename); err != nil {
-				fmt.Fprintf(os.Stderr, "source: %s: No such file or directory\n", filename)
+names:
+	names := args[i:]
+
+	if prompt != "" {
+		fmt.Fprint(stdio.Stderr, prompt)
+	}
+
+	line, ok := readLine(stdio.Stdin, raw)
+
+	if len(names) == 0 {
+		s.variables.Set("REPLY", line)
+	} else {
+		fields := s.variables.SplitFields(line, len(names))
+		for n, name := range names {
+			value := ""
+			if n < len(fields) {
+				value = fields[n]
+			}
+			if err := s.variables.Set(name, value); err != nil {
+				fmt.Fprintf(stdio.Stderr, "read: %v\n", err)
 				return 1
 			}
 		}
 	}
 
-	if err := s.sourceFile(filename); err != nil {
-		fmt.Fprintf(os.Stderr, "source: %v\n", err)
+	if !ok {
 		return 1
 	}
 	return 0
 }
 
-func (s *Shell) builtinJobs(args []string) int {
-	s.jobs.Print()
-	return 0
+// readLine reads a line from r a byte at a time, so that nothing past the
+// newline is consumed from a shared stdin. Unless raw is set, a backslash
+// escapes the next character and a backslash-newline continues the line.
+// ok is false if input ended before a newline.
+func readLine(r io.Reader, raw bool) (line string, ok bool) {
+	var b strings.Builder
+	buf := make([]byte, 1)
+	escaped := false
+
+	for {
+		if n, err := r.Read(buf); n == 0 || err != nil {
+			return b.String(), false
+		}
+
+		ch := buf[0]
+		switch {
+		case escaped:
+			escaped = false
+			if ch != '\n' {
+				b.WriteByte(ch)
+			}
+		case ch == '\\' && !raw:
+			escaped = true
+		case ch == '\n':
+			return b.String(), true
+		default:
+			b.WriteByte(ch)
+		}
+	}
 }
 
-func (s *Shell) builtinFG(args []string) int {
+// builtinHelp lists the builtins registered with help, or prints the
+// help of those named. Builtins without help, like the easter eggs, are
+// left out of the list.
+func (s *Shell) builtinHelp(stdio builtin.IO, args []string) int {
 	if len(args) == 0 {
-		jobs := s.jobs.List()
-		if len(jobs) == 0 {
-			fmt.Fprintf(os.Stderr, "fg: no current job\n")
-			return 1
-		}
+		fmt.Fprintln(stdio.Stdout, "gosh - Go Shell")
+		fmt.Fprintln(stdio.Stdout)
+		fmt.Fprintln(stdio.Stdout, "Builtin commands:")
 
-		for i := len(jobs) - 1; i >= 0; i-- {
-			if jobs[i].State == s.jobs.Running()[0].State {
-				if err := s.jobs.Foreground(jobs[i].ID); err != nil {
-					fmt.Fprintf(os.Stderr, "fg: %v\n", err)
-					return 1
-				}
-				return 0
+		var names []string
+		width := 0
+		for _, name := range s.builtins.List() {
+			if _, ok := s.builtins.Help(name); ok {
+				names = append(names, name)
+				width = max(width, len(name))
 			}
 		}
+		sort.Strings(names)
 
-		fmt.Fprintf(os.Stderr, "fg: no current job\n")
-		return 1
+		for _, name := range names {
+			help, _ := s.builtins.Help(name)
+			fmt.Fprintf(stdio.Stdout, "  %-*s - %s\n", width, name, help.Short)
+		}
+
+		fmt.Fprintln(stdio.Stdout)
+		fmt.Fprintln(stdio.Stdout, "Use 'help name' for the usage of a builtin.")
+		fmt.Fprintln(stdio.Stdout, "For help on external commands, use 'man <command>'")
+		return 0
 	}
 
-	jobID, err := strconv.Atoi(args[0])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "fg: %s: no such job\n", args[0])
-		return 1
+	status := 0
+	for _, name := range args {
+		help, ok := s.builtins.Help(name)
+		if !ok {
+			fmt.Fprintf(stdio.Stderr, "help: no help available for '%s'\n", name)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdio.Stdout, "%s - %s\n", help.Usage, help.Short)
+		for _, line := range help.Long {
+			fmt.Fprintf(stdio.Stdout, "  %s\n", line)
+		}
 	}
+	return status
+}
 
-	if err := s.jobs.Foreground(jobID); err != nil {
-		fmt.Fprintf(os.Stderr, "fg: %v\n", err)
+func (s *Shell) builtinHistory(stdio builtin.IO, args []string) int {
+	clear := false
+	offset := ""
+	var fileOp rune
+	i := 0
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 'c':
+				clear = true
+			case 'd':
+				if i+1 >= len(args) {
+					fmt.Fprintf(stdio.Stderr, "history: -d: option requires an argument\n")
+					return 2
+				}
+				i++
+				offset = args[i]
+			case 'a', 'r', 'w':
+				if fileOp != 0 && fileOp != flag {
+					fmt.Fprintf(stdio.Stderr, "history: cannot use more than one of -arw\n")
+					return 1
+				}
+				fileOp = flag
+			default:
+				fmt.Fprintf(stdio.Stderr, "history: -%c: invalid option\n", flag)
+				fmt.Fprintf(stdio.Stderr, "history: usage: history [-c] [-d offset] [n] or history -arw [filename]\n")
+				return 2
+			}
+		}
+	}
+	args = args[i:]
+	if len(args) > 1 {
+		fmt.Fprintf(stdio.Stderr, "history: too many arguments\n")
 		return 1
 	}
 
-	return 0
-}
+	if clear {
+		s.history.Clear()
+	}
 
-func (s *Shell) builtinBG(args []string) int {
-	if len(args) == 0 {
-		jobs := s.jobs.Stopped()
-		if len(jobs) == 0 {
-			fmt.Fprintf(os.Stderr, "bg: no current job\n")
+	if offset != "" {
+		// A negative offset counts back from the end, where -1 is this
+		// history -d itself.
+		n, err := strconv.Atoi(offset)
+		if err == nil && n < 0 {
+			n += s.history.Size() + 1
+		}
+		if err != nil || !s.history.Delete(n-1) {
+			fmt.Fprintf(stdio.Stderr, "history: %s: history position out of range\n", offset)
 			return 1
 		}
+	}
+
+	if fileOp != 0 {
+		s.syncHistoryOptions()
+		file := s.history.GetFile()
+		if len(args) > 0 {
+			file = args[0]
+		}
 
-		if err := s.jobs.Background(jobs[len(jobs)-1].ID); err != nil {
-			fmt.Fprintf(os.Stderr, "bg: %v\n", err)
+		var err error
+		switch fileOp {
+		case 'a':
+			err = s.history.AppendFile(file)
+		case 'r':
+			err = s.history.ReadFile(file)
+		case 'w':
+			err = s.history.WriteFile(file)
+		}
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "history: %v\n", err)
 			return 1
 		}
 		return 0
 	}
 
-	jobID, err := strconv.Atoi(args[0])
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "bg: %s: no such job\n", args[0])
-		return 1
+	if clear || offset != "" {
+		return 0
 	}
 
-	if err := s.jobs.Background(jobID); err != nil {
-		fmt.Fprintf(os.Stderr, "bg: %v\n", err)
-		return 1
+	// history n lists only the last n entries.
+	entries := s.history.Entries()
+	first := 0
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 0 {
+			fmt.Fprintf(stdio.Stderr, "history: %s: numeric argument required\n", args[0])
+			return 1
+		}
+		first = max(len(entries)-n, 0)
+	}
+
+	timeFormat := s.variables.Get("HISTTIMEFORMAT")
+	for i, entry := range entries[first:] {
+		stamp := ""
+		if timeFormat != "" && !entry.Time.IsZero() {
+			stamp = strftime.Format(timeFormat, entry.Time)
+		}
+		fmt.Fprintf(stdio.Stdout, "%4d  %s%s\n", first+i+1, stamp, entry.Command)
 	}
 
 	return 0
 }
 
-func (s *Shell) builtinKill(args []string) int {
-	if len(args) == 0 {
-		fmt.Fprintf(os.Stderr, "kill: not enough arguments\n")
+func (s *Shell) builtinFC(stdio builtin.IO, args []string) int {
+	var list, noNumbers, reverse, substitute bool
+	editor := ""
+
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || arg[0] != '-' || (arg[1] >= '0' && arg[1] <= '9') {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch flag {
+			case 'l':
+				list = true
+			case 'n':
+				noNumbers = true
+			case 'r':
+				reverse = true
+			case 's':
+				substitute = true
+			case 'e':
+				if i+1 >= len(args) {
+					fmt.Fprintf(stdio.Stderr, "fc: -e: option requires an argument\n")
+					return 2
+				}
+				i++
+				editor = args[i]
+			default:
+				fmt.Fprintf(stdio.Stderr, "fc: -%c: invalid option\n", flag)
+				fmt.Fprintf(stdio.Stderr, "fc: usage: fc [-e ename] [-lnr] [first] [last] or fc -s [pat=rep] [command]\n")
+				return 2
+			}
+		}
+	}
+	args = args[i:]
+
+	// The fc invocation itself is already in history; it is not a
+	// candidate for listing or re-execution.
+	entries := s.history.All()
+	if n := len(entries); n > 0 && strings.HasPrefix(entries[n-1], "fc") {
+		entries = entries[:n-1]
+	}
+	if len(entries) == 0 {
+		fmt.Fprintf(stdio.Stderr, "fc: no history\n")
 		return 1
 	}
 
-	for _, arg := range args {
-		jobID, err := strconv.Atoi(arg)
+	if substitute {
+		var old, new string
+		if len(args) > 0 && strings.Contains(args[0], "=") {
+			parts := strings.SplitN(args[0], "=", 2)
+			old, new = parts[0], parts[1]
+			args = args[1:]
+		}
+
+		spec := "-1"
+		if len(args) > 0 {
+			spec = args[0]
+		}
+		index, err := fcEvent(entries, spec)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "kill: %s: no such job\n", arg)
-			continue
+			fmt.Fprintf(stdio.Stderr, "fc: %v\n", err)
+			return 1
 		}
 
-		if err := s.jobs.Kill(jobID); err != nil {
-			fmt.Fprintf(os.Stderr, "kill: %v\n", err)
+		command := entries[index]
+		if old != "" {
+			command = strings.Replace(command, old, new, 1)
 		}
+		return s.fcRun(stdio, command)
 	}
 
-	return 0
-}
+	firstSpec, lastSpec := "-1", ""
+	if list {
+		firstSpec = "-16"
+	}
+	if len(args) > 0 {
+		firstSpec = args[0]
+	}
+	if len(args) > 1 {
+		lastSpec = args[1]
+	}
 
-func (s *Shell) builtinTest(args []string) int {
-	if len(args) < 3 {
-		fmt.Fprintf(os.Stderr, "[: too few arguments\n")
+	first, err := fcEvent(entries, firstSpec)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "fc: %v\n", err)
 		return 1
 	}
-	if args[len(args)-1] != "]" {
-		fmt.Fprintf(os.Stderr, "[: missing ']'\n")
-		return 1
+	last := first
+	if list && len(args) < 2 {
+		last = len(entries) - 1
 	}
-	left := args[0]
-	op := args[1]
-	right := args[2]
-	switch op {
-	case "-lt":
-		l, _ := strconv.Atoi(left)
-		r, _ := strconv.Atoi(right)
-		if l < r {
-			return 0
+	if lastSpec != "" {
+		if last, err = fcEvent(entries, lastSpec); err != nil {
+			fmt.Fprintf(stdio.Stderr, "fc: %v\n", err)
+			return 1
 		}
-		return 1
-	case "-eq":
-		l, _ := strconv.Atoi(left)
-		r, _ := strconv.Atoi(right)
-		if l == r {
-			return 0
+	}
+
+	if first > last {
+		first, last = last, first
+		reverse = !reverse
+	}
+
+	if list {
+		for n := first; n <= last; n++ {
+			index := n
+			if reverse {
+				index = first + last - n
+			}
+			if noNumbers {
+				fmt.Fprintf(stdio.Stdout, "\t%s\n", entries[index])
+			} else {
+				fmt.Fprintf(stdio.Stdout, "%d\t%s\n", index+1, entries[index])
+			}
 		}
+		return 0
+	}
+
+	selected := append([]string{}, entries[first:last+1]...)
+	if reverse {
+		for l, r := 0, len(selected)-1; l < r; l, r = l+1, r-1 {
+			selected[l], selected[r] = selected[r], selected[l]
+		}
+	}
+	return s.fcEdit(stdio, editor, selected)
+}
+
+// fcEvent resolves an fc history reference to an index into entries: a
+// positive number is an absolute history number, a negative one is an
+// offset from the end, and anything else selects the most recent command
+// starting with that string.
+func fcEvent(entries []string, spec string) (int, error) {
+	if num, err := strconv.Atoi(spec); err == nil {
+		index := num - 1
+		if num < 0 {
+			index = len(entries) + num
+		}
+		if index < 0 {
+			index = 0
+		}
+		if index >= len(entries) {
+			index = len(entries) - 1
+		}
+		return index, nil
+	}
+
+	for i := len(entries) - 1; i >= 0; i-- {
+		if strings.HasPrefix(entries[i], spec) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("%s: event not found", spec)
+}
+
+// fcEdit opens commands in the editor and runs whatever is saved. The
+// editor is taken from -e, then $FCEDIT, then $EDITOR, falling back to vi.
+func (s *Shell) fcEdit(stdio builtin.IO, editor string, commands []string) int {
+	if editor == "" {
+		editor = s.variables.Get("FCEDIT")
+	}
+	if editor == "" {
+		editor = s.variables.Get("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+
+	file, err := os.CreateTemp("", "gosh-fc-*.sh")
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "fc: %v\n", err)
 		return 1
-	default:
-		fmt.Fprintf(os.Stderr, "[: unsupported op %s\n", op)
-		return 1
 	}
+	path := file.Name()
+	defer os.Remove(path)
+
+	_, err = file.WriteString(strings.Join(commands, "\n") + "\n")
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "fc: %v\n", err)
+		return 1
+	}
+
+	fields := strings.Fields(editor)
+	if code := s.executor.RunWithTimeout(stdio, fields[0], append(fields[1:], path), 0); code != 0 {
+		return code
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "fc: %v\n", err)
+		return 1
+	}
+
+	code := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		code = s.fcRun(stdio, line)
+		if !s.running {
+			break
+		}
+	}
+	return code
+}
+
+// fcRun echoes command, records it in history as bash does, and runs it.
+func (s *Shell) fcRun(stdio builtin.IO, command string) int {
+	fmt.Fprintln(stdio.Stdout, command)
+	s.history.Add(command)
+
+	code, err := s.RunString(command)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "fc: %v\n", err)
+	}
+	return code
+}
+
+// builtinExport is declare -x, except that -n takes the export attribute
+// away instead, leaving the values in the shell.
+func (s *Shell) builtinExport(stdio builtin.IO, args []string) int {
+	if len(args) == 0 || args[0] != "-n" {
+		return s.declare(stdio, "export", append([]string{"-x"}, args...), false)
+	}
+
+	status := 0
+	for _, arg := range args[1:] {
+		name, value, assign := strings.Cut(arg, "=")
+		if !variables.ValidName(name) {
+			fmt.Fprintf(stdio.Stderr, "export: `%s': not a valid identifier\n", arg)
+			status = 1
+			continue
+		}
+		if assign {
+			if err := s.assignValue(name, value); err != nil {
+				fmt.Fprintf(stdio.Stderr, "export: %v\n", err)
+				status = 1
+				continue
+			}
+		}
+		s.variables.Unexport(name)
+	}
+	return status
+}
+
+func (s *Shell) builtinReadonly(stdio builtin.IO, args []string) int {
+	return s.declare(stdio, "readonly", append([]string{"-r"}, args...), false)
+}
+
+func (s *Shell) builtinDeclare(stdio builtin.IO, args []string) int {
+	return s.declare(stdio, "declare", args, s.variables.InFunction())
+}
+
+func (s *Shell) builtinLocal(stdio builtin.IO, args []string) int {
+	if !s.variables.InFunction() {
+		fmt.Fprintf(stdio.Stderr, "local: can only be used in a function\n")
+		return 1
+	}
+	return s.declare(stdio, "local", args, true)
+}
+
+// declare implements declare, typeset and local. Inside a function the
+// names are made local unless -g is given, as in bash; export still acts
+// on whichever variable is visible, so a local stays in its frame.
+func (s *Shell) declare(stdio builtin.IO, cmd string, args []string, local bool) int {
+	var enable, disable []rune
+	printOnly := false
+
+	i := 0
+	for ; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			i++
+			break
+		}
+		if len(arg) < 2 || (arg[0] != '-' && arg[0] != '+') {
+			break
+		}
+		for _, flag := range arg[1:] {
+			switch {
+			case flag == 'p':
+				printOnly = true
+			case flag == 'g' && cmd != "local":
+				local = false
+			case strings.ContainsRune("ilurxaA", flag):
+				if arg[0] == '-' {
+					enable = append(enable, flag)
+				} else {
+					disable = append(disable, flag)
+				}
+			default:
+				fmt.Fprintf(stdio.Stderr, "%s: %c%c: invalid option\n", cmd, arg[0], flag)
+				fmt.Fprintf(stdio.Stderr, "%s: usage: %s [-aAilrux] [-p] [name[=value] ...]\n", cmd, cmd)
+				return 2
+			}
+		}
+	}
+	names := args[i:]
+
+	if len(names) == 0 {
+		vars := s.variables.All()
+		var sorted []string
+		for name, v := range vars {
+			if hasAttributes(v, enable) {
+				sorted = append(sorted, name)
+			}
+		}
+		sort.Strings(sorted)
+		for _, name := range sorted {
+			fmt.Fprintln(stdio.Stdout, declaration(vars[name]))
+		}
+		return 0
+	}
+
+	status := 0
+
+	if printOnly {
+		vars := s.variables.All()
+		for _, name := range names {
+			v, exists := vars[name]
+			if !exists {
+				fmt.Fprintf(stdio.Stderr, "%s: %s: not found\n", cmd, name)
+				status = 1
+				continue
+			}
+			fmt.Fprintln(stdio.Stdout, declaration(v))
+		}
+		return status
+	}
+
+	for _, arg := range names {
+		name, value, assign := strings.Cut(arg, "=")
+		if !variables.ValidName(name) {
+			fmt.Fprintf(stdio.Stderr, "%s: `%s': not a valid identifier\n", cmd, arg)
+			status = 1
+			continue
+		}
+
+		if local {
+			if err := s.variables.Local(name); err != nil {
+				fmt.Fprintf(stdio.Stderr, "%s: %v\n", cmd, err)
+				status = 1
+				continue
+			}
+		}
+
+		// readonly is applied last so that the assignment can happen.
+		readonly := false
+		failed := false
+		for _, attrs := range []struct {
+			flags   []rune
+			enabled bool
+		}{{enable, true}, {disable, false}} {
+			for _, flag := range attrs.flags {
+				if flag == 'r' && attrs.enabled {
+					readonly = true
+					continue
+				}
+				if err := s.variables.SetAttribute(name, flag, attrs.enabled); err != nil {
+					fmt.Fprintf(stdio.Stderr, "%s: %v\n", cmd, err)
+					failed = true
+				}
+			}
+		}
+
+		if assign && !failed {
+			if err := s.assignValue(name, value); err != nil {
+				fmt.Fprintf(stdio.Stderr, "%s: %v\n", cmd, err)
+				failed = true
+			}
+		}
+		if readonly {
+			s.variables.SetAttribute(name, 'r', true)
+		}
+		if failed {
+			status = 1
+		}
+	}
+
+	return status
+}
+
+// assignValue sets name to value, assigning an array when value is an
+// array literal such as (a b c) or ([key]=value).
+func (s *Shell) assignValue(name, value string) error {
+	if strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+		return s.variables.AssignCompound(name, parser.ArrayElements(value[1:len(value)-1], s.variables.Parameter))
+	}
+	return s.variables.Set(name, value)
+}
+
+// hasAttributes reports whether v has every declare attribute in flags.
+func hasAttributes(v *variables.Variable, flags []rune) bool {
+	for _, flag := range flags {
+		if !strings.ContainsRune(attributeFlags(v), flag) {
+			return false
+		}
+	}
+	return true
+}
+
+func attributeFlags(v *variables.Variable) string {
+	var flags strings.Builder
+	for _, attr := range []struct {
+		flag rune
+		set  bool
+	}{
+		{'a', v.Array},
+		{'A', v.Assoc},
+		{'i', v.Integer},
+		{'l', v.Lowercase},
+		{'r', v.ReadOnly},
+		{'u', v.Uppercase},
+		{'x', v.Exported},
+	} {
+		if attr.set {
+			flags.WriteRune(attr.flag)
+		}
+	}
+	return flags.String()
+}
+
+// declaration formats v the way declare -p prints it.
+func declaration(v *variables.Variable) string {
+	flags := attributeFlags(v)
+	if flags == "" {
+		flags = "-"
+	}
+
+	var value string
+	switch {
+	case v.Assoc:
+		keys := make([]string, 0, len(v.Map))
+		for key := range v.Map {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		var elems []string
+		for _, key := range keys {
+			elems = append(elems, fmt.Sprintf("[%s]=%s", quoteKey(key), quoteValue(v.Map[key])))
+		}
+		value = "(" + strings.Join(elems, " ") + ")"
+	case v.Array:
+		var elems []string
+		for i, elem := range v.Values {
+			elems = append(elems, fmt.Sprintf("[%d]=%s", i, quoteValue(elem)))
+		}
+		value = "(" + strings.Join(elems, " ") + ")"
+	default:
+		value = quoteValue(v.Value)
+	}
+
+	return fmt.Sprintf("declare -%s %s=%s", flags, v.Name, value)
+}
+
+// quoteKey quotes an associative array key unless it is made only of
+// characters that stand for themselves inside [ ].
+func quoteKey(key string) string {
+	if key != "" && strings.Trim(key, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_.,:+-/@%") == "" {
+		return key
+	}
+	return quoteValue(key)
+}
+
+// quoteValue double-quotes value, escaping the characters that are still
+// special inside double quotes.
+func quoteValue(value string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range value {
+		if strings.ContainsRune("\"\\$`", r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func (s *Shell) builtinUnset(stdio builtin.IO, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(stdio.Stderr, "unset: not enough arguments\n")
+		return 1
+	}
+
+	// -v only unsets variables and -f only functions; without either a
+	// name is a variable if one is set and a function otherwise.
+	vars, funcs := true, true
+	i := 0
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 'v':
+				vars, funcs = true, false
+			case 'f':
+				vars, funcs = false, true
+			default:
+				fmt.Fprintf(stdio.Stderr, "unset: -%c: invalid option\n", flag)
+				fmt.Fprintf(stdio.Stderr, "unset: usage: unset [-f] [-v] [name ...]\n")
+				return 2
+			}
+		}
+	}
+
+	for _, arg := range args[i:] {
+		if funcs && (!vars || !s.variables.IsSet(arg)) && s.executor.UnsetFunction(arg) {
+			continue
+		}
+		if !vars {
+			continue
+		}
+		if err := s.variables.Unset(arg); err != nil {
+			fmt.Fprintf(stdio.Stderr, "unset: %v\n", err)
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func (s *Shell) builtinSet(stdio builtin.IO, args []string) int {
+	if len(args) == 0 {
+		vars := s.variables.All()
+		var names []string
+		for name := range vars {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			v := vars[name]
+			fmt.Fprintf(stdio.Stdout, "%s=%s\n", name, v.Value)
+		}
+		return 0
+	}
+
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case strings.Contains(arg, "="):
+			parts := strings.SplitN(arg, "=", 2)
+			name, value := parts[0], parts[1]
+			s.assignValue(name, value)
+		case arg == "-o" || arg == "+o":
+			if i+1 >= len(args) {
+				s.printOptions(stdio, arg == "+o")
+				continue
+			}
+			i++
+			if !s.setOption(args[i], arg == "-o") {
+				fmt.Fprintf(stdio.Stderr, "set: %s: invalid option name\n", args[i])
+				return 1
+			}
+		case arg != "--" && len(arg) > 1 && (arg[0] == '-' || arg[0] == '+'):
+			for _, flag := range []byte(arg[1:]) {
+				name, ok := setFlags[flag]
+				if !ok {
+					fmt.Fprintf(stdio.Stderr, "set: %c%c: invalid option\n", arg[0], flag)
+					fmt.Fprintf(stdio.Stderr, "set: usage: set [-Cefux] [-o option] [--] [arg ...]\n")
+					return 2
+				}
+				s.setOption(name, arg[0] == '-')
+			}
+		default:
+			// The rest, after any --, are the new positional parameters.
+			if arg == "--" {
+				i++
+			}
+			s.setPositionalParams(s.variables.Get("0"), args[i:])
+			return 0
+		}
+	}
+
+	return 0
+}
+
+// setOptions returns the options set -o manages by name, each pointing
+// at the config field that holds it. emacs, the opposite of vi, is
+// handled apart.
+func (s *Shell) setOptions() map[string]*bool {
+	return map[string]*bool{
+		"errexit":   &s.config.ErrExit,
+		"noclobber": &s.config.NoClobber,
+		"noglob":    &s.config.NoGlob,
+		"nounset":   &s.config.NoUnset,
+		"pipefail":  &s.config.PipeFail,
+		"posix":     &s.config.POSIX,
+		"vi":        &s.config.ViMode,
+		"xtrace":    &s.config.XTrace,
+	}
+}
+
+// setFlags are the single-letter forms of set's options.
+var setFlags = map[byte]string{
+	'C': "noclobber",
+	'e': "errexit",
+	'f': "noglob",
+	'u': "nounset",
+	'x': "xtrace",
+}
+
+// setOption sets a named shell option for set -o and +o and reports
+// whether the name was recognized. lithist and huponexit, which belong
+// to shopt, are accepted too, as they were before shopt existed.
+func (s *Shell) setOption(name string, enabled bool) bool {
+	switch name {
+	case "emacs":
+		s.config.ViMode = !enabled
+	case "lithist", "huponexit":
+		*s.shoptOptions()[name] = enabled
+	default:
+		option := s.setOptions()[name]
+		if option == nil {
+			return false
+		}
+		*option = enabled
+	}
+	s.applyOptions()
+	return true
+}
+
+// printOptions lists the set -o options with their state, or with
+// commands set +o prints, as commands that restore them.
+func (s *Shell) printOptions(stdio builtin.IO, commands bool) {
+	options := s.setOptions()
+	emacs := !s.config.ViMode
+	options["emacs"] = &emacs
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		on := *options[name]
+		switch {
+		case commands && on:
+			fmt.Fprintf(stdio.Stdout, "set -o %s\n", name)
+		case commands:
+			fmt.Fprintf(stdio.Stdout, "set +o %s\n", name)
+		case on:
+			fmt.Fprintf(stdio.Stdout, "%-15s\ton\n", name)
+		default:
+			fmt.Fprintf(stdio.Stdout, "%-15s\toff\n", name)
+		}
+	}
+}
+
+// shoptOptions returns the options shopt manages by name, each pointing
+// at the config field that holds it.
+func (s *Shell) shoptOptions() map[string]*bool {
+	return map[string]*bool{
+		"dotglob":    &s.config.DotGlob,
+		"failglob":   &s.config.FailGlob,
+		"globstar":   &s.config.GlobStar,
+		"histappend": &s.config.HistoryAppend,
+		"huponexit":  &s.config.HupOnExit,
+		"lithist":    &s.config.LitHist,
+		"nocaseglob": &s.config.NoCaseGlob,
+		"nullglob":   &s.config.NullGlob,
+	}
+}
+
+// applyOptions passes the set and shopt options on to the parts of the
+// shell that read them from elsewhere than the config.
+func (s *Shell) applyOptions() {
+	s.executor.SetNoClobber(s.config.NoClobber)
+	s.executor.SetNoGlob(s.config.NoGlob)
+	s.executor.SetNoUnset(s.config.NoUnset)
+	s.executor.SetXTrace(s.config.XTrace)
+	s.executor.SetPipeFail(s.config.PipeFail)
+	s.readline.SetViMode(s.config.ViMode)
+	s.executor.SetGlobOptions(parser.GlobOptions{
+		GlobStar:   s.config.GlobStar,
+		NullGlob:   s.config.NullGlob,
+		FailGlob:   s.config.FailGlob,
+		DotGlob:    s.config.DotGlob,
+		NoCaseGlob: s.config.NoCaseGlob,
+	})
+	if s.interactive {
+		s.history.SetAppend(s.config.HistoryAppend)
+	}
+}
+
+func (s *Shell) builtinShopt(stdio builtin.IO, args []string) int {
+	var set, unset, quiet, print bool
+	i := 0
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 's':
+				set = true
+			case 'u':
+				unset = true
+			case 'q':
+				quiet = true
+			case 'p':
+				print = true
+			default:
+				fmt.Fprintf(stdio.Stderr, "shopt: -%c: invalid option\n", flag)
+				fmt.Fprintf(stdio.Stderr, "shopt: usage: shopt [-pqsu] [optname ...]\n")
+				return 2
+			}
+		}
+	}
+	if set && unset {
+		fmt.Fprintf(stdio.Stderr, "shopt: cannot set and unset shell options simultaneously\n")
+		return 1
+	}
+
+	options := s.shoptOptions()
+	names := args[i:]
+	for _, name := range names {
+		if options[name] == nil {
+			fmt.Fprintf(stdio.Stderr, "shopt: %s: invalid shell option name\n", name)
+			return 1
+		}
+	}
+
+	if (set || unset) && len(names) > 0 {
+		for _, name := range names {
+			*options[name] = set
+		}
+		s.applyOptions()
+		return 0
+	}
+
+	// Without names, list every option, or with -s or -u those that are
+	// on or off.
+	if len(names) == 0 {
+		for name, value := range options {
+			if !set && !unset || *value == set {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+	}
+
+	status := 0
+	for _, name := range names {
+		on := *options[name]
+		if !on {
+			status = 1
+		}
+		switch {
+		case quiet:
+		case print:
+			flag := "-u"
+			if on {
+				flag = "-s"
+			}
+			fmt.Fprintf(stdio.Stdout, "shopt %s %s\n", flag, name)
+		default:
+			state := "off"
+			if on {
+				state = "on"
+			}
+			fmt.Fprintf(stdio.Stdout, "%-15s\t%s\n", name, state)
+		}
+	}
+	if len(args[i:]) == 0 {
+		return 0
+	}
+	return status
+}
+
+// shellKeywords are the reserved words the parser recognizes.
+var shellKeywords = map[string]bool{
+	"if": true, "then": true, "elif": true, "else": true, "fi": true,
+	"while": true, "do": true, "done": true, "for": true, "in": true,
+	"case": true, "esac": true, "function": true, "{": true, "}": true,
+	"[[": true, "]]": true,
+}
+
+// commandType reports how name would be run: as a keyword, function,
+// builtin or file, with the path of a file. It returns "" if name is not
+// found.
+func (s *Shell) commandType(name string) (kind, path string) {
+	switch {
+	case shellKeywords[name]:
+		return "keyword", ""
+	case s.executor.IsFunction(name):
+		return "function", ""
+	case s.builtins.Get(name) != nil:
+		return "builtin", ""
+	}
+	if path, err := s.executor.LookPath(name); err == nil {
+		return "file", path
+	}
+	return "", ""
+}
+
+func (s *Shell) builtinType(stdio builtin.IO, args []string) int {
+	var kindOnly, pathOnly bool
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 't':
+				kindOnly = true
+			case 'p':
+				pathOnly = true
+			default:
+				fmt.Fprintf(stdio.Stderr, "type: -%c: invalid option\n", flag)
+				return 2
+			}
+		}
+		args = args[1:]
+	}
+
+	status := 0
+	for _, name := range args {
+		kind, path := s.commandType(name)
+		switch {
+		case kind == "":
+			if !kindOnly && !pathOnly {
+				fmt.Fprintf(stdio.Stderr, "type: %s: not found\n", name)
+			}
+			status = 1
+		case kindOnly:
+			fmt.Fprintln(stdio.Stdout, kind)
+		case pathOnly:
+			if path != "" {
+				fmt.Fprintln(stdio.Stdout, path)
+			}
+		default:
+			fmt.Fprintln(stdio.Stdout, describeCommand(name, kind, path))
+		}
+	}
+	return status
+}
+
+func describeCommand(name, kind, path string) string {
+	switch kind {
+	case "keyword":
+		return name + " is a shell keyword"
+	case "function":
+		return name + " is a function"
+	case "builtin":
+		return name + " is a shell builtin"
+	}
+	return name + " is " + path
+}
+
+func (s *Shell) builtinGetopts(stdio builtin.IO, args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintf(stdio.Stderr, "getopts: usage: getopts optstring name [arg ...]\n")
+		return 2
+	}
+
+	optstring, name, params := args[0], args[1], args[2:]
+	if len(args) == 2 {
+		params = s.positionalParams()
+	}
+	silent := strings.HasPrefix(optstring, ":")
+	if silent {
+		optstring = optstring[1:]
+	}
+
+	optind, err := strconv.Atoi(s.variables.Get("OPTIND"))
+	if err != nil || optind < 1 {
+		optind = 1
+	}
+	if optind != s.optind {
+		// The script reset OPTIND, so start at the front of an argument.
+		s.optpos = 0
+	}
+	defer func() {
+		s.optind = optind
+		s.variables.Set("OPTIND", strconv.Itoa(optind))
+	}()
+
+	if s.optpos == 0 {
+		if optind > len(params) {
+			s.variables.Set(name, "?")
+			return 1
+		}
+		arg := params[optind-1]
+		if arg == "--" {
+			optind++
+		}
+		if arg == "--" || len(arg) < 2 || arg[0] != '-' {
+			s.variables.Set(name, "?")
+			return 1
+		}
+		s.optpos = 1
+	}
+
+	arg := params[optind-1]
+	opt := arg[s.optpos]
+	s.optpos++
+	if s.optpos >= len(arg) {
+		optind++
+		s.optpos = 0
+	}
+
+	i := strings.IndexByte(optstring, opt)
+	if i < 0 || opt == ':' {
+		if silent {
+			s.variables.Set("OPTARG", string(opt))
+		} else {
+			fmt.Fprintf(stdio.Stderr, "getopts: illegal option -- %c\n", opt)
+			s.variables.Unset("OPTARG")
+		}
+		s.variables.Set(name, "?")
+		return 0
+	}
+
+	if i+1 >= len(optstring) || optstring[i+1] != ':' {
+		s.variables.Unset("OPTARG")
+		s.variables.Set(name, string(opt))
+		return 0
+	}
+
+	switch {
+	case s.optpos > 0:
+		// -bvalue: the rest of the argument is the value.
+		s.variables.Set("OPTARG", arg[s.optpos:])
+		optind++
+		s.optpos = 0
+	case optind <= len(params):
+		s.variables.Set("OPTARG", params[optind-1])
+		optind++
+	case silent:
+		s.variables.Set("OPTARG", string(opt))
+		s.variables.Set(name, ":")
+		return 0
+	default:
+		fmt.Fprintf(stdio.Stderr, "getopts: option requires an argument -- %c\n", opt)
+		s.variables.Unset("OPTARG")
+		s.variables.Set(name, "?")
+		return 0
+	}
+	s.variables.Set(name, string(opt))
+	return 0
+}
+
+// positionalParams returns $1 through $#.
+func (s *Shell) positionalParams() []string {
+	count, _ := strconv.Atoi(s.variables.Get("#"))
+	params := make([]string, count)
+	for i := range params {
+		params[i] = s.variables.Get(strconv.Itoa(i + 1))
+	}
+	return params
+}
+
+func (s *Shell) builtinCommand(stdio builtin.IO, args []string) int {
+	var printPath, verbose bool
+	for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+		if args[0] == "--" {
+			args = args[1:]
+			break
+		}
+		for _, flag := range args[0][1:] {
+			switch flag {
+			case 'v':
+				printPath = true
+			case 'V':
+				verbose = true
+			case 'p':
+			default:
+				fmt.Fprintf(stdio.Stderr, "command: -%c: invalid option\n", flag)
+				return 2
+			}
+		}
+		args = args[1:]
+	}
+
+	if len(args) == 0 {
+		return 0
+	}
+
+	if !printPath && !verbose {
+		return s.executor.RunCommand(stdio, args[0], args[1:])
+	}
+
+	status := 0
+	for _, name := range args {
+		kind, path := s.commandType(name)
+		switch {
+		case kind == "":
+			if verbose {
+				fmt.Fprintf(stdio.Stderr, "command: %s: not found\n", name)
+			}
+			status = 1
+		case verbose:
+			fmt.Fprintln(stdio.Stdout, describeCommand(name, kind, path))
+		case path != "":
+			fmt.Fprintln(stdio.Stdout, path)
+		default:
+			fmt.Fprintln(stdio.Stdout, name)
+		}
+	}
+	return status
+}
+
+func (s *Shell) builtinWhich(stdio builtin.IO, args []string) int {
+	all := false
+	if len(args) > 0 && args[0] == "-a" {
+		all = true
+		args = args[1:]
+	}
+
+	status := 0
+	for _, name := range args {
+		found := false
+		if strings.Contains(name, "/") {
+			if path, err := s.executor.LookPath(name); err == nil {
+				fmt.Fprintln(stdio.Stdout, path)
+				found = true
+			}
+		} else {
+			for _, dir := range filepath.SplitList(s.variables.Get("PATH")) {
+				path := filepath.Join(dir, name)
+				if info, err := os.Stat(path); err == nil && !info.IsDir() && info.Mode()&0111 != 0 {
+					fmt.Fprintln(stdio.Stdout, path)
+					found = true
+					if !all {
+						break
+					}
+				}
+			}
+		}
+		if !found {
+			status = 1
+		}
+	}
+	return status
+}
+
+func (s *Shell) builtinSource(stdio builtin.IO, args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(stdio.Stderr, "source: not enough arguments\n")
+		return 1
+	}
+
+	filename, ok := s.findSourceFile(args[0])
+	if !ok {
+		fmt.Fprintf(stdio.Stderr, "source: %s: No such file or directory\n", args[0])
+		return 1
+	}
+
+	// Arguments after the file become its positional parameters for as
+	// long as it runs.
+	if len(args) > 1 {
+		defer s.savePositionalParams(len(args) - 1)()
+		s.setPositionalParams(s.variables.Get("0"), args[1:])
+	}
+
+	if err := s.sourceFile(filename); err != nil {
+		fmt.Fprintf(stdio.Stderr, "source: %v\n", err)
+		return 1
+	}
+	return s.executor.GetLastExitCode()
+}
+
+// findSourceFile returns the file source reads for name. A name with a
+// slash is used as it is; any other is looked for in $PATH and then, as
+// bash does outside POSIX mode, in the current directory.
+func (s *Shell) findSourceFile(name string) (string, bool) {
+	if strings.Contains(name, "/") {
+		_, err := os.Stat(name)
+		return name, err == nil
+	}
+
+	path := s.variables.Get("PATH")
+	if path == "" {
+		path = "/usr/local/bin:/usr/bin:/bin"
+	}
+	for _, dir := range strings.Split(path, ":") {
+		fullPath := filepath.Join(dir, name)
+		if info, err := os.Stat(fullPath); err == nil && !info.IsDir() {
+			return fullPath, true
+		}
+	}
+
+	if s.posixMode() {
+		return name, false
+	}
+	_, err := os.Stat(name)
+	return name, err == nil
+}
+
+func (s *Shell) builtinJobs(stdio builtin.IO, args []string) int {
+	long, pids := false, false
+	list := s.jobs.List
+	i := 0
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		for _, flag := range args[i][1:] {
+			switch flag {
+			case 'l':
+				long = true
+			case 'p':
+				pids = true
+			case 'r':
+				list = s.jobs.Running
+			case 's':
+				list = s.jobs.Stopped
+			default:
+				fmt.Fprintf(stdio.Stderr, "jobs: -%c: invalid option\n", flag)
+				fmt.Fprintf(stdio.Stderr, "jobs: usage: jobs [-lprs] [jobspec ...]\n")
+				return 2
+			}
+		}
+	}
+
+	status := 0
+	jobs := list()
+	if i < len(args) {
+		jobs = nil
+		for _, spec := range args[i:] {
+			job, err := s.jobs.Resolve(spec)
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "jobs: %v\n", err)
+				status = 1
+				continue
+			}
+			jobs = append(jobs, job)
+		}
+	}
+
+	if pids {
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].ID < jobs[j].ID })
+		for _, job := range jobs {
+			if job.PID != 0 {
+				fmt.Fprintln(stdio.Stdout, job.PID)
+			}
+		}
+		return status
+	}
+	s.jobs.Print(stdio.Stdout, jobs, long)
+	return status
+}
+
+func (s *Shell) builtinWait(stdio builtin.IO, args []string) int {
+	if len(args) == 0 {
+		s.jobs.Wait()
+		return 0
+	}
+
+	status := 0
+	for _, arg := range args {
+		var job *jobs.Job
+		if strings.HasPrefix(arg, "%") {
+			var err error
+			if job, err = s.jobs.Resolve(arg); err != nil {
+				fmt.Fprintf(stdio.Stderr, "wait: %v\n", err)
+				status = 127
+				continue
+			}
+		} else {
+			pid, err := strconv.Atoi(arg)
+			if err != nil {
+				fmt.Fprintf(stdio.Stderr, "wait: `%s': not a pid or valid job spec\n", arg)
+				status = 2
+				continue
+			}
+			if job = s.jobs.GetByPID(pid); job == nil {
+				fmt.Fprintf(stdio.Stderr, "wait: pid %d is not a child of this shell\n", pid)
+				status = 127
+				continue
+			}
+		}
+
+		status, _ = s.jobs.WaitJob(job.ID)
+	}
+	return status
+}
+
+func (s *Shell) builtinFG(stdio builtin.IO, args []string) int {
+	spec := "%+"
+	if len(args) > 0 {
+		spec = args[0]
+	}
+
+	job, err := s.jobs.Resolve(spec)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "fg: %v\n", err)
+		return 1
+	}
+
+	if state := s.jobs.State(job.ID); state == jobs.JobDone || state == jobs.JobKilled {
+		fmt.Fprintf(stdio.Stderr, "fg: job %d has terminated\n", job.ID)
+		return 1
+	}
+
+	fmt.Fprintln(stdio.Stdout, job.Command)
+
+	// A job with a process has a process group of its own. While it is
+	// in the foreground it has the terminal, and a SIGINT sent to the
+	// shell is passed on to it as it is to any foreground command.
+	if job.Cmd != nil {
+		defer s.giveTerminal(job.PID)()
+		defer s.executor.TrackForeground(job.Cmd)()
+	}
+	if err := s.jobs.Foreground(job.ID); err != nil {
+		fmt.Fprintf(stdio.Stderr, "fg: %v\n", err)
+		return 1
+	}
+
+	status, _ := s.jobs.WaitJob(job.ID)
+	return status
+}
+
+// giveTerminal makes the process group pgid the terminal's foreground
+// group and returns the function that gives the terminal back to the
+// shell. Without a terminal it does nothing.
+func (s *Shell) giveTerminal(pgid int) func() {
+	if !s.interactive || !s.terminal {
+		return func() {}
+	}
+	fd, shell := int(os.Stdin.Fd()), unix.Getpgrp()
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, pgid); err != nil {
+		return func() {}
+	}
+
+	return func() {
+		// Until it has the terminal back the shell is in the background,
+		// where asking for it would stop the shell with SIGTTOU.
+		signal.Ignore(syscall.SIGTTOU)
+		defer signal.Reset(syscall.SIGTTOU)
+		unix.IoctlSetPointerInt(fd, unix.TIOCSPGRP, shell)
+	}
+}
+
+func (s *Shell) builtinBG(stdio builtin.IO, args []string) int {
+	if len(args) == 0 {
+		args = []string{"%+"}
+	}
+
+	status := 0
+	for _, spec := range args {
+		job, err := s.jobs.Resolve(spec)
+		if err == nil {
+			err = s.jobs.Background(job.ID)
+		}
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "bg: %v\n", err)
+			status = 1
+			continue
+		}
+		fmt.Fprintf(stdio.Stdout, "[%d]+ %s &\n", job.ID, job.Command)
+	}
+
+	return status
+}
+
+func (s *Shell) builtinKill(stdio builtin.IO, args []string) int {
+	usage := func() int {
+		fmt.Fprintf(stdio.Stderr, "kill: usage: kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]\n")
+		return 2
+	}
+
+	sig := syscall.SIGTERM
+	i := 0
+	if len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		spec := ""
+		switch args[0] {
+		case "--":
+			i = 1
+		case "-l", "-L":
+			return s.listSignals(stdio, args[1:])
+		case "-s", "-n":
+			if len(args) < 2 {
+				fmt.Fprintf(stdio.Stderr, "kill: %s: option requires an argument\n", args[0])
+				return usage()
+			}
+			spec, i = args[1], 2
+		default:
+			spec, i = args[0][1:], 1
+		}
+		if spec != "" {
+			var ok bool
+			if sig, ok = jobs.ParseSignal(spec); !ok {
+				fmt.Fprintf(stdio.Stderr, "kill: %s: invalid signal specification\n", spec)
+				return 1
+			}
+			if i < len(args) && args[i] == "--" {
+				i++
+			}
+		}
+	}
+	if i >= len(args) {
+		return usage()
+	}
+
+	status := 0
+	for _, arg := range args[i:] {
+		var err error
+		if strings.HasPrefix(arg, "%") {
+			var job *jobs.Job
+			if job, err = s.jobs.Resolve(arg); err == nil {
+				err = s.jobs.Signal(job.ID, sig)
+			}
+		} else if pid, convErr := strconv.Atoi(arg); convErr != nil {
+			err = fmt.Errorf("%s: arguments must be process or job IDs", arg)
+		} else if job := s.jobs.GetByPID(pid); job != nil {
+			err = s.jobs.Signal(job.ID, sig)
+		} else {
+			// A negative PID names a process group.
+			err = syscall.Kill(pid, sig)
+			if err != nil {
+				err = fmt.Errorf("(%d) - %v", pid, err)
+			}
+		}
+
+		if err != nil {
+			fmt.Fprintf(stdio.Stderr, "kill: %v\n", err)
+			status = 1
+		}
+	}
+
+	return status
+}
+
+// listSignals is kill -l. With no arguments it lists the signals as bash
+// does; otherwise it turns each name into its number and each number,
+// or exit status of a process killed by a signal, into its name.
+func (s *Shell) listSignals(stdio builtin.IO, args []string) int {
+	if len(args) == 0 {
+		signals := jobs.Signals()
+		for i, sig := range signals {
+			sep := "\t"
+			if (i+1)%5 == 0 || i == len(signals)-1 {
+				sep = "\n"
+			}
+			fmt.Fprintf(stdio.Stdout, "%2d) SIG%s%s", int(sig), jobs.SignalName(sig), sep)
+		}
+		return 0
+	}
+
+	status := 0
+	for _, arg := range args {
+		if n, err := strconv.Atoi(arg); err == nil {
+			if n > 128 {
+				n -= 128
+			}
+			if name := jobs.SignalName(syscall.Signal(n)); name != strconv.Itoa(n) {
+				fmt.Fprintln(stdio.Stdout, name)
+				continue
+			}
+		} else if sig, ok := jobs.ParseSignal(arg); ok {
+			fmt.Fprintln(stdio.Stdout, int(sig))
+			continue
+		}
+		fmt.Fprintf(stdio.Stderr, "kill: %s: invalid signal specification\n", arg)
+		status = 1
+	}
+	return status
+}
+
+func (s *Shell) builtinBracket(stdio builtin.IO, args []string) int {
+	if len(args) == 0 || args[len(args)-1] != "]" {
+		fmt.Fprintf(stdio.Stderr, "[: missing ']'\n")
+		return 2
+	}
+	return s.test(stdio, "[", args[:len(args)-1])
+}
+
+func (s *Shell) builtinTest(stdio builtin.IO, args []string) int {
+	return s.test(stdio, "test", args)
+}
+
+// test evaluates a test expression, returning 0 if it is true, 1 if it is
+// false and 2 on error.
+func (s *Shell) test(stdio builtin.IO, name string, args []string) int {
+	result, err := evalTest(args)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "%s: %v\n", name, err)
+		return 2
+	}
+	if result {
+		return 0
+	}
+	return 1
+}
+
+// evalTest follows the POSIX test algorithm, which decides by the number
+// of arguments how to read them, so that operands looking like operators
+// (as in [ "-f" = "-f" ]) are still compared. Five or more arguments are
+// parsed as an expression with !, -a, -o and parentheses.
+func evalTest(args []string) (bool, error) {
+	switch len(args) {
+	case 0:
+		return false, nil
+	case 1:
+		return args[0] != "", nil
+	case 2:
+		if args[0] == "!" {
+			return args[1] == "", nil
+		}
+		if conditional.IsUnary(args[0]) {
+			return conditional.Unary(args[0], args[1])
+		}
+		return false, fmt.Errorf("%s: unary operator expected", args[0])
+	case 3:
+		if conditional.IsBinary(args[1]) {
+			return conditional.Binary(args[0], args[1], args[2])
+		}
+		if args[0] == "!" {
+			result, err := evalTest(args[1:])
+			return !result, err
+		}
+		if args[0] == "(" && args[2] == ")" {
+			return args[1] != "", nil
+		}
+		return false, fmt.Errorf("%s: binary operator expected", args[1])
+	case 4:
+		if args[0] == "!" {
+			result, err := evalTest(args[1:])
+			return !result, err
+		}
+		if args[0] == "(" && args[3] == ")" {
+			return evalTest(args[1:3])
+		}
+	}
+
+	t := &testParser{args: args}
+	result, err := t.or()
+	if err == nil && t.pos < len(t.args) {
+		err = fmt.Errorf("%s: unexpected argument", t.args[t.pos])
+	}
+	return result, err
+}
+
+// testParser parses the long form of a test expression:
+// or := and { -o and }, and := not { -a not }, not := ! not | primary.
+type testParser struct {
+	args []string
+	pos  int
+}
+
+func (t *testParser) or() (bool, error) {
+	result, err := t.and()
+	for err == nil && t.pos < len(t.args) && t.args[t.pos] == "-o" {
+		t.pos++
+		var right bool
+		right, err = t.and()
+		result = result || right
+	}
+	return result, err
+}
+
+func (t *testParser) and() (bool, error) {
+	result, err := t.not()
+	for err == nil && t.pos < len(t.args) && t.args[t.pos] == "-a" {
+		t.pos++
+		var right bool
+		right, err = t.not()
+		result = result && right
+	}
+	return result, err
+}
+
+func (t *testParser) not() (bool, error) {
+	if t.pos < len(t.args) && t.args[t.pos] == "!" {
+		t.pos++
+		result, err := t.not()
+		return !result, err
+	}
+	return t.primary()
+}
+
+func (t *testParser) primary() (bool, error) {
+	rest := t.args[t.pos:]
+	switch {
+	case len(rest) == 0:
+		return false, fmt.Errorf("argument expected")
+	case len(rest) >= 3 && conditional.IsBinary(rest[1]):
+		t.pos += 3
+		return conditional.Binary(rest[0], rest[1], rest[2])
+	case rest[0] == "(":
+		t.pos++
+		result, err := t.or()
+		if err != nil {
+			return false, err
+		}
+		if t.pos >= len(t.args) || t.args[t.pos] != ")" {
+			return false, fmt.Errorf("')' expected")
+		}
+		t.pos++
+		return result, nil
+	case len(rest) >= 2 && conditional.IsUnary(rest[0]):
+		t.pos += 2
+		return conditional.Unary(rest[0], rest[1])
+	}
+	t.pos++
+	return rest[0] != "", nil
+}
+
+func (s *Shell) builtinComplete(stdio builtin.IO, args []string) int {
+	spec := &readline.CompletionSpec{}
+	print, remove := false, false
+	i := 0
+	for ; i < len(args) && len(args[i]) > 1 && args[i][0] == '-'; i++ {
+		if args[i] == "--" {
+			i++
+			break
+		}
+		flags := args[i][1:]
+		for j := 0; j < len(flags); j++ {
+			switch flags[j] {
+			case 'p':
+				print = true
+			case 'r':
+				remove = true
+			case 'f':
+				spec.Files = true
+			case 'd':
+				spec.Dirs = true
+			case 'W', 'F':
+				// The argument is the rest of the word, or the next one.
+				value := flags[j+1:]
+				if value == "" {
+					if i+1 >= len(args) {
+						fmt.Fprintf(stdio.Stderr, "complete: -%c: option requires an argument\n", flags[j])
+						return 2
+					}
+					i++
+					value = args[i]
+				}
+				if flags[j] == 'W' {
+					spec.Words = strings.Fields(value)
+				} else {
+					spec.Function = value
+				}
+				j = len(flags)
+			default:
+				fmt.Fprintf(stdio.Stderr, "complete: -%c: invalid option\n", flags[j])
+				fmt.Fprintf(stdio.Stderr, "complete: usage: complete [-fdpr] [-W wordlist] [-F function] [name ...]\n")
+				return 2
+			}
+		}
+	}
+
+	names := args[i:]
+	specs := s.readline.CompletionSpecs()
+	if remove || print || len(names) == 0 {
+		if len(names) == 0 {
+			for name := range specs {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+		}
+		status := 0
+		for _, name := range names {
+			if remove {
+				s.readline.SetCompletionSpec(name, nil)
+				continue
+			}
+			spec := specs[name]
+			if spec == nil {
+				fmt.Fprintf(stdio.Stderr, "complete: %s: no completion specification\n", name)
+				status = 1
+				continue
+			}
+			line := "complete"
+			if spec.Files {
+				line += " -f"
+			}
+			if spec.Dirs {
+				line += " -d"
+			}
+			if spec.Words != nil {
+				line += " -W " + quoteValue(strings.Join(spec.Words, " "))
+			}
+			if spec.Function != "" {
+				line += " -F " + spec.Function
+			}
+			fmt.Fprintf(stdio.Stdout, "%s %s\n", line, name)
+		}
+		return status
+	}
+
+	for _, name := range names {
+		s.readline.SetCompletionSpec(name, spec)
+	}
+	return 0
+}
+
+func (s *Shell) builtinExec(stdio builtin.IO, args []string) int {
+	if len(args) > 0 && s.embedded {
+		fmt.Fprintf(stdio.Stderr, "exec: cannot replace the process of an embedded shell\n")
+		return 1
+	}
+
+	status, err := s.executor.Exec(args)
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "exec: %v\n", err)
+		if len(args) > 0 && !s.interactive {
+			s.Exit(status)
+		}
+	}
+	return status
+}
+
+func (s *Shell) builtinTimeout(stdio builtin.IO, args []string) int {
+	if len(args) < 2 {
+		fmt.Fprintf(stdio.Stderr, "timeout: usage: timeout DURATION command [args...]\n")
+		return 125
+	}
+
+	timeout, err := parseDuration(args[0])
+	if err != nil {
+		fmt.Fprintf(stdio.Stderr, "timeout: invalid time interval '%s'\n", args[0])
+		return 125
+	}
+
+	return s.executor.RunWithTimeout(stdio, args[1], args[2:], timeout)
+}
+
+// parseDuration accepts the GNU timeout forms: a number of seconds with
+// an optional s, m, h or d suffix.
+func parseDuration(arg string) (time.Duration, error) {
+	unit := time.Second
+	switch {
+	case strings.HasSuffix(arg, "s"):
+		arg = arg[:len(arg)-1]
+	case strings.HasSuffix(arg, "m"):
+		unit = time.Minute
+		arg = arg[:len(arg)-1]
+	case strings.HasSuffix(arg, "h"):
+		unit = time.Hour
+		arg = arg[:len(arg)-1]
+	case strings.HasSuffix(arg, "d"):
+		unit = 24 * time.Hour
+		arg = arg[:len(arg)-1]
+	}
+
+	n, err := strconv.ParseFloat(arg, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid duration")
+	}
+	return time.Duration(n * float64(unit)), nil
 }
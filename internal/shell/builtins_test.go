@@ -0,0 +1,385 @@
+package shell
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDeclarePrintRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup string
+	}{
+		{"indexed array", `declare -a v=(a "b\"c" 'd$e' "f\\g" "h i" '` + "`j`" + `')`},
+		{"associative array", `declare -A v=([k]="v w" [q]='x"y' [r]="\$z")`},
+		{"integer", `declare -i v=5`},
+		{"exported integer", `declare -ix v=7`},
+		{"exported readonly integer array", `declare -rxai v=(1 2 3)`},
+		{"lower case", `declare -l v=ABC`},
+		{"upper case", `declare -u v=abc`},
+		{"exported", `export v="p q"`},
+		{"readonly", `readonly v='r"o'`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dump, code := runScript(t, tt.setup+"\ndeclare -p v")
+			if code != 0 || dump == "" {
+				t.Fatalf("declare -p failed with status %d", code)
+			}
+
+			file := writeFile(t, t.TempDir(), "dump.sh", dump)
+			again, code := runScript(t, ". "+file+"\ndeclare -p v")
+			if code != 0 {
+				t.Fatalf("sourcing %q failed with status %d", dump, code)
+			}
+			if again != dump {
+				t.Errorf("declare -p after sourcing the dump printed\n%s\nwant\n%s", again, dump)
+			}
+		})
+	}
+}
+
+func TestComplete(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "file", "")
+	if err := os.Mkdir(filepath.Join(dir, "folder"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		setup string
+		line  string
+		want  []string
+	}{
+		{"word list", `complete -W "start stop restart" myservice`, "myservice st", []string{"start", "stop"}},
+		{"word list, new word", `complete -W "start stop" myservice`, "myservice ", []string{"start", "stop"}},
+		{"directories", "complete -d cdx", "cdx " + dir + "/f", []string{dir + "/folder/"}},
+		{"files", "complete -f cat", "cat " + dir + "/f", []string{dir + "/file", dir + "/folder/"}},
+		{"function", `_f() { COMPREPLY=("$1" "$2" "$3"); }; complete -F _f tool`, "tool one tw", []string{"tool", "tw", "one"}},
+		{"removed", `complete -W "start" myservice; complete -r myservice`, "myservice " + dir + "/n", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, stderr := newTestShell(t)
+			if code, _ := s.RunString(tt.setup); code != 0 {
+				t.Fatalf("setup failed with status %d: %s", code, stderr)
+			}
+			if got := s.readline.Complete(tt.line); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Complete(%q) = %q, want %q", tt.line, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIFS(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"read with a prefix", `IFS=, read a b c <<< "x,y,z"; echo "$a|$b|$c"`, "x|y|z\n"},
+		{"prefix does not stay", `IFS=, read a b <<< "1,2"; read c d <<< "3,4 5"; echo "$a $b|$c|$d"`, "1 2|3,4|5\n"},
+		{"read between changes", `read a b <<< "x,y z"; echo "$a|$b"; IFS=,; read a b <<< "x,y z"; echo "$a|$b"`, "x,y|z\nx|y z\n"},
+		{"last name takes the rest", `IFS=: read a b <<< "p:q:r"; echo "$a|$b"`, "p|q:r\n"},
+		{"for between changes", `v="a:b c"; IFS=:; for w in $v; do echo "[$w]"; done; IFS=" "; for w in $v; do echo "[$w]"; done`, "[a]\n[b c]\n[a:b]\n[c]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestExportScoping(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"export in a function is global", `f() { export A=1; }; f; sh -c 'echo "[$A]"'`, "[1]\n"},
+		{"local is not exported", `f() { local B=2; sh -c 'echo "[$B]"'; }; f`, "[]\n"},
+		{"local -x is exported in the function", `f() { local -x C=3; sh -c 'echo "[$C]"'; }; f; sh -c 'echo "[$C]"'`, "[3]\n[]\n"},
+		{"declare -x is local to the function", `f() { declare -x E=5; sh -c 'echo "[$E]"'; }; f; sh -c 'echo "[$E]"'`, "[5]\n[]\n"},
+		{"export reaches the caller's local", `g() { export D=4; }; f() { local D=0; g; sh -c 'echo "[$D]"'; }; f; sh -c 'echo "[$D]"'`, "[4]\n[]\n"},
+		{"export in a nested function", `f() { g() { export F=6; }; g; }; f; sh -c 'echo "[$F]"'`, "[6]\n"},
+		{"export of a global from a function", `G=7; f() { export G; }; f; sh -c 'echo "[$G]"'`, "[7]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestExec(t *testing.T) {
+	dir := t.TempDir()
+	log := filepath.Join(dir, "log")
+	bad := writeFile(t, dir, "bad", "\x00\x01not a program\n")
+	if err := os.Chmod(bad, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// The redirects apply before the command is looked for, so the
+	// error of a failed exec goes to them, as in bash.
+	tests := []struct {
+		name   string
+		src    string
+		stdout string
+		stderr string
+		code   int
+		log    string // a part of what is written to the log
+	}{
+		{"replace", `exec sh -c 'echo out; echo err >&2; exit 3' > "$L" 2>&1; echo not reached`, "", "", 3, "out\nerr\n"},
+		{"not found", `exec /nonexistent/cmd > "$L" 2>&1; echo not reached`, "", "", 127, "exec: /nonexistent/cmd: "},
+		{"cannot run", `exec "$B" > "$L" 2>&1; echo not reached`, "", "", 126, "exec: " + bad + ": "},
+		{"redirects only", `exec > "$L"; echo to log; echo to stderr >&2`, "", "to stderr\n", 0, "to log\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(log)
+			stdout, stderr, code := runProcess(t, "L='"+log+"'; B='"+bad+"'; "+tt.src)
+			if stdout != tt.stdout || stderr != tt.stderr || code != tt.code {
+				t.Errorf("got %q, %q, %d; want %q, %q, %d", stdout, stderr, code, tt.stdout, tt.stderr, tt.code)
+			}
+			if content, _ := os.ReadFile(log); !strings.Contains(string(content), tt.log) {
+				t.Errorf("the log holds %q, want %q in it", content, tt.log)
+			}
+		})
+	}
+}
+
+func TestUnset(t *testing.T) {
+	const (
+		setup = "f=var; f() { echo func; }; "
+		check = "; declare -p f >/dev/null 2>&1 && echo var; f 2>/dev/null; true"
+	)
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"nothing", setup + ":" + check, "var\nfunc\n"},
+		{"bare removes the variable first", setup + "unset f" + check, "func\n"},
+		{"bare twice removes both", setup + "unset f; unset f" + check, ""},
+		{"-v", setup + "unset -v f" + check, "func\n"},
+		{"-f", setup + "unset -f f" + check, "var\n"},
+		{"-f and -v", setup + "unset -f f; unset -v f" + check, ""},
+		{"bare removes a function", "g() { echo g; }; unset g; g 2>/dev/null; echo $?", "127\n"},
+		{"-- ends the options", "x=1; unset -- x; declare -p x >/dev/null 2>&1; echo $?", "1\n"},
+		{"invalid option", "unset -x a; echo $?", "2\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestGlobOptions(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a.go", "1.go", "d/b.go", "d/e/c.go"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, dir, name, "")
+	}
+
+	tests := []struct {
+		name   string
+		src    string
+		stdout string
+		code   int
+	}{
+		{"no match stays", `echo *.none`, "*.none\n", 0},
+		{"nullglob", `shopt -s nullglob; echo x *.none y`, "x y\n", 0},
+		{"nullglob loop", `shopt -s nullglob; for f in *.none; do echo $f; done; echo done`, "done\n", 0},
+		{"failglob", "shopt -s failglob\necho *.none\necho $?", "1\n", 0},
+		{"failglob with a match", `shopt -s failglob; echo *.go`, "1.go a.go\n", 0},
+		{"classes", `echo [[:alpha:]].go [[:digit:]].go [!a].go`, "a.go 1.go 1.go\n", 0},
+		{"** without globstar", `echo **/*.go`, "d/b.go\n", 0},
+		{"globstar", `shopt -s globstar; echo **/*.go`, "1.go a.go d/b.go d/e/c.go\n", 0},
+		{"globstar off again", `shopt -s globstar; shopt -u globstar; echo **/*.go`, "d/b.go\n", 0},
+		{"globstar in POSIX mode", `set -o posix; shopt -s globstar; echo **/*.go`, "d/b.go\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, code := runProcess(t, "cd '"+dir+"' && "+tt.src)
+			if stdout != tt.stdout || code != tt.code {
+				t.Errorf("got %q, %d, want %q, %d", stdout, code, tt.stdout, tt.code)
+			}
+		})
+	}
+}
+
+func TestDirStackLogical(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "real"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("real", filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+
+	tests := []struct {
+		name   string
+		src    string
+		stdout string
+	}{
+		{"pushd", `pushd / >/dev/null; dirs`, "/ " + link + "\n"},
+		{"popd", `pushd / >/dev/null; popd >/dev/null; echo "$PWD"`, link + "\n"},
+		{"pushd swap", `pushd / >/dev/null; pushd >/dev/null; echo "$PWD"; dirs`, link + "\n" + link + " /\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, _, _ := runProcess(t, "cd '"+link+"' && "+tt.src)
+			if stdout != tt.stdout {
+				t.Errorf("got %q, want %q", stdout, tt.stdout)
+			}
+		})
+	}
+}
+
+func TestSource(t *testing.T) {
+	dir := t.TempDir()
+	for _, sub := range []string{"bin", "sub"} {
+		if err := os.Mkdir(filepath.Join(dir, sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, dir, "setup.sh", "echo setup; X=1\n")
+	writeFile(t, dir, "both.sh", "echo here\n")
+	writeFile(t, dir, "local.sh", "echo local\n")
+	writeFile(t, dir, "bin/both.sh", "echo path\n")
+	writeFile(t, dir, "sub/nested.sh", "echo nested\n")
+
+	tests := []struct {
+		name   string
+		src    string
+		stdout string
+		stderr string
+	}{
+		{"./ path", `source ./setup.sh; echo $X`, "setup\n1\n", ""},
+		{"dot", `. ./setup.sh; echo $?`, "setup\n0\n", ""},
+		{"relative path", `source sub/nested.sh`, "nested\n", ""},
+		{"parent path", `cd sub && source ../setup.sh`, "setup\n", ""},
+		{"$PATH first", `PATH="$PWD/bin:$PATH"; source both.sh`, "path\n", ""},
+		{"current directory after $PATH", `PATH="$PWD/bin:$PATH"; source local.sh`, "local\n", ""},
+		{"a path is not searched", `PATH="$PWD/bin:$PATH"; source ./both.sh`, "here\n", ""},
+		{"missing path", `source ./missing.sh; echo $?`, "1\n", "source: ./missing.sh: No such file or directory\n"},
+		{"missing name", `source missing.sh; echo $?`, "1\n", "source: missing.sh: No such file or directory\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, _ := runProcess(t, "cd '"+dir+"' && "+tt.src)
+			if stdout != tt.stdout {
+				t.Errorf("stdout: got %q, want %q", stdout, tt.stdout)
+			}
+			if stderr != tt.stderr {
+				t.Errorf("stderr: got %q, want %q", stderr, tt.stderr)
+			}
+		})
+	}
+}
+
+func TestHistory(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		stdout string
+		file   string
+	}{
+		{"list", `history`, "   1  a\n   2  b\n   3  c\n", ""},
+		{"last n", `history 2`, "   2  b\n   3  c\n", ""},
+		{"delete", `history -d 2; history`, "   1  a\n   2  c\n", ""},
+		{"delete from the end", `history -d -1; history`, "   1  a\n   2  b\n", ""},
+		{"delete out of range", `history -d 9; echo $?; history`, "1\n   1  a\n   2  b\n   3  c\n", ""},
+		{"clear", `history -c; history`, "", ""},
+		{"write to another file", `history -w "$F"`, "", "a\nb\nc\n"},
+		{"write after a delete", `history -d 1; history -w "$F"`, "", "b\nc\n"},
+		{"read back", `history -w "$F"; history -c; history -r "$F"; history`, "   1  a\n   2  b\n   3  c\n", "a\nb\nc\n"},
+		{"append only new", `history -a "$F"; history -a "$F"`, "", "a\nb\nc\n"},
+		{"one of -arw", `history -a -w "$F"; echo $?`, "1\n", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "history")
+			s, stdout, stderr := newTestShell(t)
+			for _, command := range []string{"a", "b", "c"} {
+				s.history.Add(command)
+			}
+
+			if _, err := s.RunString("F='" + file + "'; " + tt.src); err != nil {
+				t.Fatalf("%v: %s", err, stderr)
+			}
+			if stdout.String() != tt.stdout {
+				t.Errorf("stdout: got %q, want %q", stdout, tt.stdout)
+			}
+			content, _ := os.ReadFile(file)
+			if string(content) != tt.file {
+				t.Errorf("the file holds %q, want %q", content, tt.file)
+			}
+		})
+	}
+}
+
+func TestFGForwardsInterrupt(t *testing.T) {
+	s, _, stderr := newTestShell(t)
+	if _, err := s.RunString("sleep 30 &"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan int)
+	go func() {
+		code, _ := s.RunString("fg")
+		done <- code
+	}()
+
+	// fg tracks the job once it has it in the foreground; until then
+	// there is nothing to interrupt.
+	deadline := time.After(5 * time.Second)
+	for !s.executor.SignalForeground(syscall.SIGINT) {
+		select {
+		case <-deadline:
+			t.Fatal("the job never came to the foreground")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	select {
+	case code := <-done:
+		if code != 130 {
+			t.Errorf("fg returned %d, want 130: %s", code, stderr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the job was not interrupted")
+	}
+}
+
+// TestHelpOneOptionPerLine checks that help lines up, with each option
+// described on a line of its own.
+func TestHelpOneOptionPerLine(t *testing.T) {
+	s, _, _ := newTestShell(t)
+	second := regexp.MustCompile(`^-\w .*\s-\w\s`)
+	for _, name := range s.builtins.List() {
+		help, _ := s.builtins.Help(name)
+		for _, line := range help.Long {
+			if second.MatchString(line) {
+				t.Errorf("help %s: %q describes more than one option", name, line)
+			}
+		}
+	}
+}
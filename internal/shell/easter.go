@@ -10,19 +10,19 @@ import (
 )
 
 func registerEaster(b *builtin.Manager) {
-	b.Register("gosha", func(args []string) int {
-		fmt.Printf("Это не смешно!\n")
+	b.Register("gosha", func(stdio builtin.IO, args []string) int {
+		fmt.Fprintf(stdio.Stdout, "Это не смешно!\n")
 		return 0
 	})
 
-	b.Register("bash", func(args []string) int {
-		fmt.Printf("Bash is too old.\n")
+	b.Register("bash", func(stdio builtin.IO, args []string) int {
+		fmt.Fprintf(stdio.Stdout, "Bash is too old.\n")
 		return 0
 	})
 
-	b.Register("ohmy", func(args []string) int {
+	b.Register("ohmy", func(stdio builtin.IO, args []string) int {
 		path, _ := os.Executable()
-		fmt.Printf("%s\n", path)
+		fmt.Fprintf(stdio.Stdout, "%s\n", path)
 		return 0
 	})
 }
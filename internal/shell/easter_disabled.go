@@ -3,6 +3,8 @@
 
 package shell
 
-import "gosh/internal/builtin"
+import (
+	"gosh/internal/builtin"
+)
 
 func registerEaster(b *builtin.Manager) {}
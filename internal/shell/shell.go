@@ -2,15 +2,21 @@ package shell
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
+	"gosh/internal/ast"
 	"gosh/internal/builtin"
 	"gosh/internal/config"
 	"gosh/internal/executor"
@@ -20,6 +26,8 @@ import (
 	"gosh/internal/prompt"
 	"gosh/internal/readline"
 	"gosh/internal/variables"
+
+	"golang.org/x/term"
 )
 
 type Shell struct {
@@ -38,15 +46,53 @@ type Shell struct {
 	exitCode    int
 	running     bool
 
+	// terminal is set when stdin is a terminal. Without one, even a
+	// shell made interactive with -i neither prompts nor edits lines.
+	terminal bool
+
 	currentDir string
+	dirStack   []string
 	startTime  time.Time
+	lineno     int
+
+	// sourcing counts the source builtins running, in which return is
+	// allowed outside functions.
+	sourcing int
+
+	// getopts state: OPTIND as getopts last set it, and the position of
+	// the next option letter within a cluster like -abc.
+	optind int
+	optpos int
 
-	sigChan chan os.Signal
+	sigChan  chan os.Signal
+	embedded bool
+}
+
+// Options configures a Shell created with NewWithOptions.
+type Options struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Env is the starting environment in os.Environ form. A nil Env
+	// inherits the environment of the current process.
+	Env []string
+
+	// Embedded shells never call os.Exit and install no signal handlers,
+	// so they are safe to run inside another program.
+	Embedded bool
 }
 
 func New() *Shell {
+	return NewWithOptions(Options{})
+}
+
+func NewWithOptions(opts Options) *Shell {
 	config := config.New()
 	vars := variables.New()
+	if opts.Env != nil {
+		vars = variables.NewWithEnv(opts.Env)
+	}
 
 	shell := &Shell{
 		config:    config,
@@ -63,14 +109,39 @@ func New() *Shell {
 		running:     true,
 		startTime:   time.Now(),
 		sigChan:     make(chan os.Signal, 1),
+		embedded:    opts.Embedded,
 	}
 
 	shell.executor = executor.New(shell.variables, shell.builtins, shell.jobs)
+	shell.parser.SetPOSIX(shell.posixMode)
+	shell.executor.SetPOSIX(shell.posixMode)
+	shell.executor.SetTerminal(shell.giveTerminal)
 	shell.readline = readline.New(shell.history)
+	shell.readline.SetCompletionCallback(shell.completeCommand)
+	shell.readline.SetFunctionCallback(shell.completeFunction)
+
+	stdin, stdout, stderr := io.Reader(os.Stdin), io.Writer(os.Stdout), io.Writer(os.Stderr)
+	if opts.Stdin != nil {
+		stdin = opts.Stdin
+	}
+	if opts.Stdout != nil {
+		stdout = opts.Stdout
+	}
+	if opts.Stderr != nil {
+		stderr = opts.Stderr
+	}
+	shell.executor.SetStdio(stdin, stdout, stderr)
+	shell.history.SetControlFunc(func() string {
+		return shell.variables.Get("HISTCONTROL")
+	})
 
 	shell.initializeBuiltins()
 	registerEaster(shell.builtins)
-	shell.setupSignalHandlers()
+	shell.initializeEnvironment()
+
+	if !shell.embedded {
+		shell.setupSignalHandlers()
+	}
 
 	return shell
 }
@@ -82,12 +153,20 @@ func (s *Shell) Run(args []string) error {
 
 	defer s.cleanup()
 
-	if s.config.Command != "" {
+	if s.config.JSON {
+		return s.runJSON()
+	}
+
+	if s.config.HasCommand {
 		return s.executeCommand(s.config.Command)
 	}
 
+	if s.config.CommandFile != "" {
+		return s.executeCommandFile(s.config.CommandFile, s.config.ScriptArgs)
+	}
+
 	if s.config.ScriptFile != "" {
-		return s.executeScript(s.config.ScriptFile)
+		return s.executeScript(s.config.ScriptFile, s.config.ScriptArgs)
 	}
 
 	if s.config.ReadStdin {
@@ -106,12 +185,8 @@ func (s *Shell) initialize(args []string) error {
 		return err
 	}
 
-	if err := s.initializeEnvironment(); err != nil {
-		return err
-	}
-
 	// env override: skip rc/profile if GOSH_NORC set
-	if os.Getenv("GOSH_NORC") != "" {
+	if s.variables.Get("GOSH_NORC") != "" {
 		s.config.NoRC = true
 		s.config.NoProfile = true
 	}
@@ -120,9 +195,50 @@ func (s *Shell) initialize(args []string) error {
 		s.loadStartupFiles()
 	}
 
+	if s.interactive {
+		s.initializeHistory()
+	}
+
 	return nil
 }
 
+// initializeHistory reloads history from $HISTFILE, which the startup
+// files may have pointed elsewhere, keeping as many entries as $HISTSIZE
+// allows, and enables per-command appending.
+func (s *Shell) initializeHistory() {
+	s.history.Clear()
+	s.syncHistoryOptions()
+	s.history.Load()
+	s.history.SetAppend(s.config.HistoryAppend)
+}
+
+// syncHistoryOptions applies the history-related shell variables that
+// may change between commands. As in bash, a $HISTSIZE or $HISTFILESIZE
+// that is unset, not a number or negative means no limit, and the file
+// is limited to $HISTSIZE when $HISTFILESIZE is unset.
+func (s *Shell) syncHistoryOptions() {
+	if file := s.variables.Get("HISTFILE"); file != "" {
+		s.history.SetFile(file)
+	}
+	s.history.SetTimestamps(s.variables.Get("HISTTIMEFORMAT") != "")
+
+	size := s.historySize("HISTSIZE")
+	s.history.SetMaxSize(size)
+	if s.variables.IsSet("HISTFILESIZE") {
+		size = s.historySize("HISTFILESIZE")
+	}
+	s.history.SetFileSize(size)
+}
+
+// historySize returns the limit the variable name sets, or -1 for none.
+func (s *Shell) historySize(name string) int {
+	size, err := strconv.Atoi(s.variables.Get(name))
+	if err != nil || size < 0 {
+		return -1
+	}
+	return size
+}
+
 func (s *Shell) parseArguments(args []string) error {
 	i := 1
 	for i < len(args) {
@@ -133,8 +249,22 @@ func (s *Shell) parseArguments(args []string) error {
 			if i+1 >= len(args) {
 				return fmt.Errorf("option -c requires an argument")
 			}
+			// As in sh -c, the words after the command string are
+			// operands: $0 and then the positional parameters.
 			s.config.Command = args[i+1]
-			i += 2
+			s.config.HasCommand = true
+			if operands := args[i+2:]; len(operands) > 0 {
+				s.config.CommandName = operands[0]
+				s.config.ScriptArgs = operands[1:]
+			}
+			i = len(args)
+		case arg == "-O" || arg == "--command-file":
+			if i+1 >= len(args) {
+				return fmt.Errorf("option %s requires an argument", arg)
+			}
+			s.config.CommandFile = args[i+1]
+			s.config.ScriptArgs = args[i+2:]
+			i = len(args)
 		case arg == "-i":
 			s.interactive = true
 			i++
@@ -156,53 +286,121 @@ func (s *Shell) parseArguments(args []string) error {
 		case arg == "--debug":
 			s.config.Debug = true
 			i++
+		case arg == "--json":
+			s.config.JSON = true
+			i++
+		case arg == "--timeout":
+			if i+1 >= len(args) {
+				return fmt.Errorf("option --timeout requires an argument")
+			}
+			seconds, err := strconv.Atoi(args[i+1])
+			if err != nil || seconds < 0 {
+				return fmt.Errorf("invalid timeout: %s", args[i+1])
+			}
+			s.config.CommandTimeout = seconds
+			i += 2
+		case arg == "--" || arg == "-":
+			// POSIX treats a lone - as an ignored first operand.
+			s.setOperands(args[i+1:])
+			i = len(args)
 		case strings.HasPrefix(arg, "-"):
 			return fmt.Errorf("unknown option: %s", arg)
 		default:
-			s.config.ScriptFile = arg
-			s.config.ScriptArgs = args[i:]
-			break
+			// The first operand ends option parsing; everything after it
+			// is passed on, even words starting with -.
+			s.setOperands(args[i:])
+			i = len(args)
 		}
 	}
 
-	if s.config.Command == "" && s.config.ScriptFile == "" && !s.config.ReadStdin {
-		s.interactive = true
+	// With nothing else to run, commands come from stdin, and the shell
+	// is interactive when that is a terminal or -i says so.
+	s.terminal = term.IsTerminal(int(os.Stdin.Fd()))
+	s.readline.SetTerminal(s.terminal)
+	if !s.config.HasCommand && s.config.CommandFile == "" && s.config.ScriptFile == "" && !s.config.ReadStdin && !s.config.JSON {
+		if s.terminal {
+			s.interactive = true
+		} else if !s.interactive {
+			s.config.ReadStdin = true
+		}
 	}
 
+	s.executor.SetTimeout(time.Duration(s.config.CommandTimeout) * time.Second)
+
 	return nil
 }
 
-func (s *Shell) initializeEnvironment() error {
-	s.currentDir, _ = os.Getwd()
+func (s *Shell) initializeEnvironment() {
+	// An inherited $PWD is kept if it leads here, with its symbolic
+	// links, as the logical directory.
+	s.currentDir = os.Getenv("PWD")
+	if !sameDir(s.currentDir, ".") {
+		s.currentDir, _ = os.Getwd()
+	}
 
 	s.variables.Set("PWD", s.currentDir)
-	s.variables.Set("SHLVL", fmt.Sprintf("%d", s.getSHLVL()+1))
+	s.variables.Set("SHLVL", strconv.Itoa(s.getSHLVL()+1))
 	s.variables.Set("GOSH_VERSION", "1.0.4")
 	if execPath, err := os.Executable(); err == nil {
 		s.variables.Set("SHELL", execPath)
 	} else {
 		s.variables.Set("SHELL", "gosh")
 	}
+	// Commands started from here, gosh among them, see where and how
+	// deep they were started.
+	for _, name := range []string{"PWD", "SHLVL", "SHELL"} {
+		s.variables.Export(name)
+	}
 	s.variables.Set("_", os.Args[0])
+	s.setPositionalParams(os.Args[0], nil)
 
 	if hostname, err := os.Hostname(); err == nil {
 		s.variables.Set("HOSTNAME", hostname)
 	}
 
-	if user := os.Getenv("USER"); user != "" {
-		s.variables.Set("USER", user)
+	if s.variables.Get("HISTFILE") == "" {
+		s.variables.Set("HISTFILE", s.history.GetFile())
 	}
 
-	if home := os.Getenv("HOME"); home != "" {
-		s.variables.Set("HOME", home)
+	if !s.variables.IsSet("HISTSIZE") {
+		s.variables.Set("HISTSIZE", strconv.Itoa(s.config.HistorySize))
 	}
 
-	return nil
+	if s.variables.Get("HISTCONTROL") == "" {
+		s.variables.Set("HISTCONTROL", "ignoredups")
+	}
+
+	s.variables.Set("OPTIND", "1")
+
+	s.variables.SetDynamic("RANDOM", func() string {
+		return strconv.Itoa(rand.Intn(32768))
+	})
+	s.variables.SetDynamic("SECONDS", func() string {
+		return strconv.Itoa(int(time.Since(s.startTime).Seconds()))
+	})
+	s.variables.SetDynamic("LINENO", func() string {
+		return strconv.Itoa(s.lineno)
+	})
+	s.variables.SetDynamic("PPID", func() string {
+		return strconv.Itoa(os.Getppid())
+	})
+	s.variables.SetDynamic("?", func() string {
+		return strconv.Itoa(s.executor.GetLastExitCode())
+	})
 }
 
+// maxSHLVL is the level at which, as in bash, a runaway chain of nested
+// shells is assumed and SHLVL starts over.
+const maxSHLVL = 1000
+
 func (s *Shell) getSHLVL() int {
-	if shlvl := os.Getenv("SHLVL"); shlvl != "" {
-		if level := parseInt(shlvl); level > 0 {
+	if shlvl := s.variables.Get("SHLVL"); shlvl != "" {
+		level := parseInt(shlvl)
+		if level+1 >= maxSHLVL {
+			fmt.Fprintf(s.stderr(), "gosh: warning: shell level (%d) too high, resetting to 1\n", level+1)
+			return 0
+		}
+		if level > 0 {
 			return level
 		}
 	}
@@ -228,9 +426,9 @@ func (s *Shell) loadStartupFiles() {
 func (s *Shell) loadProfileFiles() {
 	profiles := []string{
 		"/etc/profile",
-		filepath.Join(os.Getenv("HOME"), ".profile"),
-		filepath.Join(os.Getenv("HOME"), ".bash_profile"),
-		filepath.Join(os.Getenv("HOME"), ".gosh_profile"),
+		filepath.Join(s.variables.Get("HOME"), ".profile"),
+		filepath.Join(s.variables.Get("HOME"), ".bash_profile"),
+		filepath.Join(s.variables.Get("HOME"), ".gosh_profile"),
 	}
 
 	for _, profile := range profiles {
@@ -243,8 +441,8 @@ func (s *Shell) loadProfileFiles() {
 
 func (s *Shell) loadRCFile() {
 	rcFiles := []string{
-		filepath.Join(os.Getenv("HOME"), ".goshrc"),
-		filepath.Join(os.Getenv("HOME"), ".bashrc"),
+		filepath.Join(s.variables.Get("HOME"), ".goshrc"),
+		filepath.Join(s.variables.Get("HOME"), ".bashrc"),
 	}
 
 	for _, rcFile := range rcFiles {
@@ -261,18 +459,61 @@ func (s *Shell) sourceFile(filename string) error {
 		return err
 	}
 	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.IsDir() {
+		return fmt.Errorf("%s: is a directory", filename)
+	}
+
+	s.sourcing++
+	defer func() { s.sourcing-- }()
 
+	// A file with no commands in it, empty or only comments, succeeds
+	// rather than passing on the status from before it was sourced.
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
+	if !s.executeLines(scanner) {
+		s.executor.SetLastExitCode(0)
+	}
+	s.executor.Returned()
+	return scanner.Err()
+}
+
+// executeLines runs the commands read from scanner. Lines are joined
+// until they form a complete command, so compound commands may span
+// several lines. It reports whether any command was run.
+func (s *Shell) executeLines(scanner *bufio.Scanner) bool {
+	defer func(lineno int) { s.lineno = lineno }(s.lineno)
+
+	var pending string
+	read, ran := 0, false
+	for s.running && !s.executor.Returning() && scanner.Scan() {
+		read++
+		line := scanner.Text()
+		if pending != "" {
+			line = pending + "\n" + line
+		} else {
+			s.lineno = read
+		}
+
+		commands, err := s.parser.Parse(line)
+		if errors.Is(err, parser.ErrIncomplete) {
+			pending = line
 			continue
 		}
+		pending = ""
 
+		// Blank and comment-only lines parse to nothing and leave $?
+		// alone.
+		if err == nil && len(commands) == 0 {
+			continue
+		}
 		s.executeLine(line)
+		ran = true
 	}
 
-	return scanner.Err()
+	if pending != "" && s.running && !s.executor.Returning() {
+		s.executeLine(pending)
+		ran = true
+	}
+	return ran
 }
 
 func (s *Shell) setupSignalHandlers() {
@@ -282,8 +523,11 @@ func (s *Shell) setupSignalHandlers() {
 		for sig := range s.sigChan {
 			switch sig {
 			case syscall.SIGINT:
+				if s.executor.SignalForeground(syscall.SIGINT) {
+					continue
+				}
 				if s.interactive {
-					fmt.Println()
+					fmt.Fprintln(s.stderr())
 					s.readline.ResetLine()
 				} else {
 					s.Exit(130)
@@ -300,141 +544,651 @@ func (s *Shell) setupSignalHandlers() {
 }
 
 func (s *Shell) interactiveLoop() error {
-	fmt.Printf("gosh %s - Go Shell\n", s.variables.Get("GOSH_VERSION"))
-	fmt.Println("Type 'help' for more information.")
+	if s.terminal {
+		fmt.Fprintf(s.stderr(), "gosh %s - Go Shell\n", s.variables.Get("GOSH_VERSION"))
+		fmt.Fprintln(s.stderr(), "Type 'help' for more information.")
+	}
 
 	for s.running {
-		promptStr := s.prompt.Generate(s.exitCode)
+		for _, notice := range s.jobs.Notifications() {
+			fmt.Fprintln(s.stderr(), notice)
+		}
 
-		line, err := s.readline.ReadLine(promptStr)
+		lines, err := s.readCommand()
 		if err != nil {
 			if err == io.EOF {
-				fmt.Println("exit")
+				if s.terminal {
+					fmt.Fprintln(s.stderr(), "exit")
+				}
 				break
 			}
 			continue
 		}
 
-		line = strings.TrimSpace(line)
+		s.syncHistoryOptions()
+		s.history.Add(s.historyEntry(lines))
+
+		s.lineno += len(lines)
+		line := strings.TrimSpace(strings.Join(lines, "\n"))
 		if line == "" {
 			continue
 		}
 
-		s.history.Add(line)
+		start := time.Now()
 		s.executeLine(line)
+		elapsed := time.Since(start)
+		s.prompt.SetDuration(elapsed)
+		s.reportTime(lines, elapsed)
 	}
 
+	s.Exit(s.exitCode)
 	return nil
 }
 
+// reportTime tells the user how long a command took if it ran for at
+// least $REPORTTIME seconds. Reporting is off while REPORTTIME is unset
+// or not a number.
+func (s *Shell) reportTime(lines []string, elapsed time.Duration) {
+	threshold, err := strconv.ParseFloat(s.variables.Get("REPORTTIME"), 64)
+	if err != nil || threshold < 0 || elapsed.Seconds() < threshold {
+		return
+	}
+
+	command := strings.TrimSpace(lines[0])
+	if len(lines) > 1 {
+		command += " ..."
+	}
+	fmt.Fprintf(s.stderr(), "%s  took %s\n", command, prompt.FormatDuration(elapsed))
+}
+
+// readCommand reads one complete command from the terminal, prompting
+// with PS2 for as long as the input so far does not parse on its own. It
+// returns the lines read, each after history expansion.
+func (s *Shell) readCommand() ([]string, error) {
+	var lines []string
+	var incomplete error
+	promptStr := s.prompt.Generate(s.exitCode)
+	s.readline.SetRightPrompt(s.prompt.GenerateRight(s.exitCode))
+
+	for {
+		line, err := s.readline.ReadLine(promptStr)
+		if err != nil {
+			if err == io.EOF && incomplete != nil {
+				fmt.Fprintf(s.stderr(), "gosh: %v\n", incomplete)
+				s.exitCode = 2
+				return nil, incomplete
+			}
+			return nil, err
+		}
+
+		expanded, err := s.history.Expand(line)
+		if err != nil {
+			fmt.Fprintf(s.stderr(), "gosh: %v\n", err)
+			return nil, err
+		}
+		if expanded != line {
+			fmt.Fprintln(s.stderr(), expanded)
+		}
+		lines = append(lines, expanded)
+
+		if _, incomplete = s.parser.Parse(strings.Join(lines, "\n")); !errors.Is(incomplete, parser.ErrIncomplete) {
+			return lines, nil
+		}
+		promptStr = s.prompt.GeneratePS2()
+		s.readline.SetRightPrompt("")
+	}
+}
+
+// historyEntry joins the lines of a multi-line command into a single
+// history entry. With lithist the newlines are kept; otherwise the lines
+// are joined with semicolons where the syntax needs them, as bash does.
+func (s *Shell) historyEntry(lines []string) string {
+	if s.config.LitHist || len(lines) == 1 {
+		return strings.Join(lines, "\n")
+	}
+
+	entry := strings.TrimRightFunc(lines[0], unicode.IsSpace)
+	for _, line := range lines[1:] {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if needsSeparator(entry) {
+			entry += ";"
+		}
+		entry += " " + line
+	}
+	return entry
+}
+
+// needsSeparator reports whether a command line must be followed by a
+// semicolon before more commands can be appended to it on the same line.
+func needsSeparator(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+	switch fields[len(fields)-1] {
+	case "do", "then", "else", "{", "(":
+		return false
+	}
+	return !strings.ContainsAny(line[len(line)-1:], ";|&")
+}
+
 func (s *Shell) executeLine(line string) {
-	commands, err := s.parser.Parse(line)
+	if _, err := s.RunString(line); err != nil {
+		fmt.Fprintf(s.stderr(), "gosh: %v\n", err)
+		// POSIX requires a non-interactive shell to exit on a syntax error.
+		if s.posixMode() && !s.interactive {
+			s.Exit(2)
+		}
+	}
+}
+
+// posixMode reports whether bash extensions are disabled, either by
+// --posix or set -o posix, or by POSIXLY_CORRECT being set. Every
+// extension gate goes through this check.
+func (s *Shell) posixMode() bool {
+	return s.config.POSIX || s.variables.IsSet("POSIXLY_CORRECT")
+}
+
+// RunString parses and executes src and returns the exit status of the
+// last command run. Once the shell has exited, RunString does nothing.
+func (s *Shell) RunString(src string) (int, error) {
+	if !s.running {
+		return s.exitCode, nil
+	}
+
+	commands, err := s.parser.Parse(src)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
 		s.exitCode = 2
-		return
+		return s.exitCode, err
 	}
 
 	for _, cmd := range commands {
 		exitCode := s.executor.Execute(cmd)
+		if !s.running {
+			break
+		}
 		s.exitCode = exitCode
+		if s.executor.Returning() {
+			break
+		}
 
 		if s.config.Debug {
-			fmt.Fprintf(os.Stderr, "[DEBUG] Command exit code: %d\n", exitCode)
+			fmt.Fprintf(s.stderr(), "[DEBUG] Command exit code: %d\n", exitCode)
+		}
+
+		// A negated command is tested, so its failure is not an error.
+		if s.config.ErrExit && exitCode != 0 && cmd.Type != ast.CommandNegation {
+			s.Exit(exitCode)
+			break
 		}
 	}
+
+	return s.exitCode, nil
+}
+
+// setOperands takes the operands after the options: the script and its
+// arguments, or with -s the positional parameters.
+func (s *Shell) setOperands(operands []string) {
+	if !s.config.ReadStdin && len(operands) > 0 {
+		s.config.ScriptFile = operands[0]
+		operands = operands[1:]
+	}
+	s.config.ScriptArgs = operands
 }
 
 func (s *Shell) executeCommand(command string) error {
+	if s.config.CommandName != "" {
+		s.setPositionalParams(s.config.CommandName, s.config.ScriptArgs)
+	}
 	s.executeLine(command)
 	s.Exit(s.exitCode)
 	return nil
 }
 
-func (s *Shell) executeScript(filename string) error {
-	file, err := os.Open(filename)
+// executeCommandFile parses the whole of filename as a single program, as
+// -c does with its argument, and runs it with args as $1, $2, ...
+func (s *Shell) executeCommandFile(filename string, args []string) error {
+	content, err := os.ReadFile(filename)
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	lineNum := 0
 
-	for scanner.Scan() {
-		lineNum++
-		line := strings.TrimSpace(scanner.Text())
+	s.setPositionalParams(filename, args)
+	s.executeLine(string(content))
+	s.Exit(s.exitCode)
+	return nil
+}
 
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
-		}
+// setPositionalParams sets $0 to name and $1, $2, ... $#, $@ and $* from
+// args.
+func (s *Shell) setPositionalParams(name string, args []string) {
+	s.variables.Set("0", name)
+	for i, arg := range args {
+		s.variables.Set(strconv.Itoa(i+1), arg)
+	}
+	count, _ := strconv.Atoi(s.variables.Get("#"))
+	for i := len(args) + 1; i <= count; i++ {
+		s.variables.Unset(strconv.Itoa(i))
+	}
+	s.variables.Set("#", strconv.Itoa(len(args)))
+	s.variables.Set("@", strings.Join(args, " "))
+	s.variables.Set("*", strings.Join(args, " "))
+}
 
-		s.executeLine(line)
+// savePositionalParams returns a function that puts $1, $2, ... $#, $@
+// and $* back as they are now, once up to n of them have been replaced.
+func (s *Shell) savePositionalParams(n int) func() {
+	count, _ := strconv.Atoi(s.variables.Get("#"))
+	restores := []func(){
+		s.variables.Snapshot("#"),
+		s.variables.Snapshot("@"),
+		s.variables.Snapshot("*"),
+	}
+	for i := 1; i <= max(count, n); i++ {
+		restores = append(restores, s.variables.Snapshot(strconv.Itoa(i)))
+	}
 
-		if !s.running {
-			break
+	return func() {
+		for _, restore := range restores {
+			restore()
 		}
 	}
+}
+
+func (s *Shell) executeScript(filename string, args []string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	s.setPositionalParams(filename, args)
+	scanner := bufio.NewScanner(file)
+	s.executeLines(scanner)
 
 	s.Exit(s.exitCode)
 	return scanner.Err()
 }
 
 func (s *Shell) readFromStdin() error {
-	scanner := bufio.NewScanner(os.Stdin)
-
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
-		}
-
-		s.executeLine(line)
-
-		if !s.running {
-			break
-		}
+	if len(s.config.ScriptArgs) > 0 {
+		s.setPositionalParams(s.variables.Get("0"), s.config.ScriptArgs)
 	}
+	scanner := bufio.NewScanner(os.Stdin)
+	s.executeLines(scanner)
 
+	s.Exit(s.exitCode)
 	return scanner.Err()
 }
 
 func (s *Shell) suspendShell() {
-	fmt.Println("\n[Suspended]")
+	fmt.Fprintln(s.stderr(), "\n[Suspended]")
 	syscall.Kill(os.Getpid(), syscall.SIGSTOP)
 }
 
 func (s *Shell) initializeBuiltins() {
-	s.builtins.Register("exit", s.builtinExit)
-	s.builtins.Register("cd", s.builtinCD)
-	s.builtins.Register("pwd", s.builtinPWD)
-	s.builtins.Register("echo", s.builtinEcho)
-	s.builtins.Register("help", s.builtinHelp)
-	s.builtins.Register("history", s.builtinHistory)
-	s.builtins.Register("export", s.builtinExport)
-	s.builtins.Register("unset", s.builtinUnset)
-	s.builtins.Register("set", s.builtinSet)
-	s.builtins.Register("source", s.builtinSource)
-	s.builtins.Register(".", s.builtinSource)
-	s.builtins.Register("jobs", s.builtinJobs)
-	s.builtins.Register("fg", s.builtinFG)
-	s.builtins.Register("bg", s.builtinBG)
-	s.builtins.Register("kill", s.builtinKill)
-	s.builtins.Register("[", s.builtinTest)
+	s.builtins.RegisterWithHelp("exit", s.builtinExit, builtin.Help{
+		Usage: "exit [code]",
+		Short: "Exit the shell with optional exit code",
+		Long:  []string{"The code is that of the last command run if it is left out"},
+	})
+	s.builtins.RegisterWithHelp("return", s.builtinReturn, builtin.Help{
+		Usage: "return [n]",
+		Short: "Return from a function or sourced script",
+		Long:  []string{"The status is n, or that of the last command run if n is left out"},
+	})
+	s.builtins.RegisterWithHelp("cd", s.builtinCD, builtin.Help{
+		Usage: "cd [-L|-P] [directory]",
+		Short: "Change the current directory",
+		Long: []string{
+			"cd           - Go to home directory",
+			"cd -         - Go to previous directory",
+			"cd /path     - Go to specified path",
+			"-L  keep symbolic links in $PWD (the default)",
+			"-P  resolve symbolic links",
+			"A relative directory is looked for in each directory of $CDPATH",
+		},
+	})
+	s.builtins.RegisterWithHelp("pwd", s.builtinPWD, builtin.Help{
+		Usage: "pwd [-LP]",
+		Short: "Print the current working directory",
+		Long: []string{
+			"-L  as reached through symbolic links (the default)",
+			"-P  with symbolic links resolved",
+		},
+	})
+	s.builtins.RegisterWithHelp("echo", s.builtinEcho, builtin.Help{
+		Usage: "echo [arguments...]",
+		Short: "Display arguments",
+	})
+	s.builtins.RegisterWithHelp("read", s.builtinRead, builtin.Help{
+		Usage: "read [-r] [-p prompt] [name ...]",
+		Short: "Read a line and split it into variables",
+		Long:  []string{"Fields are split on $IFS; the last name gets the rest of the line"},
+	})
+	s.builtins.RegisterWithHelp("help", s.builtinHelp, builtin.Help{
+		Usage: "help [command]",
+		Short: "List the builtins, or describe one of them",
+	})
+	s.builtins.RegisterWithHelp("history", s.builtinHistory, builtin.Help{
+		Usage: "history [-c] [-d offset] [n] or history -arw [filename]",
+		Short: "Display or manipulate the command history",
+		Long: []string{
+			"With n, list only the last n entries",
+			"-c  clear the history",
+			"-d  delete the entry at offset; a negative offset counts from the end",
+			"-a  append the entries new since the last write to the file",
+			"-r  read the file and add its entries to the history",
+			"-w  write the whole history to the file",
+			"The file defaults to $HISTFILE",
+		},
+	})
+	s.builtins.RegisterWithHelp("fc", s.builtinFC, builtin.Help{
+		Usage: "fc [-e ename] [-lnr] [first] [last]",
+		Short: "Edit and re-run history",
+		Long: []string{
+			"fc -l [first] [last]  - List history",
+			"fc -s [old=new] [cmd] - Re-run a command with a substitution",
+		},
+	})
+	s.builtins.RegisterWithHelp("export", s.builtinExport, builtin.Help{
+		Usage: "export [-n] [-p] [name[=value] ...]",
+		Short: "Export variables to environment",
+		Long: []string{
+			"-n  stop exporting the names, keeping their values",
+			"With -p or no names, print the exported variables as declarations",
+		},
+	})
+	s.builtins.RegisterWithHelp("readonly", s.builtinReadonly, builtin.Help{
+		Usage: "readonly [-p] [name[=value] ...]",
+		Short: "Make variables read-only",
+		Long:  []string{"With -p or no names, print the read-only variables as declarations"},
+	})
+	s.builtins.RegisterWithHelp("unset", s.builtinUnset, builtin.Help{
+		Usage: "unset [-f] [-v] [name ...]",
+		Short: "Remove variables or functions",
+		Long: []string{
+			"-v  only variables",
+			"-f  only functions",
+			"Without either, a name is a variable if one is set, else a function",
+		},
+	})
+	declareHelp := builtin.Help{
+		Usage: "declare [-aAilrux] [-p] [name[=value] ...]",
+		Short: "Set variable attributes",
+		Long: []string{
+			"-i  integer",
+			"-l  lowercase",
+			"-u  uppercase",
+			"-r  readonly",
+			"-x  export",
+			"-a  indexed array",
+			"-A  associative array",
+			"-p  print declarations",
+			"-g  in a function, set a global instead of a local",
+			"Using + instead of - turns an attribute off",
+		},
+	}
+	s.builtins.RegisterWithHelp("declare", s.builtinDeclare, declareHelp)
+	s.builtins.RegisterWithHelp("typeset", s.builtinDeclare, declareHelp)
+	s.builtins.RegisterWithHelp("local", s.builtinLocal, builtin.Help{
+		Usage: "local [-aAilrux] [name[=value] ...]",
+		Short: "Declare variables local to a function",
+		Long:  []string{"Locals are not exported unless -x is given or they shadow an export"},
+	})
+	s.builtins.RegisterWithHelp("set", s.builtinSet, builtin.Help{
+		Usage: "set [-Cefux] [-o option] [--] [arg ...]",
+		Short: "Show variables, set shell options or set the positional parameters",
+		Long: []string{
+			"-e  errexit",
+			"-u  nounset",
+			"-x  xtrace",
+			"-f  noglob",
+			"-C  noclobber",
+			"-o option turns a named option on and +o off; + turns the letters off",
+			"set -o lists the options and set +o prints them as set commands",
+			"Any args, or all words after --, become $1, $2, ...",
+			"With no arguments, print every variable",
+		},
+	})
+	sourceHelp := builtin.Help{
+		Usage: "source file [args...]",
+		Short: "Run the commands in file in the current shell",
+		Long:  []string{"Any args become the positional parameters while file runs"},
+	}
+	s.builtins.RegisterWithHelp("source", s.builtinSource, sourceHelp)
+	s.builtins.RegisterWithHelp(".", s.builtinSource, sourceHelp)
+	s.builtins.RegisterWithHelp("exec", s.builtinExec, builtin.Help{
+		Usage: "exec [command [args...]]",
+		Short: "Replace the shell with command",
+		Long:  []string{"Without a command, its redirections apply to the shell itself"},
+	})
+	s.builtins.RegisterWithHelp("getopts", s.builtinGetopts, builtin.Help{
+		Usage: "getopts optstring name [args...]",
+		Short: "Parse the next option into $name",
+		Long: []string{
+			"A letter followed by : takes an argument, left in $OPTARG",
+			"A leading : reports errors through $name and $OPTARG instead of stderr",
+		},
+	})
+	s.builtins.RegisterWithHelp("command", s.builtinCommand, builtin.Help{
+		Usage: "command [-vV] name [args...]",
+		Short: "Run a builtin or external command, ignoring functions",
+		Long: []string{
+			"-v  print the name or path that would be run",
+			"-V  describe it like type",
+		},
+	})
+	s.builtins.RegisterWithHelp("type", s.builtinType, builtin.Help{
+		Usage: "type [-tp] name ...",
+		Short: "Describe how each name would be interpreted",
+		Long: []string{
+			"-t  print one of keyword, function, builtin or file",
+			"-p  print file paths only",
+		},
+	})
+	s.builtins.RegisterWithHelp("which", s.builtinWhich, builtin.Help{
+		Usage: "which [-a] name ...",
+		Short: "Print the path of each command found in $PATH",
+	})
+	s.builtins.RegisterWithHelp("jobs", s.builtinJobs, builtin.Help{
+		Usage: "jobs [-lprs] [jobspec ...]",
+		Short: "Show the status of jobs",
+		Long: []string{
+			"-l  include process IDs",
+			"-p  print only process IDs",
+			"-r  only running jobs",
+			"-s  only stopped jobs",
+		},
+	})
+	s.builtins.RegisterWithHelp("fg", s.builtinFG, builtin.Help{
+		Usage: "fg [jobspec]",
+		Short: "Bring a job to the foreground, the current job by default",
+	})
+	s.builtins.RegisterWithHelp("bg", s.builtinBG, builtin.Help{
+		Usage: "bg [jobspec]",
+		Short: "Resume a stopped job in the background, the current job by default",
+	})
+	s.builtins.RegisterWithHelp("kill", s.builtinKill, builtin.Help{
+		Usage: "kill [-s sigspec | -n signum | -sigspec] pid | jobspec ... or kill -l [sigspec]",
+		Short: "Send a signal to processes or jobs",
+		Long: []string{
+			"The signal is TERM unless given by name, as in -KILL or -s HUP, or number",
+			"%n names a job; a negative pid names a process group",
+			"-l lists the signals, or converts between names and numbers",
+		},
+	})
+	s.builtins.RegisterWithHelp("wait", s.builtinWait, builtin.Help{
+		Usage: "wait [%job | pid ...]",
+		Short: "Wait for jobs to finish",
+		Long:  []string{"Returns the status of the last job waited for, or 0 with no arguments"},
+	})
+	testHelp := builtin.Help{
+		Usage: "test expr, [ expr ]",
+		Short: "Evaluate a conditional expression",
+		Long:  []string{"The status is 0 if expr is true and 1 if it is false"},
+	}
+	s.builtins.RegisterWithHelp("[", s.builtinBracket, testHelp)
+	s.builtins.RegisterWithHelp("test", s.builtinTest, testHelp)
+	trueHelp := builtin.Help{
+		Usage: "true, : [args...]",
+		Short: "Return 0; arguments are expanded and redirects applied",
+	}
+	s.builtins.RegisterWithHelp(":", s.builtinTrue, trueHelp)
+	s.builtins.RegisterWithHelp("true", s.builtinTrue, trueHelp)
+	s.builtins.RegisterWithHelp("false", s.builtinFalse, builtin.Help{
+		Usage: "false",
+		Short: "Return 1",
+	})
+	s.builtins.RegisterWithHelp("timeout", s.builtinTimeout, builtin.Help{
+		Usage: "timeout duration command [args...]",
+		Short: "Run command, killing it if it runs longer than duration",
+	})
+	s.builtins.RegisterWithHelp("pushd", s.builtinPushd, builtin.Help{
+		Usage: "pushd [dir]",
+		Short: "Change directory, saving the current one on the stack",
+		Long:  []string{"Without dir, swap the current directory with the top of the stack"},
+	})
+	s.builtins.RegisterWithHelp("popd", s.builtinPopd, builtin.Help{
+		Usage: "popd",
+		Short: "Return to the last directory pushed",
+	})
+	s.builtins.RegisterWithHelp("dirs", s.builtinDirs, builtin.Help{
+		Usage: "dirs [-c]",
+		Short: "Show the directory stack",
+		Long:  []string{"-c  clear the stack"},
+	})
+	s.builtins.RegisterWithHelp("shopt", s.builtinShopt, builtin.Help{
+		Usage: "shopt [-pqsu] [optname ...]",
+		Short: "Show or set shell options",
+		Long: []string{
+			"-s  turn the options on",
+			"-u  turn them off",
+			"-q  only set the status: 0 if every option named is on",
+			"-p  print the options as shopt commands",
+			"Options: dotglob failglob globstar histappend huponexit lithist nocaseglob nullglob",
+		},
+	})
+	s.builtins.RegisterWithHelp("complete", s.builtinComplete, builtin.Help{
+		Usage: "complete [-fdpr] [-W words] [-F function] [name ...]",
+		Short: "Set how arguments of name are completed",
+		Long: []string{
+			"-W  the words in the list",
+			"-f  file names",
+			"-d  directory names",
+			"-F  run function, which leaves the completions in the COMPREPLY array",
+			"-r  remove the specs for the names, or all of them",
+			"-p  print the specs, as complete does with no options",
+		},
+	})
 }
 
+// Exit stops the shell with code wrapped to the 0-255 range of a
+// process exit status.
 func (s *Shell) Exit(code int) {
+	code &= 0xFF
 	s.running = false
+	s.exitCode = code
+	if s.embedded {
+		return
+	}
 	s.cleanup()
 	os.Exit(code)
 }
 
+func (s *Shell) stdout() io.Writer {
+	return s.executor.Stdout()
+}
+
+func (s *Shell) stderr() io.Writer {
+	return s.executor.Stderr()
+}
+
 func (s *Shell) cleanup() {
-	if s.history != nil {
-		s.history.Save()
+	if s.interactive && s.config.HupOnExit {
+		s.jobs.Hangup()
+	}
+	if s.history != nil && s.interactive {
+		s.syncHistoryOptions()
+		if s.history.Appending() {
+			s.history.Truncate()
+		} else {
+			s.history.Save()
+		}
 	}
 	if s.readline != nil {
 		s.readline.Close()
 	}
 	close(s.sigChan)
 }
+
+// completeCommand returns the builtins, functions and commands in $PATH
+// whose names start with prefix, sorted and without duplicates.
+func (s *Shell) completeCommand(prefix string) []string {
+	seen := make(map[string]bool)
+	var names []string
+	add := func(name string) {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+
+	for _, name := range s.builtins.List() {
+		add(name)
+	}
+	for _, name := range s.executor.Functions() {
+		add(name)
+	}
+	for _, dir := range filepath.SplitList(s.variables.Get("PATH")) {
+		if dir == "" {
+			dir = "."
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), prefix) || seen[entry.Name()] {
+				continue
+			}
+			info, err := os.Stat(filepath.Join(dir, entry.Name()))
+			if err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+				add(entry.Name())
+			}
+		}
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+// completeFunction runs the function of a complete -F spec the way bash
+// does, with the command, the word being completed and the word before
+// it as arguments and COMP_WORDS and COMP_CWORD set, and returns the
+// words it leaves in COMPREPLY.
+func (s *Shell) completeFunction(name string, words []string) []string {
+	cword := len(words) - 1
+	prev := ""
+	if cword > 0 {
+		prev = words[cword-1]
+	}
+	s.variables.SetArray("COMP_WORDS", words)
+	s.variables.Set("COMP_CWORD", strconv.Itoa(cword))
+	s.variables.Unset("COMPREPLY")
+
+	status := s.executor.GetLastExitCode()
+	s.executor.Execute(&ast.Command{
+		Type: ast.CommandSimple,
+		Simple: &ast.SimpleCommand{
+			Name: parser.Quote(name),
+			Args: []string{parser.Quote(words[0]), parser.Quote(words[cword]), parser.Quote(prev)},
+		},
+	})
+	s.executor.SetLastExitCode(status)
+
+	return s.variables.GetArray("COMPREPLY")
+}
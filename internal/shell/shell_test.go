@@ -0,0 +1,736 @@
+package shell
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// runProcess starts the test binary again to be a shell running
+	// $GOSH_TEST_SCRIPT, for tests that need a process of their own.
+	if script, ok := os.LookupEnv("GOSH_TEST_SCRIPT"); ok {
+		s := New()
+		if err := s.Run([]string{"gosh", "--norc", "-c", script}); err != nil {
+			fmt.Fprintf(os.Stderr, "gosh: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(s.exitCode)
+	}
+	os.Exit(m.Run())
+}
+
+// runProcess runs script in a shell process of its own and returns what
+// it wrote to stdout and stderr and its exit status.
+func runProcess(t *testing.T, script string) (string, string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "GOSH_TEST_SCRIPT="+script, "HOME="+t.TempDir())
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// newTestShell returns an embedded shell writing to the returned buffers,
+// with a fresh $HOME so that no history or startup file of the user's
+// is read.
+func newTestShell(t testing.TB) (*Shell, *bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	var stdout, stderr bytes.Buffer
+	s := NewWithOptions(Options{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Env:      []string{"HOME=" + home, "PATH=" + os.Getenv("PATH")},
+		Embedded: true,
+	})
+	return s, &stdout, &stderr
+}
+
+// runScript runs src in a new test shell and returns its stdout and the
+// exit status of the last command.
+func runScript(t *testing.T, src string) (string, int) {
+	t.Helper()
+	s, stdout, stderr := newTestShell(t)
+	code, err := s.RunString(src)
+	if err != nil {
+		t.Logf("stderr: %s", stderr)
+	}
+	return stdout.String(), code
+}
+
+// writeFile creates name in dir with content and returns its path.
+func writeFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// withStdin makes os.Stdin read input for the rest of the test.
+func withStdin(t *testing.T, input string) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.WriteString(input)
+	w.Close()
+
+	old := os.Stdin
+	os.Stdin = r
+	t.Cleanup(func() {
+		os.Stdin = old
+		r.Close()
+	})
+}
+
+func TestEmptyPrograms(t *testing.T) {
+	dir := t.TempDir()
+	empty := writeFile(t, dir, "empty.sh", "")
+	comments := writeFile(t, dir, "comments.sh", "# one\n  # two\n\n")
+
+	tests := []struct {
+		name   string
+		src    string
+		output string
+		code   int
+	}{
+		{"empty", "", "", 0},
+		{"blanks", "  \n\n\t", "", 0},
+		{"comment", "# nothing", "", 0},
+		{"source empty", "false; . " + empty + "; echo $?", "0\n", 0},
+		{"source comments", "false; . " + comments + "; echo $?", "0\n", 0},
+		{"comment keeps status", "false\n# c", "", 1},
+		{"empty then", "false; if true; then fi; echo $?", "0\n", 0},
+		{"empty else", "if false; then echo x; else fi; echo $?", "0\n", 0},
+		{"empty while", "while false; do :; done; echo $?", "0\n", 0},
+		{"empty do", "for x in a b; do done; echo $?", "0\n", 0},
+		{"for over nothing", "for x in; do echo $x; done; echo $?", "0\n", 0},
+		{"empty case", "case a in esac; echo $?", "0\n", 0},
+		{"empty group", "{ ; }; echo $?", "0\n", 0},
+		{"empty function", "f() { :; }; f; echo $?", "0\n", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output, code := runScript(t, tt.src)
+			if output != tt.output || code != tt.code {
+				t.Errorf("got %q, %d; want %q, %d", output, code, tt.output, tt.code)
+			}
+		})
+	}
+}
+
+func TestEmptyCommandString(t *testing.T) {
+	withStdin(t, "echo leaked\n")
+	s, stdout, _ := newTestShell(t)
+
+	if err := s.Run([]string{"gosh", "-c", ""}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.Len() != 0 || s.exitCode != 0 {
+		t.Errorf("gosh -c '' printed %q with status %d; want nothing and 0", stdout, s.exitCode)
+	}
+}
+
+func TestEmptyStdin(t *testing.T) {
+	withStdin(t, "\n")
+	s, stdout, _ := newTestShell(t)
+
+	if err := s.Run([]string{"gosh"}); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.Len() != 0 || s.exitCode != 0 {
+		t.Errorf("echo '' | gosh printed %q with status %d; want nothing and 0", stdout, s.exitCode)
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"expansion", "echo $((1+2))", "3\n"},
+		{"names", "x=4; echo $((x*2))", "8\n"},
+		{"parameters", "x=3; echo $(( $x + 1 ))", "4\n"},
+		{"nested parentheses", "echo $(( (1+2)*3 ))", "9\n"},
+		{"quoted", `echo "$((2**3))"`, "8\n"},
+		{"assignment", "x=$(( 6 / 2 )); echo $x", "3\n"},
+		{"while loop", "i=0; while ((i<3)); do echo $i; ((i++)); done", "0\n1\n2\n"},
+		{"if", "x=7; if ((x > 5)); then echo big; fi", "big\n"},
+		{"if false", "x=2; if ((x > 5)); then echo big; else echo small; fi", "small\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestCompleteCommand(t *testing.T) {
+	bin := t.TempDir()
+	writeFile(t, bin, "mytool", "")
+	if err := os.Chmod(filepath.Join(bin, "mytool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, bin, "mydata", "")
+
+	s, _, _ := newTestShell(t)
+	if _, err := s.RunString("PATH=" + bin + "; myfunc() { :; }; echo() { :; }"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []string
+	}{
+		{"my", []string{"myfunc", "mytool"}},
+		{"ech", []string{"echo"}},
+		{"[", []string{"["}},
+		{"zz", nil},
+	}
+	for _, tt := range tests {
+		if got := s.completeCommand(tt.prefix); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("completeCommand(%q) = %q, want %q", tt.prefix, got, tt.want)
+		}
+	}
+}
+
+func TestHistoryExpansionEcho(t *testing.T) {
+	withStdin(t, "echo one\n!!\n")
+	s, stdout, stderr := newTestShell(t)
+	s.readline.SetTerminal(false)
+
+	for i := 0; i < 2; i++ {
+		lines, err := s.readCommand()
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.history.Add(lines[0])
+	}
+	if stdout.Len() != 0 {
+		t.Errorf("stdout = %q, want nothing", stdout)
+	}
+	if got := stderr.String(); got != "echo one\n" {
+		t.Errorf("stderr = %q, want the expanded line", got)
+	}
+}
+
+func TestSHLVLWarning(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	var stdout, stderr bytes.Buffer
+	s := NewWithOptions(Options{
+		Stdout:   &stdout,
+		Stderr:   &stderr,
+		Env:      []string{"HOME=" + home, "SHLVL=999"},
+		Embedded: true,
+	})
+
+	if got := s.variables.Get("SHLVL"); got != "1" {
+		t.Errorf("SHLVL = %q, want 1", got)
+	}
+	if !bytes.Contains(stderr.Bytes(), []byte("shell level (1000) too high")) {
+		t.Errorf("stderr = %q, want the shell level warning", stderr.String())
+	}
+}
+
+func TestIdentityExported(t *testing.T) {
+	home, dir := t.TempDir(), t.TempDir()
+	t.Setenv("HOME", home)
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"SHLVL", `env | grep '^SHLVL='`, "SHLVL=4\n"},
+		{"SHLVL after a change", `SHLVL=7; printenv SHLVL`, "7\n"},
+		{"PWD after cd", "cd '" + dir + "' && sh -c 'echo $PWD'", dir + "\n"},
+		{"SHELL", `sh -c 'echo "${SHELL:+set}"'`, "set\n"},
+		{"GOSH_VERSION is not", `sh -c 'echo "[$GOSH_VERSION]"'`, "[]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wd, _ := os.Getwd()
+			t.Cleanup(func() { os.Chdir(wd) })
+
+			var stdout, stderr bytes.Buffer
+			s := NewWithOptions(Options{
+				Stdout:   &stdout,
+				Stderr:   &stderr,
+				Env:      []string{"HOME=" + home, "PATH=" + os.Getenv("PATH"), "SHLVL=3"},
+				Embedded: true,
+			})
+			if _, err := s.RunString(tt.src); err != nil {
+				t.Fatalf("%v: %s", err, &stderr)
+			}
+			if stdout.String() != tt.output {
+				t.Errorf("got %q, want %q", &stdout, tt.output)
+			}
+		})
+	}
+}
+
+func TestChildEnvironment(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"exported", `export GOSH_CHILD=yes; sh -c 'echo $GOSH_CHILD'`, "yes\n"},
+		{"exported later", `GOSH_CHILD=yes; export GOSH_CHILD; sh -c 'echo $GOSH_CHILD'`, "yes\n"},
+		{"not exported", `GOSH_CHILD=no; sh -c 'echo "[$GOSH_CHILD]"'`, "[]\n"},
+		{"unset", `export GOSH_CHILD=yes; unset GOSH_CHILD; sh -c 'echo "[$GOSH_CHILD]"'`, "[]\n"},
+		{"prefix", `GOSH_CHILD=once sh -c 'echo $GOSH_CHILD'; sh -c 'echo "[$GOSH_CHILD]"'`, "once\n[]\n"},
+		{"prefix to env", `GOSH_CHILD=bar env | grep '^GOSH_CHILD='; sh -c 'echo "[$GOSH_CHILD]"'`, "GOSH_CHILD=bar\n[]\n"},
+		{"prefix over an exported value", `export GOSH_CHILD=a; GOSH_CHILD=b env | grep '^GOSH_CHILD='; echo $GOSH_CHILD; env | grep '^GOSH_CHILD='`, "GOSH_CHILD=b\na\nGOSH_CHILD=a\n"},
+		{"several prefixes", `GOSH_CHILD=1 GOSH_CHILD2=2 env | grep '^GOSH_CHILD' | LC_ALL=C sort`, "GOSH_CHILD2=2\nGOSH_CHILD=1\n"},
+		{"prefix to a function", `f() { printenv GOSH_CHILD; }; GOSH_CHILD=x f; sh -c 'echo "[$GOSH_CHILD]"'`, "x\n[]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+			for _, name := range []string{"GOSH_CHILD", "GOSH_CHILD2"} {
+				if _, set := os.LookupEnv(name); set {
+					t.Errorf("%s was set in the process environment", name)
+				}
+			}
+		})
+	}
+}
+
+func TestArrayExpansion(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"element", "arr=(a b c); echo ${arr[1]}", "b\n"},
+		{"element in quotes", `arr=(a "b c"); echo "<${arr[1]}>"`, "<b c>\n"},
+		{"for over elements", `arr=(a "b c" d); for x in "${arr[@]}"; do echo "[$x]"; done`, "[a]\n[b c]\n[d]\n"},
+		{"for over unquoted elements", `arr=(a "b c"); for x in ${arr[@]}; do echo "[$x]"; done`, "[a]\n[b]\n[c]\n"},
+		{"elements as arguments", `arr=("a b" c); printf "<%s>" "${arr[@]}"; echo`, "<a b><c>\n"},
+		{"all elements as one", `arr=(a b c); echo "${arr[*]}"`, "a b c\n"},
+		{"indices", "arr=(a b c); echo ${!arr[@]}", "0 1 2\n"},
+		{"for over indices", `arr=(x y); for i in "${!arr[@]}"; do echo "$i=${arr[$i]}"; done`, "0=x\n1=y\n"},
+		{"length", "arr=(a b c); echo ${#arr[@]}", "3\n"},
+		{"associative", "declare -A m=([k]=v); echo ${m[k]} ${!m[@]}", "v k\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestDefaultAssignment(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"unset", ": ${V:=def}; echo $V", "def\n"},
+		{"empty", "V=; : ${V:=def}; echo $V", "def\n"},
+		{"set", "V=x; : ${V:=def}; echo $V", "x\n"},
+		{"without colon", ": ${V=def}; echo $V", "def\n"},
+		{"without colon when set", "V=x; : ${V=def}; echo $V", "x\n"},
+		{"value", "echo ${V:=def}; echo $V", "def\ndef\n"},
+		{"expanded word", "x=b; : ${V:=$x}; echo $V", "b\n"},
+		{"quoted", `: "${V:=a b}"; echo "[$V]"`, "[a b]\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestCase(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"one line", "case x in y) echo y;; x) echo x;; esac", "x\n"},
+		{"leading paren", "case x in (x) echo p;; esac", "p\n"},
+		{"leading paren with a glob", "case ab in (a*|b) echo glob;; *) echo no; esac", "glob\n"},
+		{"no final ;;", "case x in x) echo last; esac", "last\n"},
+		{"default on its own line", "case z in y) echo y;; *) echo default\nesac", "default\n"},
+		{"no match", "case z in y) echo y;; esac; echo $?", "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func BenchmarkExpansionLoop(b *testing.B) {
+	const src = `i=0; while ((i < 1000)); do x="$i ${HOME} $((i * 2))"; ((i++)); done`
+	s, _, stderr := newTestShell(b)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if code, err := s.RunString(src); code != 0 || err != nil {
+			b.Fatalf("status %d, %v: %s", code, err, stderr)
+		}
+	}
+}
+
+func TestNoclobber(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+		file   string
+	}{
+		{"> fails", `set -o noclobber; echo new > "$F"; echo $?`, "1\n", "old\n"},
+		{"set -C", `set -C; echo new > "$F"; echo $?`, "1\n", "old\n"},
+		{">| overwrites", `set -o noclobber; echo new >| "$F"; echo $?`, "0\n", "new\n"},
+		{">> appends", `set -o noclobber; echo new >> "$F"; echo $?`, "0\n", "old\nnew\n"},
+		{"&> fails", `set -o noclobber; echo new &> "$F"; echo $?`, "1\n", "old\n"},
+		{"devices are written", `set -o noclobber; echo new > /dev/null; echo $?`, "0\n", "old\n"},
+		{"new files are created", `set -o noclobber; echo new > "$F.new"; cat "$F.new"`, "new\n", "old\n"},
+		{"off again", `set -o noclobber; set +o noclobber; echo new > "$F"; echo $?`, "0\n", "new\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeFile(t, t.TempDir(), "existing", "old\n")
+			output, _ := runScript(t, "F='"+file+"'; "+tt.src)
+			if output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+			if content, _ := os.ReadFile(file); string(content) != tt.file {
+				t.Errorf("the file holds %q, want %q", content, tt.file)
+			}
+		})
+	}
+}
+
+func TestFunctionRedirects(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+		file   string
+	}{
+		{"output", `f() { echo hi; }; f > "$F"; echo $?`, "0\n", "hi\n"},
+		{"append", `f() { echo hi; }; f > "$F"; f >> "$F"`, "", "hi\nhi\n"},
+		{"nested calls", `g() { echo g; }; f() { echo f; g; }; f > "$F"`, "", "f\ng\n"},
+		{"stderr", `f() { echo out; echo err >&2; }; f 2> "$F"`, "out\n", "err\n"},
+		{"input", `echo in > "$F"; f() { read v; echo "v=$v"; }; f < "$F"`, "v=in\n", "in\n"},
+		{"status", `f() { return 3; }; f > "$F"; echo $?`, "3\n", ""},
+		{"only for the call", `f() { echo hi; }; f > "$F"; echo after`, "after\n", "hi\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "out")
+			output, _ := runScript(t, "F='"+file+"'; "+tt.src)
+			if output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+			if content, _ := os.ReadFile(file); string(content) != tt.file {
+				t.Errorf("the file holds %q, want %q", content, tt.file)
+			}
+		})
+	}
+}
+
+func TestScriptArguments(t *testing.T) {
+	script := writeFile(t, t.TempDir(), "script.sh", `echo $#; for a in "$@"; do echo "[$a]"; done`+"\n")
+	tests := []struct {
+		name   string
+		args   []string
+		output string
+	}{
+		{"options after the script", []string{script, "-x", "foo"}, "2\n[-x]\n[foo]\n"},
+		{"-- after the script", []string{script, "--", "-c"}, "2\n[--]\n[-c]\n"},
+		{"shell options before the script", []string{"--norc", script, "a"}, "1\n[a]\n"},
+		{"no arguments", []string{script}, "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, stdout, stderr := newTestShell(t)
+			if err := s.Run(append([]string{"gosh"}, tt.args...)); err != nil {
+				t.Fatalf("%v: %s", err, stderr)
+			}
+			if stdout.String() != tt.output {
+				t.Errorf("got %q, want %q", stdout, tt.output)
+			}
+		})
+	}
+}
+
+func TestCommandArguments(t *testing.T) {
+	script := writeFile(t, t.TempDir(), "script.sh", `echo "$#:$*"`+"\n")
+	tests := []struct {
+		name   string
+		args   []string
+		output string
+	}{
+		{"name and arguments", []string{"-c", `echo "$0 $#:$*"`, "name", "a", "b"}, "name 2:a b\n"},
+		{"name only", []string{"-c", `echo "$0 $#"`, "name"}, "name 0\n"},
+		{"options as arguments", []string{"-c", `echo "$0 $#:$*"`, "-x", "-i", "--"}, "-x 2:-i --\n"},
+		{"options before -c", []string{"--norc", "-c", `echo "$#"`}, "0\n"},
+		{"-- ends the options", []string{"--", script, "-i"}, "1:-i\n"},
+		{"- ends the options", []string{"-", script, "x"}, "1:x\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, stdout, stderr := newTestShell(t)
+			if err := s.Run(append([]string{"gosh"}, tt.args...)); err != nil {
+				t.Fatalf("%v: %s", err, stderr)
+			}
+			if stdout.String() != tt.output {
+				t.Errorf("got %q, want %q", stdout, tt.output)
+			}
+		})
+	}
+}
+
+func TestBadArguments(t *testing.T) {
+	for _, args := range [][]string{
+		{"-c"},
+		{"--nope"},
+		{"-q", "script"},
+		{"--timeout", "soon"},
+	} {
+		s, _, _ := newTestShell(t)
+		if err := s.Run(append([]string{"gosh"}, args...)); err == nil {
+			t.Errorf("gosh %q succeeded, want an error", args)
+		}
+	}
+}
+
+func TestCompoundStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"for over no words", "false; for x in; do :; done; echo $?", "0\n"},
+		{"for body", "for x in a b; do sh -c 'exit 4'; done; echo $?", "4\n"},
+		{"for body, last run", "for x in 1 0; do sh -c \"exit $x\"; done; echo $?", "0\n"},
+		{"while never run", "false; while false; do :; done; echo $?", "0\n"},
+		{"while condition fails", "while sh -c 'exit 8'; do :; done; echo $?", "0\n"},
+		{"while body", "x=0; while ((x<1)); do ((x++)); sh -c 'exit 9'; done; echo $?", "9\n"},
+		{"if with no branch run", "sh -c 'exit 7'; if false; then :; fi; echo $?", "0\n"},
+		{"if condition status in else", "if sh -c 'exit 3'; then :; else echo $?; fi", "3\n"},
+		{"if then", "if true; then sh -c 'exit 6'; fi; echo $?", "6\n"},
+		{"if else", "if false; then :; else sh -c 'exit 2'; fi; echo $?", "2\n"},
+		{"elif with no branch run", "if false; then :; elif sh -c 'exit 5'; then :; fi; echo $?", "0\n"},
+		{"case with no match", "false; case a in b) ;; esac; echo $?", "0\n"},
+		{"case body", "case a in a) sh -c 'exit 3';; esac; echo $?", "3\n"},
+		{"killed by SIGINT", "sh -c 'kill -INT $$'; echo $?", "130\n"},
+		{"killed by SIGTERM", "sh -c 'kill -TERM $$'; echo $?", "143\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestPOSIXMode(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"braces", "echo {a,b}", "a b\n"},
+		{"posix braces", "set -o posix; echo {a,b}", "{a,b}\n"},
+		{"posix sequence", "set -o posix; echo {1..3}", "{1..3}\n"},
+		{"posix for braces", "set -o posix; for x in {1..2}; do echo $x; done", "{1..2}\n"},
+		{"POSIXLY_CORRECT braces", "POSIXLY_CORRECT=1; echo {1..3}", "{1..3}\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestCompoundPipelines(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"while read", `printf 'a\nb\n' | while read l; do echo "got $l"; done`, "got a\ngot b\n"},
+		{"group", `{ echo x; echo y; } | wc -l | tr -d ' '`, "2\n"},
+		{"group reading", `echo q | { read v; echo "v=$v"; }`, "v=q\n"},
+		{"if", `if true; then echo yes; fi | tr a-z A-Z`, "YES\n"},
+		{"for", `for i in 1 2 3; do echo $i; done | tail -n 1`, "3\n"},
+		{"case", `case a in a) echo hit;; esac | cat`, "hit\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestEmptyPipelineSide(t *testing.T) {
+	for _, src := range []string{"| wc -l", "echo a | | wc -l"} {
+		if output, code := runScript(t, src); code != 2 || output != "" {
+			t.Errorf("%q printed %q with status %d, want nothing and 2", src, output, code)
+		}
+	}
+}
+
+func TestPipefail(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"off", `false | true; echo $?`, "0\n"},
+		{"on", `set -o pipefail; false | true; echo $?`, "1\n"},
+		{"rightmost failure", `set -o pipefail; sh -c 'exit 2' | sh -c 'exit 3' | true; echo $?`, "3\n"},
+		{"all succeed", `set -o pipefail; true | true | true; echo $?`, "0\n"},
+		{"last fails", `set -o pipefail; true | false; echo $?`, "1\n"},
+		{"negated", `set -o pipefail; ! false | true; echo $?`, "0\n"},
+		{"off again", `set -o pipefail; set +o pipefail; false | true; echo $?`, "0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestComments(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"inside a word", "echo a#b\n", "a#b\n"},
+		{"after a word", "echo a #b\n", "a\n"},
+		{"after an operator", "echo a;#b\n", "a\n"},
+		{"quoted", "echo \"a #b\" 'c #d'\n", "a #b c #d\n"},
+		{"escaped", "echo a \\#b\n", "a #b\n"},
+		{"whole lines", "# one\n  # two\necho a\n#three\n", "a\n"},
+		{"in a multi-line command", "for x in a b; do # loop\n\techo $x#\ndone\n", "a#\nb#\n"},
+		{"shebang", "#!/bin/gosh\necho a\n", "a\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			script := writeFile(t, dir, "script.sh", tt.src)
+
+			s, stdout, stderr := newTestShell(t)
+			if err := s.Run([]string{"gosh", script}); err != nil {
+				t.Fatalf("%v: %s", err, stderr)
+			}
+			if stdout.String() != tt.output {
+				t.Errorf("script: got %q, want %q", stdout, tt.output)
+			}
+
+			output, _ := runScript(t, "source '"+script+"'")
+			if output != tt.output {
+				t.Errorf("source: got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
+
+func TestUnterminatedQuotes(t *testing.T) {
+	const unmatched = "syntax error: unexpected EOF while looking for matching `\"'"
+	tests := []struct {
+		name   string
+		mode   string // "script", "-c" or "-i"
+		src    string
+		stdout string
+		stderr string
+		code   int
+	}{
+		{"script", "script", "echo before\necho \"hello\necho after\n", "before\n", unmatched, 2},
+		{"script, single quote", "script", "echo 'hello\n", "", "syntax error: unexpected EOF while looking for matching `''", 2},
+		{"script, closed on a later line", "script", "echo \"a\nb\"\n", "a\nb\n", "", 0},
+		{"-c", "-c", `echo "hello`, "", unmatched, 2},
+		{"interactive", "-i", "echo before\necho \"hello\n", "before\n", unmatched, 2},
+		{"interactive continuation", "-i", "echo \"a\nb\"\necho c\n", "a\nb\nc\n", "", 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var args []string
+			switch tt.mode {
+			case "script":
+				args = []string{"gosh", writeFile(t, t.TempDir(), "script.sh", tt.src)}
+			case "-c":
+				args = []string{"gosh", "--norc", "-c", tt.src}
+			case "-i":
+				withStdin(t, tt.src)
+				args = []string{"gosh", "--norc", "-i"}
+			}
+
+			s, stdout, stderr := newTestShell(t)
+			s.Run(args)
+			if stdout.String() != tt.stdout {
+				t.Errorf("stdout: got %q, want %q", stdout, tt.stdout)
+			}
+			if tt.stderr == "" && stderr.Len() != 0 || !bytes.Contains(stderr.Bytes(), []byte(tt.stderr)) {
+				t.Errorf("stderr: got %q, want %q", stderr, tt.stderr)
+			}
+			if s.exitCode != tt.code {
+				t.Errorf("exit status %d, want %d", s.exitCode, tt.code)
+			}
+		})
+	}
+}
+
+func TestBackgroundFunctions(t *testing.T) {
+	tests := []struct {
+		name   string
+		src    string
+		output string
+	}{
+		{"alongside the shell", `f() { for i in 1 2 3; do :; done; }; f & f & for i in 1 2 3; do :; done; wait; echo done`, "done\n"},
+		{"return", `f() { return 3; }; f & wait %1; echo $?`, "3\n"},
+		{"$? of the job", `f() { false; echo $?; }; true; f & wait`, "1\n"},
+		{"return with $?", `f() { false; return; }; f & wait %1; echo $?`, "1\n"},
+		{"locals and read", `f() { local y=1; read x; echo "$x$y"; }; echo hi | f & wait`, "hi1\n"},
+		{"functions defined stay in the job", `{ h() { :; }; } & wait; type h >/dev/null 2>&1; echo $?`, "1\n"},
+		{"functions defined before are seen", `g() { echo g; }; { g; } & wait`, "g\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if output, _ := runScript(t, tt.src); output != tt.output {
+				t.Errorf("got %q, want %q", output, tt.output)
+			}
+		})
+	}
+}
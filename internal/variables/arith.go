@@ -0,0 +1,420 @@
+package variables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxArithDepth bounds how deeply variables holding expressions may refer
+// to one another, so that x=x fails instead of recursing forever.
+const maxArithDepth = 1024
+
+// arithOps are the arithmetic operators, longer ones first so that the
+// tokenizer takes the longest match.
+var arithOps = []string{
+	"<<=", ">>=",
+	"**", "++", "--", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=",
+	"<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "=", "!", "~", "&", "|", "^",
+	"?", ":", "(", ")", ",",
+}
+
+// EvalArithmetic evaluates expr as shell arithmetic: integer constants,
+// in hex with 0x and octal with a leading 0, variables, whose values may
+// be expressions themselves, and the C operators with their precedence,
+// including assignments, ++, -- and ?:. An unset or empty variable is 0.
+func (m *Manager) EvalArithmetic(expr string) (int, error) {
+	return m.evalArithmetic(expr, 0)
+}
+
+func (m *Manager) evalArithmetic(expr string, depth int) (int, error) {
+	if depth > maxArithDepth {
+		return 0, fmt.Errorf("%s: expression recursion level exceeded", expr)
+	}
+
+	tokens, err := arithTokens(expr)
+	if err != nil {
+		return 0, err
+	}
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+
+	a := &arith{m: m, expr: expr, tokens: tokens, depth: depth}
+	value, err := a.comma(true)
+	if err == nil && a.pos < len(a.tokens) {
+		err = a.errorf("syntax error in expression (error token is \"%s\")", strings.Join(a.tokens[a.pos:], " "))
+	}
+	return value, err
+}
+
+func arithTokens(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+			continue
+		case isNameByte(c, false):
+			end := i + 1
+			for end < len(expr) && isNameByte(expr[end], false) {
+				end++
+			}
+			tokens = append(tokens, expr[i:end])
+			i = end
+			continue
+		}
+
+		op := ""
+		for _, candidate := range arithOps {
+			if strings.HasPrefix(expr[i:], candidate) {
+				op = candidate
+				break
+			}
+		}
+		if op == "" {
+			return nil, fmt.Errorf("%s: syntax error: invalid arithmetic operator (error token is \"%s\")", expr, expr[i:])
+		}
+		tokens = append(tokens, op)
+		i += len(op)
+	}
+	return tokens, nil
+}
+
+// arith is a recursive-descent evaluator over the tokens of an
+// expression. Each method takes whether to evaluate what it parses, which
+// is false in a branch of &&, || or ?: that is skipped, so that the
+// branch's assignments do not happen.
+type arith struct {
+	m      *Manager
+	expr   string
+	tokens []string
+	pos    int
+	depth  int
+}
+
+func (a *arith) errorf(format string, args ...any) error {
+	return fmt.Errorf("%s: "+format, append([]any{a.expr}, args...)...)
+}
+
+func (a *arith) peek(offset int) string {
+	if a.pos+offset < len(a.tokens) {
+		return a.tokens[a.pos+offset]
+	}
+	return ""
+}
+
+// accept consumes the next token if it is one of ops and returns it.
+func (a *arith) accept(ops ...string) (string, bool) {
+	next := a.peek(0)
+	for _, op := range ops {
+		if next == op {
+			a.pos++
+			return op, true
+		}
+	}
+	return "", false
+}
+
+func (a *arith) comma(eval bool) (int, error) {
+	value, err := a.assign(eval)
+	for err == nil {
+		if _, ok := a.accept(","); !ok {
+			break
+		}
+		value, err = a.assign(eval)
+	}
+	return value, err
+}
+
+func (a *arith) assign(eval bool) (int, error) {
+	name, op := a.peek(0), a.peek(1)
+	if !isArithName(name) || !strings.HasSuffix(op, "=") || op == "==" || op == "!=" || op == "<=" || op == ">=" {
+		return a.ternary(eval)
+	}
+	a.pos += 2
+
+	value, err := a.assign(eval)
+	if err != nil || !eval {
+		return value, err
+	}
+	if op != "=" {
+		current, err := a.variable(name)
+		if err != nil {
+			return 0, err
+		}
+		if value, err = a.binary(strings.TrimSuffix(op, "="), current, value); err != nil {
+			return 0, err
+		}
+	}
+	return value, a.set(name, value)
+}
+
+func (a *arith) ternary(eval bool) (int, error) {
+	cond, err := a.or(eval)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := a.accept("?"); !ok {
+		return cond, nil
+	}
+
+	then, err := a.comma(eval && cond != 0)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := a.accept(":"); !ok {
+		return 0, a.errorf("syntax error: `:' expected for conditional expression")
+	}
+	otherwise, err := a.ternary(eval && cond == 0)
+	if err != nil {
+		return 0, err
+	}
+	if cond != 0 {
+		return then, nil
+	}
+	return otherwise, nil
+}
+
+func (a *arith) or(eval bool) (int, error) {
+	left, err := a.and(eval)
+	for err == nil {
+		if _, ok := a.accept("||"); !ok {
+			break
+		}
+		var right int
+		right, err = a.and(eval && left == 0)
+		left = boolInt(left != 0 || right != 0)
+	}
+	return left, err
+}
+
+func (a *arith) and(eval bool) (int, error) {
+	left, err := a.binaryLevel(eval, 0)
+	for err == nil {
+		if _, ok := a.accept("&&"); !ok {
+			break
+		}
+		var right int
+		right, err = a.binaryLevel(eval && left != 0, 0)
+		left = boolInt(left != 0 && right != 0)
+	}
+	return left, err
+}
+
+// binaryLevels are the left-associative binary operators from the
+// loosest binding to the tightest, below && and above **.
+var binaryLevels = [][]string{
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func (a *arith) binaryLevel(eval bool, level int) (int, error) {
+	if level == len(binaryLevels) {
+		return a.power(eval)
+	}
+
+	left, err := a.binaryLevel(eval, level+1)
+	for err == nil {
+		op, ok := a.accept(binaryLevels[level]...)
+		if !ok {
+			break
+		}
+		var right int
+		if right, err = a.binaryLevel(eval, level+1); err == nil && eval {
+			left, err = a.binary(op, left, right)
+		}
+	}
+	return left, err
+}
+
+func (a *arith) power(eval bool) (int, error) {
+	base, err := a.unary(eval)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := a.accept("**"); !ok {
+		return base, nil
+	}
+	exp, err := a.power(eval)
+	if err != nil || !eval {
+		return 0, err
+	}
+	return a.binary("**", base, exp)
+}
+
+func (a *arith) unary(eval bool) (int, error) {
+	if op, ok := a.accept("++", "--"); ok {
+		name := a.peek(0)
+		if !isArithName(name) {
+			return 0, a.errorf("syntax error: operand expected (error token is \"%s\")", op)
+		}
+		a.pos++
+		if !eval {
+			return 0, nil
+		}
+		value, err := a.variable(name)
+		if err != nil {
+			return 0, err
+		}
+		if op == "++" {
+			value++
+		} else {
+			value--
+		}
+		return value, a.set(name, value)
+	}
+
+	if op, ok := a.accept("!", "~", "-", "+"); ok {
+		value, err := a.unary(eval)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "!":
+			return boolInt(value == 0), nil
+		case "~":
+			return ^value, nil
+		case "-":
+			return -value, nil
+		}
+		return value, nil
+	}
+
+	return a.postfix(eval)
+}
+
+func (a *arith) postfix(eval bool) (int, error) {
+	tok := a.peek(0)
+	switch {
+	case tok == "":
+		return 0, a.errorf("syntax error: operand expected")
+	case tok == "(":
+		a.pos++
+		value, err := a.comma(eval)
+		if err != nil {
+			return 0, err
+		}
+		if _, ok := a.accept(")"); !ok {
+			return 0, a.errorf("missing `)'")
+		}
+		return value, nil
+	case tok[0] >= '0' && tok[0] <= '9':
+		a.pos++
+		value, err := strconv.ParseInt(tok, 0, 0)
+		if err != nil {
+			return 0, a.errorf("value too great for base (error token is \"%s\")", tok)
+		}
+		return int(value), nil
+	case !isArithName(tok):
+		return 0, a.errorf("syntax error: operand expected (error token is \"%s\")", strings.Join(a.tokens[a.pos:], " "))
+	}
+
+	a.pos++
+	if !eval {
+		a.accept("++", "--")
+		return 0, nil
+	}
+	value, err := a.variable(tok)
+	if err != nil {
+		return 0, err
+	}
+	if op, ok := a.accept("++", "--"); ok {
+		next := value + 1
+		if op == "--" {
+			next = value - 1
+		}
+		return value, a.set(tok, next)
+	}
+	return value, nil
+}
+
+// variable returns the value of name as a number, evaluating it if it
+// holds an expression.
+func (a *arith) variable(name string) (int, error) {
+	value := strings.TrimSpace(a.m.Get(name))
+	if value == "" {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n, nil
+	}
+	return a.m.evalArithmetic(value, a.depth+1)
+}
+
+func (a *arith) set(name string, value int) error {
+	return a.m.Set(name, strconv.Itoa(value))
+}
+
+func (a *arith) binary(op string, left, right int) (int, error) {
+	switch op {
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/", "%":
+		if right == 0 {
+			return 0, a.errorf("division by 0")
+		}
+		if op == "/" {
+			return left / right, nil
+		}
+		return left % right, nil
+	case "**":
+		if right < 0 {
+			return 0, a.errorf("exponent less than 0")
+		}
+		result := 1
+		for ; right > 0; right >>= 1 {
+			if right&1 == 1 {
+				result *= left
+			}
+			left *= left
+		}
+		return result, nil
+	case "<<":
+		return left << uint(right&63), nil
+	case ">>":
+		return left >> uint(right&63), nil
+	case "&":
+		return left & right, nil
+	case "|":
+		return left | right, nil
+	case "^":
+		return left ^ right, nil
+	case "==":
+		return boolInt(left == right), nil
+	case "!=":
+		return boolInt(left != right), nil
+	case "<":
+		return boolInt(left < right), nil
+	case "<=":
+		return boolInt(left <= right), nil
+	case ">":
+		return boolInt(left > right), nil
+	case ">=":
+		return boolInt(left >= right), nil
+	}
+	return 0, a.errorf("syntax error: invalid arithmetic operator (error token is \"%s\")", op)
+}
+
+func isArithName(tok string) bool {
+	return tok != "" && isNameByte(tok[0], true)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -7,6 +7,8 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Variable struct {
@@ -16,24 +18,66 @@ type Variable struct {
 	ReadOnly bool
 	Array    bool
 	Values   []string
+
+	Integer   bool
+	Lowercase bool
+	Uppercase bool
+	Assoc     bool
+	Map       map[string]string
+}
+
+func (v *Variable) clone() *Variable {
+	copied := *v
+	copied.Values = append([]string(nil), v.Values...)
+	if v.Map != nil {
+		copied.Map = make(map[string]string, len(v.Map))
+		for key, value := range v.Map {
+			copied.Map[key] = value
+		}
+	}
+	return &copied
+}
+
+// ValidName reports whether name can be used as a variable name.
+func ValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, r := range name {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return true
 }
 
 type Manager struct {
-	vars map[string]*Variable
-	mu   sync.RWMutex
+	vars    map[string]*Variable
+	scopes  []map[string]*Variable
+	dynamic map[string]func() string
+	mu      sync.RWMutex
 }
 
 func New() *Manager {
+	return NewWithEnv(os.Environ())
+}
+
+// NewWithEnv returns a Manager whose exported variables are exactly env,
+// given in os.Environ form. The manager is the only source of truth for
+// variables: the process environment is never consulted or modified, and
+// children see exports through Exported.
+func NewWithEnv(env []string) *Manager {
 	m := &Manager{
-		vars: make(map[string]*Variable),
+		vars:    make(map[string]*Variable),
+		dynamic: make(map[string]func() string),
 	}
 
-	m.loadEnvironment()
+	m.loadEnvironment(env)
 	return m
 }
 
-func (m *Manager) loadEnvironment() {
-	for _, env := range os.Environ() {
+func (m *Manager) loadEnvironment(env []string) {
+	for _, env := range env {
 		parts := strings.SplitN(env, "=", 2)
 		if len(parts) == 2 {
 			m.vars[parts[0]] = &Variable{
@@ -46,58 +90,334 @@ func (m *Manager) loadEnvironment() {
 	}
 }
 
+// PushScope starts a function-local scope. Variables declared with Local
+// live in it until the matching PopScope; every other assignment goes to
+// the innermost scope already holding the name, or to the globals.
+func (m *Manager) PushScope() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.scopes = append(m.scopes, make(map[string]*Variable))
+}
+
+func (m *Manager) PopScope() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.scopes) > 0 {
+		m.scopes = m.scopes[:len(m.scopes)-1]
+	}
+}
+
+// InFunction reports whether a function-local scope is active.
+func (m *Manager) InFunction() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.scopes) > 0
+}
+
+// Local declares name in the innermost function scope. Like bash, the new
+// local starts unset but keeps the export attribute of the variable it
+// shadows, so children still see the name in their environment.
+func (m *Manager) Local(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.scopes) == 0 {
+		return fmt.Errorf("can only be used in a function")
+	}
+
+	scope := m.scopes[len(m.scopes)-1]
+	if _, exists := scope[name]; exists {
+		return nil
+	}
+
+	exported := false
+	if v, exists := m.lookup(name); exists {
+		if v.ReadOnly {
+			return fmt.Errorf("%s: readonly variable", name)
+		}
+		exported = v.Exported
+	}
+
+	scope[name] = &Variable{Name: name, Exported: exported}
+	return nil
+}
+
+// SetLocal declares name in the innermost function scope and assigns it.
+func (m *Manager) SetLocal(name, value string) error {
+	if err := m.Local(name); err != nil {
+		return err
+	}
+	return m.Set(name, value)
+}
+
+// lookup returns the visible variable called name. Callers hold m.mu.
+func (m *Manager) lookup(name string) (*Variable, bool) {
+	for i := len(m.scopes) - 1; i >= 0; i-- {
+		if v, exists := m.scopes[i][name]; exists {
+			return v, true
+		}
+	}
+	v, exists := m.vars[name]
+	return v, exists
+}
+
+// scopeOf returns the innermost scope holding name, or the globals if no
+// function scope does. Callers hold m.mu.
+func (m *Manager) scopeOf(name string) map[string]*Variable {
+	for i := len(m.scopes) - 1; i >= 0; i-- {
+		if _, exists := m.scopes[i][name]; exists {
+			return m.scopes[i]
+		}
+	}
+	return m.vars
+}
+
+// visible returns every variable in view, locals shadowing globals.
+// Callers hold m.mu.
+func (m *Manager) visible() map[string]*Variable {
+	if len(m.scopes) == 0 {
+		return m.vars
+	}
+
+	merged := make(map[string]*Variable, len(m.vars))
+	for name, v := range m.vars {
+		merged[name] = v
+	}
+	for _, scope := range m.scopes {
+		for name, v := range scope {
+			merged[name] = v
+		}
+	}
+	return merged
+}
+
 func (m *Manager) Set(name, value string) error {
+	value = m.transform(name, value)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if existing, exists := m.vars[name]; exists && existing.ReadOnly {
+	existing, exists := m.lookup(name)
+	if !exists {
+		m.scopeOf(name)[name] = &Variable{Name: name, Value: value}
+		return nil
+	}
+	if existing.ReadOnly {
 		return fmt.Errorf("variable %s is read-only", name)
 	}
 
-	exported := false
-	if existing, exists := m.vars[name]; exists {
-		exported = existing.Exported
+	// Assigning to an array without a subscript sets element zero.
+	switch {
+	case existing.Assoc:
+		existing.Map["0"] = value
+	case existing.Array:
+		if len(existing.Values) == 0 {
+			existing.Values = []string{""}
+		}
+		existing.Values[0] = value
+		value = strings.Join(existing.Values, " ")
 	}
+	existing.Value = value
 
-	m.vars[name] = &Variable{
-		Name:     name,
-		Value:    value,
-		Exported: exported,
-		ReadOnly: false,
+	return nil
+}
+
+// transform applies the integer and case attributes of name to a value
+// being assigned to it.
+func (m *Manager) transform(name, value string) string {
+	m.mu.RLock()
+	v, exists := m.lookup(name)
+	var integer, lower, upper bool
+	if exists {
+		integer, lower, upper = v.Integer, v.Lowercase, v.Uppercase
 	}
+	m.mu.RUnlock()
 
-	if exported {
-		os.Setenv(name, value)
+	switch {
+	case integer:
+		n, err := m.EvalArithmetic(value)
+		if err != nil {
+			n = 0
+		}
+		return strconv.Itoa(n)
+	case lower:
+		return strings.ToLower(value)
+	case upper:
+		return strings.ToUpper(value)
+	}
+	return value
+}
+
+// SetAttribute turns one of the declare attributes on or off for name,
+// creating the variable if needed. attr is the declare flag letter: i, l,
+// u, x, r, a or A.
+func (m *Manager) SetAttribute(name string, attr rune, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, exists := m.lookup(name)
+	if !exists {
+		v = &Variable{Name: name}
+		m.scopeOf(name)[name] = v
+	}
+
+	switch attr {
+	case 'i':
+		v.Integer = enabled
+	case 'l':
+		v.Lowercase = enabled
+		v.Uppercase = v.Uppercase && !enabled
+	case 'u':
+		v.Uppercase = enabled
+		v.Lowercase = v.Lowercase && !enabled
+	case 'x':
+		v.Exported = enabled
+	case 'r':
+		if !enabled && v.ReadOnly {
+			return fmt.Errorf("%s: readonly variable", name)
+		}
+		v.ReadOnly = enabled
+	case 'a':
+		if !enabled {
+			if v.Array {
+				return fmt.Errorf("%s: cannot destroy array variables in this way", name)
+			}
+			return nil
+		}
+		if v.Assoc {
+			return fmt.Errorf("%s: cannot convert associative to indexed array", name)
+		}
+		if !v.Array {
+			v.Array = true
+			if v.Value != "" {
+				v.Values = []string{v.Value}
+			}
+		}
+	case 'A':
+		if !enabled {
+			if v.Assoc {
+				return fmt.Errorf("%s: cannot destroy array variables in this way", name)
+			}
+			return nil
+		}
+		if v.Array {
+			return fmt.Errorf("%s: cannot convert indexed to associative array", name)
+		}
+		if !v.Assoc {
+			v.Assoc = true
+			v.Map = make(map[string]string)
+			if v.Value != "" {
+				v.Map["0"] = v.Value
+			}
+		}
+	default:
+		return fmt.Errorf("-%c: invalid attribute", attr)
 	}
 
 	return nil
 }
 
+func (m *Manager) SetAssocElement(name, key, value string) error {
+	value = m.transform(name, value)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	v, exists := m.lookup(name)
+	if !exists || !v.Assoc {
+		return fmt.Errorf("variable %s is not an associative array", name)
+	}
+	if v.ReadOnly {
+		return fmt.Errorf("variable %s is read-only", name)
+	}
+
+	v.Map[key] = value
+	return nil
+}
+
+func (m *Manager) GetAssocElement(name, key string) string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if v, exists := m.lookup(name); exists && v.Assoc {
+		return v.Map[key]
+	}
+
+	return ""
+}
+
+// SetDynamic makes name a variable whose value is computed by fn each
+// time it is read, like RANDOM or SECONDS. Unsetting name removes fn.
+func (m *Manager) SetDynamic(name string, fn func() string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dynamic[name] = fn
+}
+
 func (m *Manager) Get(name string) string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if v, exists := m.vars[name]; exists {
+	if fn, exists := m.dynamic[name]; exists {
+		return fn()
+	}
+
+	if v, exists := m.lookup(name); exists {
 		return v.Value
 	}
 
-	return os.Getenv(name)
+	return ""
+}
+
+// IsSet reports whether name is set, even if to the empty string.
+func (m *Manager) IsSet(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if _, exists := m.dynamic[name]; exists {
+		return true
+	}
+	_, exists := m.lookup(name)
+	return exists
+}
+
+// Snapshot records the current state of name and returns a function that
+// restores it, for assignments that last only for a single command.
+func (m *Manager) Snapshot(name string) func() {
+	m.mu.RLock()
+	saved, exists := m.lookup(name)
+	if exists {
+		saved = saved.clone()
+	}
+	m.mu.RUnlock()
+
+	return func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if exists {
+			m.scopeOf(name)[name] = saved
+		} else {
+			delete(m.scopeOf(name), name)
+		}
+	}
 }
 
 func (m *Manager) Export(name string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if v, exists := m.vars[name]; exists {
+	if v, exists := m.lookup(name); exists {
 		v.Exported = true
-		os.Setenv(name, v.Value)
 		return nil
 	}
 
-	value := os.Getenv(name)
-	m.vars[name] = &Variable{
+	m.scopeOf(name)[name] = &Variable{
 		Name:     name,
-		Value:    value,
 		Exported: true,
 		ReadOnly: false,
 	}
@@ -105,16 +425,26 @@ func (m *Manager) Export(name string) error {
 	return nil
 }
 
+// Unexport removes the export attribute from name, keeping its value.
+func (m *Manager) Unexport(name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if v, exists := m.lookup(name); exists {
+		v.Exported = false
+	}
+}
+
 func (m *Manager) Unset(name string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if v, exists := m.vars[name]; exists && v.ReadOnly {
+	if v, exists := m.lookup(name); exists && v.ReadOnly {
 		return fmt.Errorf("variable %s is read-only", name)
 	}
 
-	delete(m.vars, name)
-	os.Unsetenv(name)
+	delete(m.scopeOf(name), name)
+	delete(m.dynamic, name)
 
 	return nil
 }
@@ -123,7 +453,7 @@ func (m *Manager) SetReadOnly(name string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if v, exists := m.vars[name]; exists {
+	if v, exists := m.lookup(name); exists {
 		v.ReadOnly = true
 		return nil
 	}
@@ -135,7 +465,7 @@ func (m *Manager) IsExported(name string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if v, exists := m.vars[name]; exists {
+	if v, exists := m.lookup(name); exists {
 		return v.Exported
 	}
 
@@ -146,7 +476,7 @@ func (m *Manager) IsReadOnly(name string) bool {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if v, exists := m.vars[name]; exists {
+	if v, exists := m.lookup(name); exists {
 		return v.ReadOnly
 	}
 
@@ -158,15 +488,8 @@ func (m *Manager) All() map[string]*Variable {
 	defer m.mu.RUnlock()
 
 	result := make(map[string]*Variable)
-	for k, v := range m.vars {
-		result[k] = &Variable{
-			Name:     v.Name,
-			Value:    v.Value,
-			Exported: v.Exported,
-			ReadOnly: v.ReadOnly,
-			Array:    v.Array,
-			Values:   append([]string{}, v.Values...),
-		}
+	for k, v := range m.visible() {
+		result[k] = v.clone()
 	}
 
 	return result
@@ -177,7 +500,7 @@ func (m *Manager) Exported() []string {
 	defer m.mu.RUnlock()
 
 	var exported []string
-	for _, v := range m.vars {
+	for _, v := range m.visible() {
 		if v.Exported {
 			exported = append(exported, fmt.Sprintf("%s=%s", v.Name, v.Value))
 		}
@@ -188,39 +511,98 @@ func (m *Manager) Exported() []string {
 }
 
 func (m *Manager) SetArray(name string, values []string) error {
+	transformed := make([]string, len(values))
+	for i, value := range values {
+		transformed[i] = m.transform(name, value)
+	}
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if existing, exists := m.vars[name]; exists && existing.ReadOnly {
+	v, exists := m.lookup(name)
+	if !exists {
+		v = &Variable{Name: name}
+		m.scopeOf(name)[name] = v
+	}
+	if v.ReadOnly {
 		return fmt.Errorf("variable %s is read-only", name)
 	}
 
-	exported := false
-	if existing, exists := m.vars[name]; exists {
-		exported = existing.Exported
-	}
+	v.Array = true
+	v.Values = transformed
+	v.Value = strings.Join(transformed, " ")
 
-	m.vars[name] = &Variable{
-		Name:     name,
-		Value:    strings.Join(values, " "),
-		Exported: exported,
-		ReadOnly: false,
-		Array:    true,
-		Values:   append([]string{}, values...),
+	return nil
+}
+
+// AssignCompound assigns the elements of an array literal such as
+// (a [5]=b c) to name. An element written [key]=value sets that index, or
+// that key when name is an associative array; any other element takes the
+// index after the one before it.
+func (m *Manager) AssignCompound(name string, elems []string) error {
+	m.mu.RLock()
+	v, exists := m.lookup(name)
+	assoc := exists && v.Assoc
+	m.mu.RUnlock()
+
+	if assoc {
+		values := make(map[string]string, len(elems))
+		for _, elem := range elems {
+			key, value, ok := subscripted(elem)
+			if !ok {
+				return fmt.Errorf("%s: %s: must use subscript when assigning associative array", name, elem)
+			}
+			values[key] = m.transform(name, value)
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		v, _ := m.lookup(name)
+		if v.ReadOnly {
+			return fmt.Errorf("variable %s is read-only", name)
+		}
+		v.Map = values
+		return nil
 	}
 
-	if exported {
-		os.Setenv(name, strings.Join(values, " "))
+	var values []string
+	next := 0
+	for _, elem := range elems {
+		index := next
+		if key, value, ok := subscripted(elem); ok {
+			n, err := strconv.Atoi(key)
+			if err != nil || n < 0 {
+				return fmt.Errorf("%s: bad array subscript", key)
+			}
+			index, elem = n, value
+		}
+		for len(values) <= index {
+			values = append(values, "")
+		}
+		values[index] = elem
+		next = index + 1
 	}
+	return m.SetArray(name, values)
+}
 
-	return nil
+// subscripted splits an array literal element of the form [key]=value.
+func subscripted(elem string) (key, value string, ok bool) {
+	if !strings.HasPrefix(elem, "[") {
+		return "", "", false
+	}
+	end := strings.Index(elem, "]=")
+	if end < 0 {
+		return "", "", false
+	}
+	return elem[1:end], elem[end+2:], true
 }
 
 func (m *Manager) GetArray(name string) []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if v, exists := m.vars[name]; exists && v.Array {
+	if v, exists := m.lookup(name); exists && v.Array {
 		return append([]string{}, v.Values...)
 	}
 
@@ -228,21 +610,23 @@ func (m *Manager) GetArray(name string) []string {
 }
 
 func (m *Manager) SetArrayElement(name string, index int, value string) error {
+	value = m.transform(name, value)
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	if existing, exists := m.vars[name]; exists && existing.ReadOnly {
+	if existing, exists := m.lookup(name); exists && existing.ReadOnly {
 		return fmt.Errorf("variable %s is read-only", name)
 	}
 
-	v, exists := m.vars[name]
+	v, exists := m.lookup(name)
 	if !exists {
 		v = &Variable{
 			Name:   name,
 			Array:  true,
 			Values: []string{},
 		}
-		m.vars[name] = v
+		m.scopeOf(name)[name] = v
 	}
 
 	if !v.Array {
@@ -256,10 +640,6 @@ func (m *Manager) SetArrayElement(name string, index int, value string) error {
 	v.Values[index] = value
 	v.Value = strings.Join(v.Values, " ")
 
-	if v.Exported {
-		os.Setenv(name, v.Value)
-	}
-
 	return nil
 }
 
@@ -267,7 +647,7 @@ func (m *Manager) GetArrayElement(name string, index int) string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	if v, exists := m.vars[name]; exists && v.Array {
+	if v, exists := m.lookup(name); exists && v.Array {
 		if index >= 0 && index < len(v.Values) {
 			return v.Values[index]
 		}
@@ -276,65 +656,276 @@ func (m *Manager) GetArrayElement(name string, index int) string {
 	return ""
 }
 
-func (m *Manager) SubstituteVariables(text string) string {
-	result := text
+// Parameter returns the value of the parameter reference inside ${...}:
+// a name, an element name[index] or name[key], all elements name[@] or
+// name[*], the indices !name[@], an indirect reference !name, the
+// length #name or #name[@], or the value of an arithmetic expression
+// given as (expression), which is empty if it is not valid. name=word
+// first assigns word to name if it is unset, and name:=word also if it
+// is empty.
+func (m *Manager) Parameter(expr string) string {
+	if name, word, colon, ok := defaultAssignment(expr); ok {
+		if !m.IsSet(name) || colon && m.Get(name) == "" {
+			m.Set(name, word)
+		}
+		return m.Get(name)
+	}
+
+	switch {
+	case len(expr) > 1 && expr[0] == '(' && expr[len(expr)-1] == ')':
+		n, err := m.EvalArithmetic(expr[1 : len(expr)-1])
+		if err != nil {
+			return ""
+		}
+		return strconv.Itoa(n)
+	case len(expr) > 1 && expr[0] == '#':
+		if name, sub, ok := subscript(expr[1:]); ok && (sub == "@" || sub == "*") {
+			return strconv.Itoa(len(m.Elements(name)))
+		}
+		return strconv.Itoa(utf8.RuneCountInString(m.Parameter(expr[1:])))
+	case len(expr) > 1 && expr[0] == '!':
+		if name, sub, ok := subscript(expr[1:]); ok && (sub == "@" || sub == "*") {
+			return strings.Join(m.Indices(name), " ")
+		}
+		return m.Parameter(m.Get(expr[1:]))
+	}
+
+	name, sub, ok := subscript(expr)
+	if !ok {
+		return m.Get(expr)
+	}
+	if sub == "@" || sub == "*" {
+		return strings.Join(m.Elements(name), " ")
+	}
+	return m.element(name, sub)
+}
 
+// defaultAssignment splits name:=word or name=word into its parts.
+func defaultAssignment(expr string) (name, word string, colon, ok bool) {
+	eq := strings.IndexByte(expr, '=')
+	if eq <= 0 {
+		return "", "", false, false
+	}
+	name, colon = strings.CutSuffix(expr[:eq], ":")
+	for i := 0; i < len(name); i++ {
+		if !isNameByte(name[i], i == 0) {
+			return "", "", false, false
+		}
+	}
+	return name, expr[eq+1:], colon, name != ""
+}
+
+// subscript splits name[sub] into its parts.
+func subscript(expr string) (name, sub string, ok bool) {
+	open := strings.IndexByte(expr, '[')
+	if open <= 0 || !strings.HasSuffix(expr, "]") {
+		return "", "", false
+	}
+	return expr[:open], expr[open+1 : len(expr)-1], true
+}
+
+func (m *Manager) element(name, sub string) string {
+	m.mu.RLock()
+	v, exists := m.lookup(name)
+	if exists && v.Assoc {
+		value := v.Map[sub]
+		m.mu.RUnlock()
+		return value
+	}
+	m.mu.RUnlock()
+	if !exists {
+		return ""
+	}
+
+	// Indexed subscripts are arithmetic, so both a[i] and a[$i] work.
+	index, err := strconv.Atoi(sub)
+	if err != nil {
+		if index, err = m.EvalArithmetic(strings.ReplaceAll(sub, "$", "")); err != nil {
+			return ""
+		}
+	}
+
+	values := m.Elements(name)
+	if index < 0 {
+		index += len(values)
+	}
+	if index < 0 || index >= len(values) {
+		return ""
+	}
+	return values[index]
+}
+
+// Elements returns the values of an array in index order, the values of
+// an associative array in key order, or a set scalar as a single element.
+func (m *Manager) Elements(name string) []string {
 	m.mu.RLock()
 	defer m.mu.RUnlock()
 
-	for name, variable := range m.vars {
-		result = strings.ReplaceAll(result, "$"+name, variable.Value)
-		result = strings.ReplaceAll(result, "${"+name+"}", variable.Value)
+	v, exists := m.lookup(name)
+	switch {
+	case !exists:
+		return nil
+	case v.Assoc:
+		values := make([]string, 0, len(v.Map))
+		for _, key := range sortedKeys(v.Map) {
+			values = append(values, v.Map[key])
+		}
+		return values
+	case v.Array:
+		return append([]string{}, v.Values...)
 	}
+	return []string{v.Value}
+}
 
-	result = strings.ReplaceAll(result, "$$", strconv.Itoa(os.Getpid()))
-	result = strings.ReplaceAll(result, "$?", "0")
+// Indices returns the subscripts matching Elements.
+func (m *Manager) Indices(name string) []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	return result
+	v, exists := m.lookup(name)
+	switch {
+	case !exists:
+		return nil
+	case v.Assoc:
+		return sortedKeys(v.Map)
+	case v.Array:
+		indices := make([]string, len(v.Values))
+		for i := range indices {
+			indices[i] = strconv.Itoa(i)
+		}
+		return indices
+	}
+	return []string{"0"}
 }
 
-func (m *Manager) EvalArithmetic(expr string) (int, error) {
-	// very limited: supports VAR op INT or INT op VAR or INT op INT with + - * /
-	expr = strings.TrimSpace(expr)
-	ops := []string{"+", "-", "*", "/"}
-	for _, op := range ops {
-		if strings.Contains(expr, op) {
-			parts := strings.Split(expr, op)
-			if len(parts) != 2 {
-				return 0, fmt.Errorf("bad expression")
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// SplitFields splits text into fields on the characters of IFS, which is
+// looked up on every call so that a change takes effect immediately. IFS
+// whitespace runs are collapsed and trimmed while every other IFS
+// character ends a field. With n >= 0 at most n fields are returned, the
+// last holding the rest of the text as read assigns it.
+func (m *Manager) SplitFields(text string, n int) []string {
+	ifs := " \t\n"
+	if m.IsSet("IFS") {
+		ifs = m.Get("IFS")
+	}
+	if ifs == "" {
+		if text == "" || n == 0 {
+			return nil
+		}
+		return []string{text}
+	}
+
+	isSpace := func(r rune) bool {
+		return strings.ContainsRune(ifs, r) && strings.ContainsRune(" \t\n", r)
+	}
+	isSeparator := func(r rune) bool {
+		return strings.ContainsRune(ifs, r)
+	}
+
+	var fields []string
+	text = strings.TrimLeftFunc(text, isSpace)
+	for text != "" && n != 0 {
+		if n > 0 && len(fields) == n-1 {
+			fields = append(fields, strings.TrimRightFunc(text, isSpace))
+			break
+		}
+
+		end := strings.IndexFunc(text, isSeparator)
+		if end < 0 {
+			fields = append(fields, text)
+			break
+		}
+		fields = append(fields, text[:end])
+
+		// IFS whitespace around a non-whitespace separator belongs to it.
+		sep, size := utf8.DecodeRuneInString(text[end:])
+		text = strings.TrimLeftFunc(text[end+size:], isSpace)
+		if r, size := utf8.DecodeRuneInString(text); isSpace(sep) && text != "" && isSeparator(r) {
+			text = strings.TrimLeftFunc(text[size:], isSpace)
+		}
+	}
+
+	return fields
+}
+
+// SubstituteVariables replaces $name, ${name}, $$ and $? in text in a
+// single scan, taking characters escaped with a backslash as they are. $name
+// takes the longest run of name characters, and references to unset
+// variables are left as written.
+func (m *Manager) SubstituteVariables(text string) string {
+	if !strings.ContainsAny(text, "$\\") {
+		return text
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var b strings.Builder
+	b.Grow(len(text))
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' && i+1 < len(text) {
+			i++
+			b.WriteByte(text[i])
+			continue
+		}
+		if text[i] != '$' || i+1 == len(text) {
+			b.WriteByte(text[i])
+			continue
+		}
+
+		switch next := text[i+1]; {
+		case next == '$':
+			b.WriteString(strconv.Itoa(os.Getpid()))
+			i++
+		case next == '?':
+			if fn := m.dynamic["?"]; fn != nil {
+				b.WriteString(fn())
+			} else {
+				b.WriteString("0")
 			}
-			aStr := strings.TrimSpace(parts[0])
-			bStr := strings.TrimSpace(parts[1])
-			aVal, err := m.arithOperand(aStr)
-			if err != nil {
-				return 0, err
+			i++
+		case next == '{':
+			end := strings.IndexByte(text[i+2:], '}')
+			if end < 0 {
+				b.WriteByte('$')
+				continue
 			}
-			bVal, err := m.arithOperand(bStr)
-			if err != nil {
-				return 0, err
+			if v, exists := m.lookup(text[i+2 : i+2+end]); exists {
+				b.WriteString(v.Value)
+			} else {
+				b.WriteString(text[i : i+3+end])
 			}
-			switch op {
-			case "+":
-				return aVal + bVal, nil
-			case "-":
-				return aVal - bVal, nil
-			case "*":
-				return aVal * bVal, nil
-			case "/":
-				if bVal == 0 {
-					return 0, fmt.Errorf("division by zero")
-				}
-				return aVal / bVal, nil
+			i += 2 + end
+		case isNameByte(next, true):
+			j := i + 2
+			for j < len(text) && isNameByte(text[j], false) {
+				j++
 			}
+			if v, exists := m.lookup(text[i+1 : j]); exists {
+				b.WriteString(v.Value)
+			} else {
+				b.WriteString(text[i:j])
+			}
+			i = j - 1
+		default:
+			b.WriteByte('$')
 		}
 	}
-	return m.arithOperand(expr)
+
+	return b.String()
 }
 
-func (m *Manager) arithOperand(tok string) (int, error) {
-	if v, err := strconv.Atoi(tok); err == nil {
-		return v, nil
-	}
-	val := m.Get(tok)
-	return strconv.Atoi(val)
+// isNameByte reports whether c can appear in a variable name, at its
+// start if first is set.
+func isNameByte(c byte, first bool) bool {
+	return c == '_' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || !first && '0' <= c && c <= '9'
 }
@@ -0,0 +1,124 @@
+package variables
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestExported(t *testing.T) {
+	m := NewWithEnv([]string{"HOME=/home/u", "EMPTY="})
+	m.Set("plain", "p")
+	m.Set("shared", "s")
+	m.Export("shared")
+	m.Export("later")
+	m.Set("later", "l")
+	m.Set("gone", "g")
+	m.Export("gone")
+	m.Unset("gone")
+
+	want := []string{"EMPTY=", "HOME=/home/u", "later=l", "shared=s"}
+	if got := m.Exported(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Exported() = %q, want %q", got, want)
+	}
+	for _, name := range []string{"plain", "shared", "later", "gone"} {
+		if _, set := os.LookupEnv(name); set {
+			t.Errorf("%s was set in the process environment", name)
+		}
+	}
+}
+
+// TestConcurrentExport runs under go test -race to check that the
+// manager, not the process environment, holds exported variables.
+func TestConcurrentExport(t *testing.T) {
+	m := NewWithEnv(nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("GOSH_RACE_%d", i)
+			for j := 0; j < 100; j++ {
+				m.Set(name, fmt.Sprint(j))
+				m.Export(name)
+				m.Exported()
+				m.Get(name)
+				if j%10 == 9 {
+					m.Unset(name)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 8; i++ {
+		if _, set := os.LookupEnv(fmt.Sprintf("GOSH_RACE_%d", i)); set {
+			t.Errorf("GOSH_RACE_%d was set in the process environment", i)
+		}
+	}
+}
+
+func TestSubstituteVariables(t *testing.T) {
+	m := NewWithEnv([]string{"HOME=/home/u", "HOMEDIR=/srv", "A=1", "AB=2"})
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"plain", "plain"},
+		{"$HOME", "/home/u"},
+		{"$HOMEDIR", "/srv"},
+		{"${HOME}DIR", "/home/uDIR"},
+		{"$A$AB", "12"},
+		{"$ABC", "$ABC"},
+		{"${nope}", "${nope}"},
+		{`\$HOME`, "$HOME"},
+		{"cost: 5$", "cost: 5$"},
+		{"$HOME/$A", "/home/u/1"},
+		{"${HOME", "${HOME"},
+	}
+	for _, tt := range tests {
+		if got := m.SubstituteVariables(tt.text); got != tt.want {
+			t.Errorf("SubstituteVariables(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestParameterDefaultAssignment(t *testing.T) {
+	m := NewWithEnv([]string{"SET=s", "EMPTY="})
+	tests := []struct {
+		expr  string
+		want  string
+		value string
+	}{
+		{"UNSET:=d", "d", "d"},
+		{"UNSET2=d", "d", "d"},
+		{"SET:=d", "s", "s"},
+		{"SET=d", "s", "s"},
+		{"EMPTY=d", "", ""},
+		{"EMPTY:=d", "d", "d"},
+		{"WORD:=a=b", "a=b", "a=b"},
+	}
+	for _, tt := range tests {
+		if got := m.Parameter(tt.expr); got != tt.want {
+			t.Errorf("Parameter(%q) = %q, want %q", tt.expr, got, tt.want)
+		}
+		name, _, _ := strings.Cut(strings.Replace(tt.expr, ":=", "=", 1), "=")
+		if got := m.Get(name); got != tt.value {
+			t.Errorf("after Parameter(%q), %s = %q, want %q", tt.expr, name, got, tt.value)
+		}
+	}
+}
+
+func BenchmarkSubstituteVariables(b *testing.B) {
+	env := make([]string, 500)
+	for i := range env {
+		env[i] = fmt.Sprintf("VAR_%d=value %d", i, i)
+	}
+	m := NewWithEnv(env)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.SubstituteVariables("$VAR_1 and ${VAR_250}/$VAR_499")
+	}
+}
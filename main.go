@@ -42,19 +42,25 @@ func main() {
 func printUsage() {
 	fmt.Printf(`gosh %s - Go Shell
 
-Usage: gosh [options] [script] [args...]
+Usage: gosh [options] [--] [script] [args...]
 
 Options:
-  -c <cmd>      Execute command and exit
+  -c <cmd> [name [args...]]
+                Execute command and exit, with name as $0 and args as $1, ...
+  -O, --command-file <file> [args...]
+                Run a whole file like -c, with args as $1, $2, ...
   -i            Interactive mode
   -l, --login   Login shell
-  -s            Read from stdin
+  -s [args...]  Read from stdin, with args as $1, $2, ...
   --version     Show version
   --help        Show help
   --norc        Skip ~/.goshrc
   --noprofile   Skip profile files
   --posix       POSIX mode
   --debug       Debug mode
+  --json        Report each command as a JSON object (with -c or stdin)
+  --timeout <n> Kill external commands after n seconds (exit 124)
+  --            End options; the next word is the script
 
 Examples:
   gosh                 # Interactive
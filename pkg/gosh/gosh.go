@@ -0,0 +1,55 @@
+// Package gosh embeds the gosh shell in another Go program.
+//
+// A Shell created with New runs scripts in-process. It never terminates
+// the host process and does not install signal handlers; `exit` in a
+// script only stops that Shell. Its variables are its own and never
+// reach the host environment, but the working directory is the
+// process's: `cd` in a script changes it for the host and for every
+// other Shell as well.
+package gosh
+
+import (
+	"io"
+
+	"gosh/internal/shell"
+)
+
+// Options configures a Shell. Zero values fall back to the host
+// process's stdin, stdout, stderr and environment.
+type Options struct {
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// Env is the starting environment in os.Environ form ("NAME=value").
+	// A nil Env inherits the host environment; use an empty, non-nil
+	// slice to start with no variables.
+	Env []string
+}
+
+// Shell is an embedded gosh interpreter. Variables and other state
+// persist across calls to RunString.
+type Shell struct {
+	sh *shell.Shell
+}
+
+// New returns a Shell configured by opts.
+func New(opts Options) *Shell {
+	return &Shell{
+		sh: shell.NewWithOptions(shell.Options{
+			Stdin:    opts.Stdin,
+			Stdout:   opts.Stdout,
+			Stderr:   opts.Stderr,
+			Env:      opts.Env,
+			Embedded: true,
+		}),
+	}
+}
+
+// RunString parses and runs src and returns the exit status of the last
+// command executed. err is non-nil only when src fails to parse, in which
+// case exitCode is 2. After a script runs `exit`, further calls return the
+// exit status without running anything.
+func (s *Shell) RunString(src string) (exitCode int, err error) {
+	return s.sh.RunString(src)
+}
@@ -0,0 +1,34 @@
+package gosh
+
+import (
+	"io"
+	"os"
+	"testing"
+)
+
+func TestHostEnvironment(t *testing.T) {
+	t.Setenv("GOSH_TEST", "host")
+	tests := []struct {
+		name string
+		src  string
+	}{
+		{"assign", "GOSH_TEST=shell"},
+		{"export", "export GOSH_TEST=shell GOSH_NEW=1"},
+		{"unset", "unset GOSH_TEST"},
+		{"exit", "export GOSH_NEW=1; exit 3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(Options{Stdout: io.Discard, Stderr: io.Discard})
+			if _, err := s.RunString(tt.src); err != nil {
+				t.Fatal(err)
+			}
+			if got := os.Getenv("GOSH_TEST"); got != "host" {
+				t.Errorf("GOSH_TEST = %q in the host, want host", got)
+			}
+			if _, set := os.LookupEnv("GOSH_NEW"); set {
+				t.Error("GOSH_NEW was set in the host")
+			}
+		})
+	}
+}